@@ -2,28 +2,72 @@ package authz
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/seslattery/gcpsudobot/config"
 	"github.com/seslattery/gcpsudobot/gcp"
 	. "github.com/seslattery/gcpsudobot/types"
 )
 
+var ErrDurationTooLong = errors.New("requested duration is too long")
+
+// ErrAccountRequirements is wrapped with what's wrong with the requestor's account, so it can be shown to them
+var ErrAccountRequirements = errors.New("the requestor's google account doesn't meet the rule's requirements")
+
+// ErrApproverNotAuthorized is wrapped with the reason the approver can't approve, so it can be shown to them
+var ErrApproverNotAuthorized = errors.New("you can't approve or deny this request")
+
 func AuthorizeRequest(ctx context.Context, p *PolicyRules, r *EscalationRequest, gs *gcp.Service) (bool, error) {
 	if !strings.HasSuffix(string(r.Requestor), fmt.Sprintf("@%s", config.Cfg.ValidDomain)) {
 		return false, fmt.Errorf("unauthorized user, not from %s: %v", config.Cfg.ValidDomain, r.Requestor)
 	}
-	groups, err := gcp.ListGoogleGroups(ctx, r.Requestor, config.Cfg.ValidDomain, gs)
+	groups, err := listGroups(ctx, p, r, r.Requestor, gs)
 	r.Groups = groups
 	if err != nil {
 		return false, fmt.Errorf("can't get group membership for user: %v: %s", r.Requestor, err)
 	}
-	if authz(p, r) {
-		return true, nil
+	// Only look up the hierarchy when a rule could use it
+	r.Ancestors = nil
+	if p.Inherits() {
+		ancestors, err := gcp.ListAncestors(ctx, r.Resource, gs)
+		if err != nil {
+			return false, fmt.Errorf("can't get ancestry for resource: %v: %s", r.Resource, err)
+		}
+		r.Ancestors = ancestors
+	}
+	// Only look up the account when a rule that could authorize the request has requirements on it.
+	// If it can't be looked up, those rules don't authorize it but the others still can.
+	r.Account = nil
+	if checksAccount(p, r) {
+		account, err := gcp.GetAccount(ctx, r.Requestor, gs)
+		if err != nil {
+			slog.Error(fmt.Sprintf("can't get google account for user: %v: %s", r.Requestor, err))
+		}
+		r.Account = account
+	}
+	rules := matchingRules(p, r)
+	if len(rules) == 0 {
+		if problems := accountProblems(p, r); len(problems) > 0 {
+			return false, fmt.Errorf("%w: %s", ErrAccountRequirements, strings.Join(problems, ", "))
+		}
+		return false, nil
+	}
+	// The first matching rule in the policy decides the duration when the requestor didn't pick one
+	if r.Duration == 0 {
+		r.Duration = Duration(rules[0].GrantDefaultDuration(config.Cfg.DefaultGrantDuration()))
 	}
-	return false, nil
+	if !authz(p, r) {
+		if total, err := r.CumulativeDuration(); r.IsExtension() && err == nil {
+			return false, fmt.Errorf("%w: extending by %v, for %v in total, is longer than the rule allows", ErrDurationTooLong, r.Duration, Duration(total))
+		}
+		return false, fmt.Errorf("%w: %v is longer than the rule allows", ErrDurationTooLong, r.Duration)
+	}
+	return true, nil
 }
 
 // Validates the EscalationApproval, and if succesful, proceeds to generate a conditional IAM Grant
@@ -37,39 +81,209 @@ func AuthorizeApprovalAndGrantIAM(ctx context.Context, p *PolicyRules, a *Escala
 	if !ok {
 		return fmt.Errorf("double checking authorization failed")
 	}
+	if a.CurrentState() != StatePending {
+		return fmt.Errorf("%w: the request was already %s", ErrApproverNotAuthorized, a.Decision())
+	}
 
 	if !strings.HasSuffix(a.Approver, fmt.Sprintf("@%s", config.Cfg.ValidDomain)) {
-		return fmt.Errorf("unauthorized user, not from example.io: %v", a.Approver)
+		return fmt.Errorf("%w: %v isn't from %s", ErrApproverNotAuthorized, a.Approver, config.Cfg.ValidDomain)
 	}
 
-	// Ensure requestor is not approver
+	rules := authorizingRules(p, r)
+	// Ensure requestor is not approver, unless a rule allows it
+	a.Mode = PeerApproval
 	if a.Approver == string(a.Requestor) {
-		return fmt.Errorf("self approval not allowed for this rule")
+		if approvalMode(rules) == PeerApproval {
+			return fmt.Errorf("%w: self approval not allowed for this rule", ErrApproverNotAuthorized)
+		}
+		a.Mode = SelfApproval
 	}
-	slog.Warn(a.String())
-	if a.Status == Approved {
-		err := gcp.BindIAMPolicy(ctx, a, gs)
-		if err != nil {
-			return fmt.Errorf("couldn't set IAM policy: %v", err)
+	for _, prev := range a.Approvals {
+		if prev == a.Approver {
+			return fmt.Errorf("%w: %s has already approved it", ErrApproverNotAuthorized, a.Approver)
+		}
+	}
+	// Everyone who has approved so far is checked again. The earlier approvals come from the request as it's stored server side,
+	// the slack button only carries the request's ID, so they can't be added to by a crafted payload.
+	approvers := append(append([]string{}, a.Approvals...), a.Approver)
+	approverGroups, err := listApproverGroups(ctx, p, r, rules, approvers, gs)
+	if err != nil {
+		return err
+	}
+	if err := authorizeApprover(rules, a.Approver, r.Requestor, approverGroups); err != nil {
+		return err
+	}
+	if a.Status == Denied {
+		return transition(a, StateDenied, a.Approver, gs, "")
+	}
+	a.Approvals = approvers
+	a.ApprovalsRemaining = approvalsRemaining(rules, approvers, r.Requestor, approverGroups)
+	if a.ApprovalsRemaining > 0 {
+		slog.Info(fmt.Sprintf("%d more approvals needed before granting %s on %s to %s", a.ApprovalsRemaining, r.Role, r.Resource, r.Requestor))
+		return transition(a, StatePending, a.Approver, gs, fmt.Sprintf("%d more approvals needed", a.ApprovalsRemaining))
+	}
+	return grant(ctx, a, a.Approver, gs)
+}
+
+// grant binds the role, or moves the expiry of the binding when the request is an extension.
+// The request moves to active, or to failed if the binding couldn't be made.
+// A binding that was written but couldn't be read back yet is still active, with a note saying so.
+// When the policy kept changing under the retries, nothing was written, so the request stays pending and the *gcp.ConflictError is returned for it to be tried again.
+func grant(ctx context.Context, a *EscalationApproval, actor string, gs *gcp.Service) error {
+	bind := gcp.BindIAMPolicy
+	if a.IsExtension() {
+		bind = gcp.ExtendIAMPolicy
+	}
+	err := bind(ctx, a, gs)
+	var conflict *gcp.ConflictError
+	if errors.As(err, &conflict) {
+		return err
+	}
+	if errors.Is(err, gcp.ErrGrantNotVisible) {
+		// The binding was written, it just hasn't shown up yet, so the grant is active and can still be revoked
+		slog.Warn(err.Error())
+		return transition(a, StateActive, actor, gs, NoteGrantNotVisible)
+	}
+	if err != nil {
+		err = fmt.Errorf("couldn't set IAM policy: %w", err)
+		if terr := transition(a, StateFailed, actor, gs, err.Error()); terr != nil {
+			return terr
 		}
+		return err
+	}
+	return transition(a, StateActive, actor, gs, "")
+}
+
+// transition moves the request to its next state, with an audit log of it
+func transition(a *EscalationApproval, to State, actor string, gs *gcp.Service, note string) error {
+	if err := a.TransitionTo(to, actor, gcp.Now(gs), note); err != nil {
+		return err
 	}
+	slog.Warn(a.String())
 	return nil
 }
 
+// RequestApprovalMode is the most permissive approval mode of the rules that authorize the request.
+// The request must have been through AuthorizeRequest first.
+func RequestApprovalMode(p *PolicyRules, r *EscalationRequest) ApprovalMode {
+	return approvalMode(authorizingRules(p, r))
+}
+
+func approvalMode(rules []Rule) ApprovalMode {
+	mode := PeerApproval
+	for _, pol := range rules {
+		switch pol.Mode() {
+		case AutoApproval:
+			return AutoApproval
+		case SelfApproval:
+			mode = SelfApproval
+		}
+	}
+	return mode
+}
+
+// AutoApproveAndGrantIAM grants the role straight away when one of the rules authorizing the request allows auto approval
+func AutoApproveAndGrantIAM(ctx context.Context, p *PolicyRules, r *EscalationRequest, gs *gcp.Service) (*EscalationApproval, error) {
+	ok, err := AuthorizeRequest(ctx, p, r, gs)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("double checking authorization failed")
+	}
+	if RequestApprovalMode(p, r) != AutoApproval {
+		return nil, fmt.Errorf("no rule allows auto approval of this request")
+	}
+	a := NewEscalationApproval(r, gcp.Now(gs))
+	a.Approver = AutoApprover
+	a.Status = Approved
+	a.Mode = AutoApproval
+	// The request is returned even when the grant failed, so the failure can be recorded.
+	// A conflict leaves nothing to record, the request can just be submitted again.
+	err = grant(ctx, a, AutoApprover, gs)
+	var conflict *gcp.ConflictError
+	if errors.As(err, &conflict) {
+		return nil, err
+	}
+	return a, err
+}
+
 func authz(p *PolicyRules, r *EscalationRequest) bool {
+	return len(authorizingRules(p, r)) > 0
+}
+
+// authorizingRules returns the matching rules that also allow the requested duration, and for an extension, the total duration of the grant
+func authorizingRules(p *PolicyRules, r *EscalationRequest) []Rule {
+	fallback := config.Cfg.DefaultGrantDuration()
+	var rules []Rule
+	for _, pol := range matchingRules(p, r) {
+		if time.Duration(r.Duration) > pol.GrantMaxDuration(fallback) {
+			continue
+		}
+		if r.IsExtension() && !withinCumulativeDuration(pol, r, fallback) {
+			continue
+		}
+		rules = append(rules, pol)
+	}
+	return rules
+}
+
+// matchingRules returns every rule that authorizes the requestor's groups and account for the role and resource, regardless of duration
+func matchingRules(p *PolicyRules, r *EscalationRequest) []Rule {
+	var rules []Rule
 	for _, pol := range p.PolicyRules {
-		for g := range r.Groups {
-			if _, ok := pol.Groups[g]; !ok {
-				continue
-			}
-			if _, ok := pol.Roles[r.Role]; !ok {
-				continue
+		if ruleMatches(pol, r) && len(pol.AccountProblems(r.Account)) == 0 {
+			rules = append(rules, pol)
+		}
+	}
+	return rules
+}
+
+// checksAccount reports whether any rule matching the requestor's groups has requirements on their account
+func checksAccount(p *PolicyRules, r *EscalationRequest) bool {
+	for _, pol := range p.PolicyRules {
+		if pol.ChecksAccount() && ruleMatches(pol, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// accountProblems is why the requestor's account doesn't meet the requirements of the rules matching their groups
+func accountProblems(p *PolicyRules, r *EscalationRequest) []string {
+	var problems []string
+	for _, pol := range p.PolicyRules {
+		if !ruleMatches(pol, r) {
+			continue
+		}
+		for _, problem := range pol.AccountProblems(r.Account) {
+			if !slices.Contains(problems, problem) {
+				problems = append(problems, problem)
 			}
-			if _, ok := pol.Resources[r.Resource]; ok {
+		}
+	}
+	return problems
+}
+
+func ruleMatches(pol Rule, r *EscalationRequest) bool {
+	for g := range r.Groups {
+		if _, ok := pol.Groups[g]; !ok {
+			continue
+		}
+		if !pol.MatchRole(r.Role) {
+			continue
+		}
+		if pol.MatchResource(r.Resource) {
+			return true
+		}
+		if !pol.Inherit {
+			continue
+		}
+		for _, a := range r.Ancestors {
+			if pol.MatchResource(a) {
 				return true
 			}
 		}
-
 	}
 	return false
 }
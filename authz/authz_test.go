@@ -2,16 +2,23 @@ package authz
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/seslattery/gcpsudobot/gcp"
+	"github.com/seslattery/gcpsudobot/groups"
 	. "github.com/seslattery/gcpsudobot/types"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/slack-go/slack"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
 )
 
 var TestPolicy = &PolicyRules{
@@ -233,6 +240,22 @@ func TestAuthorizeRequest(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"group on the third page",
+			&gcp.MockGoogler{
+				ListPageF: gcp.MockGroupPages(
+					[]string{"test-group-1", "test-group-2"},
+					[]string{"test-group-3"},
+					[]string{"test-group-4", "on-call@example.io"},
+				),
+			},
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Resource:  "organizations/0000000000",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+			},
+			true,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -259,13 +282,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			// mock googler returns groups with "on-call@gmail.com"
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 					Resource:  "organizations/0000000000",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			false,
 		},
@@ -273,13 +296,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"not a valid domain on requestor",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@foobarbaz.io",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 					Resource:  "organizations/0000000000",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -287,13 +310,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"missing @ on otherwise valid domain on requestor",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user-gmail.com",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 					Resource:  "organizations/0000000000",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -301,13 +324,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"wrong group for role/resource",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user-gmail.com",
 					Role:      "test-role-4",
 					Resource:  "test-resource-4",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -315,13 +338,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"wrong role",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Role:      "organizations/0000000000/roles/on_call_elevated-2",
 					Resource:  "organizations/0000000000",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -329,13 +352,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"wrong resource",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 					Resource:  "organizations/0000000000-2",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -343,12 +366,12 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"no resource",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -356,12 +379,12 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"no role",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Resource:  "organizations/0000000000",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -369,12 +392,12 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"no requestor",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Resource: "organizations/0000000000",
 					Role:     "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -382,13 +405,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"happy path again different requestor",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "foobarbaz@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			false,
 		},
@@ -400,13 +423,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 				},
 			},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -418,13 +441,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 				},
 			},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -436,13 +459,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 				},
 			},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -451,13 +474,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"denial",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "foobarbaz@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Denied,
+				Approver: "approver@gmail.com",
+				Status:   Denied,
 			},
 			false,
 		},
@@ -465,13 +488,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"not a valid domain for approver",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "foobarbaz@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@foobarbaz.com",
-				Approved,
+				Approver: "approver@foobarbaz.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -479,13 +502,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"missing @ on otherwise valid domain on approver",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "foobarbaz@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver-gmail.com",
-				Approved,
+				Approver: "approver-gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -493,13 +516,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 			"requestor cannot self approve",
 			gcp.NewMockGoogler(),
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "foobarbaz@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"foobarbaz@gmail.com",
-				Approved,
+				Approver: "foobarbaz@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -521,13 +544,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 				},
 			},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -552,13 +575,13 @@ func TestAuthorizeApprovalAndGrantIAM(t *testing.T) {
 				},
 			},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "user@gmail.com",
 					Resource:  "organizations/0000000000",
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 				},
-				"approver@gmail.com",
-				Approved,
+				Approver: "approver@gmail.com",
+				Status:   Approved,
 			},
 			true,
 		},
@@ -669,3 +692,1304 @@ func TestListOptions(t *testing.T) {
 
 	})
 }
+
+var TestInheritPolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"organizations/0000000000/roles/on_call_elevated": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			Inherit: true,
+		},
+		{
+			Groups: map[Group]struct{}{
+				"prod-db-access@gmail.com": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/cloudsql.admin": {},
+			},
+			Resources: map[Resource]struct{}{
+				"folders/1111": {},
+			},
+		},
+	},
+}
+
+func TestAuthorizeRequestInherit(t *testing.T) {
+	ancestry := func(ctx context.Context, resource Resource) ([]Resource, error) {
+		switch resource {
+		case "projects/prod-db":
+			return []Resource{"folders/1111", "organizations/0000000000"}, nil
+		case "projects/elsewhere":
+			return []Resource{"organizations/1111111111"}, nil
+		case "projects/broken":
+			return nil, fmt.Errorf("testing ancestry error")
+		}
+		return nil, nil
+	}
+	tests := []struct {
+		name     string
+		input    *EscalationRequest
+		expected bool
+	}{
+		{
+			"project beneath an inheriting org rule",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "projects/prod-db",
+			},
+			true,
+		},
+		{
+			"the org itself",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "organizations/0000000000",
+			},
+			true,
+		},
+		{
+			"project under a different org",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "projects/elsewhere",
+			},
+			false,
+		},
+		{
+			"rule without inherit only matches its own resources",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "roles/cloudsql.admin",
+				Resource:  "projects/prod-db",
+			},
+			false,
+		},
+		{
+			"ancestors from the request are ignored",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "projects/elsewhere",
+				Ancestors: []Resource{"organizations/0000000000"},
+			},
+			false,
+		},
+		{
+			"error when getting ancestry",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "projects/broken",
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				return &admin.Groups{Groups: []*admin.Group{{Email: "on-call@example.io"}, {Email: "prod-db-access@gmail.com"}}}, nil
+			}
+			mock.AncestryF = ancestry
+			b, err := AuthorizeRequest(ctx, TestInheritPolicy, tt.input, gcp.NewService(mock))
+			if b != tt.expected {
+				t.Log(err)
+				t.Errorf("got %v, want %v", b, tt.expected)
+			}
+		})
+	}
+}
+
+var TestPatternPolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"prod-db-access@gmail.com": {},
+			},
+			Roles: map[Role]struct{}{
+				"re:roles/cloudsql\\.(admin|editor)": {},
+			},
+			Resources: map[Resource]struct{}{
+				"projects/prod-*": {},
+			},
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/viewer": {},
+			},
+			Resources: map[Resource]struct{}{
+				"folders/*": {},
+			},
+			Inherit: true,
+		},
+	},
+}
+
+func TestAuthzPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    *EscalationRequest
+		expected bool
+	}{
+		{"role regex and resource glob", &EscalationRequest{
+			Groups:   map[Group]struct{}{"prod-db-access@gmail.com": {}},
+			Role:     "roles/cloudsql.editor",
+			Resource: "projects/prod-db",
+		}, true},
+		{"role regex doesn't match", &EscalationRequest{
+			Groups:   map[Group]struct{}{"prod-db-access@gmail.com": {}},
+			Role:     "roles/cloudsql.viewer",
+			Resource: "projects/prod-db",
+		}, false},
+		{"resource glob doesn't match", &EscalationRequest{
+			Groups:   map[Group]struct{}{"prod-db-access@gmail.com": {}},
+			Role:     "roles/cloudsql.admin",
+			Resource: "projects/staging-db",
+		}, false},
+		{"wrong group", &EscalationRequest{
+			Groups:   map[Group]struct{}{"on-call@example.io": {}},
+			Role:     "roles/cloudsql.admin",
+			Resource: "projects/prod-db",
+		}, false},
+		{"inherited through a pattern", &EscalationRequest{
+			Groups:    map[Group]struct{}{"on-call@example.io": {}},
+			Role:      "roles/viewer",
+			Resource:  "projects/anything",
+			Ancestors: []Resource{"folders/1234", "organizations/0000000000"},
+		}, true},
+		{"pattern isn't inherited without ancestors", &EscalationRequest{
+			Groups:   map[Group]struct{}{"on-call@example.io": {}},
+			Role:     "roles/viewer",
+			Resource: "projects/anything",
+		}, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			b := authz(TestPatternPolicy, tt.input)
+			if b != tt.expected {
+				t.Errorf("got %v, want %v", b, tt.expected)
+			}
+		})
+	}
+}
+
+var TestDurationPolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"organizations/0000000000/roles/hub_root": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			MaxDuration:     Duration(30 * time.Minute),
+			DefaultDuration: Duration(15 * time.Minute),
+		},
+		{
+			Groups: map[Group]struct{}{
+				"prod-db-access@gmail.com": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/cloudsql.admin": {},
+			},
+			Resources: map[Resource]struct{}{
+				"projects/testing": {},
+			},
+			MaxDuration: Duration(8 * time.Hour),
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/viewer": {},
+			},
+			Resources: map[Resource]struct{}{
+				"projects/testing": {},
+			},
+		},
+	},
+}
+
+func TestAuthorizeRequestDuration(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        *EscalationRequest
+		expected     bool
+		wantDuration Duration
+	}{
+		{
+			"rule default is used when no duration is picked",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/hub_root",
+				Resource:  "organizations/0000000000",
+			},
+			true,
+			Duration(15 * time.Minute),
+		},
+		{
+			"within the rule's max",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/hub_root",
+				Resource:  "organizations/0000000000",
+				Duration:  Duration(30 * time.Minute),
+			},
+			true,
+			Duration(30 * time.Minute),
+		},
+		{
+			"longer than the rule's max",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/hub_root",
+				Resource:  "organizations/0000000000",
+				Duration:  Duration(31 * time.Minute),
+			},
+			false,
+			Duration(31 * time.Minute),
+		},
+		{
+			"rule max can be longer than the global default",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "roles/cloudsql.admin",
+				Resource:  "projects/testing",
+				Duration:  Duration(8 * time.Hour),
+			},
+			true,
+			Duration(8 * time.Hour),
+		},
+		{
+			"default without a rule default is the global default",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "roles/cloudsql.admin",
+				Resource:  "projects/testing",
+			},
+			true,
+			Duration(2 * time.Hour),
+		},
+		{
+			"rule without a max is limited to the global default",
+			&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "roles/viewer",
+				Resource:  "projects/testing",
+				Duration:  Duration(3 * time.Hour),
+			},
+			false,
+			Duration(3 * time.Hour),
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				return &admin.Groups{Groups: []*admin.Group{{Email: "on-call@example.io"}, {Email: "prod-db-access@gmail.com"}}}, nil
+			}
+			b, err := AuthorizeRequest(ctx, TestDurationPolicy, tt.input, gcp.NewService(mock))
+			if b != tt.expected {
+				t.Log(err)
+				t.Errorf("got %v, want %v", b, tt.expected)
+			}
+			if !tt.expected && !errors.Is(err, ErrDurationTooLong) {
+				t.Errorf("got %v, want %v", err, ErrDurationTooLong)
+			}
+			if tt.input.Duration != tt.wantDuration {
+				t.Errorf("got duration %v, want %v", tt.input.Duration, tt.wantDuration)
+			}
+		})
+	}
+}
+
+var TestApproverGroupPolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"organizations/0000000000/roles/hub_root": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			ApproverGroups: map[Group]struct{}{
+				"on-call-leads@example.io": {},
+			},
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/viewer": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			ApproverGroups: map[Group]struct{}{
+				"on-call-leads@example.io": {},
+			},
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/viewer": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+		},
+	},
+}
+
+func TestAuthorizeApprovalApproverGroups(t *testing.T) {
+	groups := map[string][]string{
+		"user@gmail.com": {"on-call@example.io"},
+		"lead@gmail.com": {"on-call@example.io", "on-call-leads@example.io"},
+		"peer@gmail.com": {"on-call@example.io"},
+	}
+	tests := []struct {
+		name          string
+		role          Role
+		approver      string
+		wantErr       bool
+		wantForbidden bool
+	}{
+		{"approver in an approver group", "organizations/0000000000/roles/hub_root", "lead@gmail.com", false, false},
+		{"approver not in an approver group", "organizations/0000000000/roles/hub_root", "peer@gmail.com", true, true},
+		{"error looking up approver groups", "organizations/0000000000/roles/hub_root", "missing@gmail.com", true, false},
+		{"another matching rule without approver groups", "roles/viewer", "peer@gmail.com", false, false},
+		{"approver from another domain", "organizations/0000000000/roles/hub_root", "lead@foobarbaz.io", true, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				g, ok := groups[requestor]
+				if !ok {
+					return nil, fmt.Errorf("testing error")
+				}
+				resp := &admin.Groups{}
+				for _, email := range g {
+					resp.Groups = append(resp.Groups, &admin.Group{Email: email})
+				}
+				return resp, nil
+			}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{
+					Requestor: "user@gmail.com",
+					Role:      tt.role,
+					Resource:  "organizations/0000000000",
+				},
+				Approver: tt.approver,
+				Status:   Approved,
+			}
+			err := AuthorizeApprovalAndGrantIAM(ctx, TestApproverGroupPolicy, a, gcp.NewService(mock))
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantErr && err == nil {
+				t.Errorf("expected error not found")
+			}
+			if errors.Is(err, ErrApproverNotAuthorized) != tt.wantForbidden {
+				t.Errorf("got %v, want ErrApproverNotAuthorized: %v", err, tt.wantForbidden)
+			}
+		})
+	}
+}
+
+func TestAuthorizeApprovalNestedGroups(t *testing.T) {
+	memberships := map[string][]string{
+		"user@gmail.com":       {"sre@example.io"},
+		"sre@example.io":       {"on-call@example.io"},
+		"lead@gmail.com":       {"sre-leads@example.io"},
+		"sre-leads@example.io": {"staff@example.io"},
+		"staff@example.io":     {"on-call-leads@example.io"},
+	}
+	tests := []struct {
+		name          string
+		nested        bool
+		maxDepth      int
+		wantErr       bool
+		wantForbidden bool
+	}{
+		{"nested groups off", false, 0, true, false},
+		{"approver's group is too deep", true, 1, true, true},
+		{"nested groups on", true, 2, false, false},
+		{"default depth", true, 0, false, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := gcp.NewMockGoogler()
+			mock.ListF = gcp.MockGroupMemberships(memberships)
+			p := &PolicyRules{PolicyRules: TestApproverGroupPolicy.PolicyRules, NestedGroups: tt.nested, MaxGroupDepth: tt.maxDepth}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{
+					Requestor: "user@gmail.com",
+					Role:      "organizations/0000000000/roles/hub_root",
+					Resource:  "organizations/0000000000",
+				},
+				Approver: "lead@gmail.com",
+				Status:   Approved,
+			}
+			err := AuthorizeApprovalAndGrantIAM(ctx, p, a, gcp.NewService(mock))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrApproverNotAuthorized) != tt.wantForbidden {
+				t.Errorf("got %v, want ErrApproverNotAuthorized: %v", err, tt.wantForbidden)
+			}
+			if !tt.wantErr && a.State != StateActive {
+				t.Errorf("got state %s, want %s", a.State, StateActive)
+			}
+		})
+	}
+}
+
+var TestQuorumPolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"on-call-sudo@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"organizations/0000000000/roles/hub_root": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			ApproverGroups: map[Group]struct{}{
+				"sre-leads@example.io":      {},
+				"security-leads@example.io": {},
+			},
+			RequiredApprovals:      2,
+			DistinctApproverGroups: true,
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"organizations/0000000000/roles/on_call_elevated": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			RequiredApprovals: 3,
+		},
+	},
+}
+
+func TestAuthorizeApprovalQuorum(t *testing.T) {
+	groups := map[string][]string{
+		"user@gmail.com":     {"on-call@example.io", "on-call-sudo@example.io"},
+		"sre-1@gmail.com":    {"sre-leads@example.io"},
+		"sre-2@gmail.com":    {"sre-leads@example.io"},
+		"sec-1@gmail.com":    {"security-leads@example.io"},
+		"both@gmail.com":     {"sre-leads@example.io", "security-leads@example.io"},
+		"nobody@gmail.com":   {},
+		"engineer@gmail.com": {"on-call@example.io"},
+	}
+	hubRoot := Role("organizations/0000000000/roles/hub_root")
+	elevated := Role("organizations/0000000000/roles/on_call_elevated")
+	tests := []struct {
+		name          string
+		role          Role
+		approvals     []string
+		approver      string
+		wantRemaining int
+		wantGranted   bool
+		wantForbidden bool
+	}{
+		{"first approval", hubRoot, nil, "sre-1@gmail.com", 1, false, false},
+		{"second approval from a different group", hubRoot, []string{"sre-1@gmail.com"}, "sec-1@gmail.com", 0, true, false},
+		{"second approval from the same group", hubRoot, []string{"sre-1@gmail.com"}, "sre-2@gmail.com", 1, false, false},
+		{"approver in both groups is matched to the free one", hubRoot, []string{"sre-1@gmail.com"}, "both@gmail.com", 0, true, false},
+		{"same approver twice", hubRoot, []string{"sre-1@gmail.com"}, "sre-1@gmail.com", 0, false, true},
+		{"approver outside the approver groups", hubRoot, []string{"sre-1@gmail.com"}, "nobody@gmail.com", 0, false, true},
+		{"forged approvals aren't counted", hubRoot, []string{"nobody@gmail.com", "user@gmail.com"}, "sre-1@gmail.com", 1, false, false},
+		{"any approvers without approver groups", elevated, []string{"nobody@gmail.com"}, "engineer@gmail.com", 1, false, false},
+		{"third approval without approver groups", elevated, []string{"nobody@gmail.com", "sre-1@gmail.com"}, "engineer@gmail.com", 0, true, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			granted := false
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				resp := &admin.Groups{}
+				for _, email := range groups[requestor] {
+					resp.Groups = append(resp.Groups, &admin.Group{Email: email})
+				}
+				return resp, nil
+			}
+			mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				granted = true
+				return nil, nil
+			}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{
+					Requestor: "user@gmail.com",
+					Role:      tt.role,
+					Resource:  "organizations/0000000000",
+				},
+				Approver:  tt.approver,
+				Status:    Approved,
+				Approvals: tt.approvals,
+			}
+			err := AuthorizeApprovalAndGrantIAM(ctx, TestQuorumPolicy, a, gcp.NewService(mock))
+			if errors.Is(err, ErrApproverNotAuthorized) != tt.wantForbidden {
+				t.Fatalf("got %v, want ErrApproverNotAuthorized: %v", err, tt.wantForbidden)
+			}
+			if tt.wantForbidden {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if granted != tt.wantGranted {
+				t.Errorf("got granted %v, want %v", granted, tt.wantGranted)
+			}
+			if a.ApprovalsRemaining != tt.wantRemaining {
+				t.Errorf("got %d approvals remaining, want %d", a.ApprovalsRemaining, tt.wantRemaining)
+			}
+			if diff := cmp.Diff(a.Approvals, append(tt.approvals, tt.approver)); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+var TestApprovalModePolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/viewer": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			ApprovalMode: AutoApproval,
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/browser": {},
+				"roles/viewer":  {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+			ApproverGroups: map[Group]struct{}{
+				"sre-leads@example.io": {},
+			},
+			ApprovalMode: SelfApproval,
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"organizations/0000000000/roles/on_call_elevated": {},
+			},
+			Resources: map[Resource]struct{}{
+				"organizations/0000000000": {},
+			},
+		},
+	},
+}
+
+func TestAuthorizeApprovalApprovalMode(t *testing.T) {
+	groups := map[string][]string{
+		"user@gmail.com":     {"on-call@example.io"},
+		"sre@gmail.com":      {"sre-leads@example.io"},
+		"engineer@gmail.com": {"on-call@example.io"},
+	}
+	tests := []struct {
+		name          string
+		role          Role
+		approver      string
+		wantMode      ApprovalMode
+		wantForbidden bool
+	}{
+		{"self approval", "roles/browser", "user@gmail.com", SelfApproval, false},
+		{"peer approval under a self approval rule", "roles/browser", "sre@gmail.com", PeerApproval, false},
+		{"peer outside the approver groups under a self approval rule", "roles/browser", "engineer@gmail.com", "", true},
+		{"self approval under a peer rule", "organizations/0000000000/roles/on_call_elevated", "user@gmail.com", "", true},
+		{"peer approval under a peer rule", "organizations/0000000000/roles/on_call_elevated", "engineer@gmail.com", PeerApproval, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				resp := &admin.Groups{}
+				for _, email := range groups[requestor] {
+					resp.Groups = append(resp.Groups, &admin.Group{Email: email})
+				}
+				return resp, nil
+			}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{
+					Requestor: "user@gmail.com",
+					Role:      tt.role,
+					Resource:  "organizations/0000000000",
+				},
+				Approver: tt.approver,
+				Status:   Approved,
+			}
+			err := AuthorizeApprovalAndGrantIAM(ctx, TestApprovalModePolicy, a, gcp.NewService(mock))
+			if errors.Is(err, ErrApproverNotAuthorized) != tt.wantForbidden {
+				t.Fatalf("got %v, want ErrApproverNotAuthorized: %v", err, tt.wantForbidden)
+			}
+			if tt.wantForbidden {
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if a.Mode != tt.wantMode {
+				t.Errorf("got mode %q, want %q", a.Mode, tt.wantMode)
+			}
+		})
+	}
+}
+
+func TestAutoApproveAndGrantIAM(t *testing.T) {
+	tests := []struct {
+		name        string
+		role        Role
+		wantMode    ApprovalMode
+		wantGranted bool
+	}{
+		{"most permissive rule wins", "roles/viewer", AutoApproval, true},
+		{"self approval rule", "roles/browser", SelfApproval, false},
+		{"peer rule", "organizations/0000000000/roles/on_call_elevated", PeerApproval, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			granted := false
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				return &admin.Groups{Groups: []*admin.Group{{Email: "on-call@example.io"}}}, nil
+			}
+			mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				granted = true
+				return nil, nil
+			}
+			gs := gcp.NewService(mock)
+			r := &EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      tt.role,
+				Resource:  "organizations/0000000000",
+			}
+			ok, err := AuthorizeRequest(ctx, TestApprovalModePolicy, r, gs)
+			if err != nil || !ok {
+				t.Fatalf("request wasn't authorized: %v", err)
+			}
+			if mode := RequestApprovalMode(TestApprovalModePolicy, r); mode != tt.wantMode {
+				t.Fatalf("got mode %q, want %q", mode, tt.wantMode)
+			}
+			a, err := AutoApproveAndGrantIAM(ctx, TestApprovalModePolicy, r, gs)
+			if granted != tt.wantGranted {
+				t.Fatalf("got granted %v, want %v", granted, tt.wantGranted)
+			}
+			if !tt.wantGranted {
+				if err == nil {
+					t.Errorf("expected an error without an auto approval rule")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if a.Approver != AutoApprover || a.Mode != AutoApproval || a.Status != Approved {
+				t.Errorf("unexpected approval: %+v", a)
+			}
+		})
+	}
+}
+
+func TestAuthorizeApprovalLifecycle(t *testing.T) {
+	tests := []struct {
+		name   string
+		state  State
+		status Approval
+		setErr error
+		// Whether the write shows up when the policy is read back
+		visible       bool
+		wantState     State
+		wantNote      string
+		wantErr       bool
+		wantForbidden bool
+	}{
+		{"approved", StatePending, Approved, nil, true, StateActive, "", false, false},
+		{"granted but not yet visible", StatePending, Approved, nil, false, StateActive, NoteGrantNotVisible, false, false},
+		{"denied", StatePending, Denied, nil, true, StateDenied, "", false, false},
+		{"grant failed", StatePending, Approved, fmt.Errorf("permission denied"), true, StateFailed, "couldn't set IAM policy: failed to set iam policy: permission denied", true, false},
+		{"conflict stays pending", StatePending, Approved, &googleapi.Error{Code: http.StatusConflict}, true, StatePending, "", true, false},
+		{"already denied", StateDenied, Approved, nil, true, StateDenied, "", true, true},
+		{"already active", StateActive, Denied, nil, true, StateActive, "", true, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				return &admin.Groups{Groups: []*admin.Group{{Email: "on-call@example.io"}}}, nil
+			}
+			set := mock.SetIamPolicyF
+			mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				if tt.setErr != nil || !tt.visible {
+					return nil, tt.setErr
+				}
+				return set(ctx, resource, setiampolicyrequest)
+			}
+			a := NewEscalationApproval(&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "organizations/0000000000",
+			}, time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC))
+			a.State = tt.state
+			a.Approver = "approver@gmail.com"
+			a.Status = tt.status
+			err := AuthorizeApprovalAndGrantIAM(ctx, TestApprovalModePolicy, a, gcp.NewService(mock))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if errors.Is(err, ErrApproverNotAuthorized) != tt.wantForbidden {
+				t.Errorf("got %v, want ErrApproverNotAuthorized: %v", err, tt.wantForbidden)
+			}
+			if a.State != tt.wantState {
+				t.Errorf("got state %s, want %s", a.State, tt.wantState)
+			}
+			if tt.wantForbidden {
+				return
+			}
+			// A conflict can be retried, so it doesn't move the request on
+			var conflict *gcp.ConflictError
+			if errors.As(err, &conflict) {
+				if len(a.History) != 1 {
+					t.Errorf("got %d transitions, want only the request's", len(a.History))
+				}
+				return
+			}
+			last := a.History[len(a.History)-1]
+			if last.To != tt.wantState || last.Actor != "approver@gmail.com" || last.Note != tt.wantNote {
+				t.Errorf("got last transition %+v, want to %s by approver@gmail.com with note %q", last, tt.wantState, tt.wantNote)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRevocationAndRevokeIAM(t *testing.T) {
+	groups := map[string][]string{
+		"user@gmail.com":     {"on-call@example.io"},
+		"sre@gmail.com":      {"sre-leads@example.io"},
+		"engineer@gmail.com": {"on-call@example.io"},
+	}
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		role          Role
+		state         State
+		revoker       string
+		wantForbidden bool
+	}{
+		{"requestor", "roles/browser", StateActive, "user@gmail.com", false},
+		{"approver", "roles/browser", StateActive, "approver@gmail.com", false},
+		{"could approve", "roles/browser", StateActive, "sre@gmail.com", false},
+		{"outside the approver groups", "roles/browser", StateActive, "engineer@gmail.com", true},
+		{"anyone under a rule without approver groups", "organizations/0000000000/roles/on_call_elevated", StateActive, "engineer@gmail.com", false},
+		{"other domain", "roles/browser", StateActive, "user@example.io", true},
+		{"already revoked", "roles/browser", StateRevoked, "user@gmail.com", true},
+		{"never granted", "roles/browser", StateDenied, "user@gmail.com", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			written := false
+			expiry := at.Add(time.Hour).Format(time.RFC3339)
+			mock := gcp.NewMockGoogler()
+			mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+				resp := &admin.Groups{}
+				for _, email := range groups[requestor] {
+					resp.Groups = append(resp.Groups, &admin.Group{Email: email})
+				}
+				return resp, nil
+			}
+			mock.GetIamPolicyF = func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				return &cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{{
+					Role:    string(tt.role),
+					Members: []string{"user:user@gmail.com"},
+					Condition: &cloudresourcemanager.Expr{
+						Title:      fmt.Sprintf("Until: %s", expiry),
+						Expression: fmt.Sprintf("request.time < timestamp(\"%s\")", expiry),
+					},
+				}}}, nil
+			}
+			mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				if len(setiampolicyrequest.Policy.Bindings) != 0 {
+					return nil, fmt.Errorf("testing. binding wasn't removed")
+				}
+				written = true
+				return nil, nil
+			}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{
+					Requestor: "user@gmail.com",
+					Role:      tt.role,
+					Resource:  "organizations/0000000000",
+				},
+				Approver:  "approver@gmail.com",
+				Status:    Approved,
+				Approvals: []string{"approver@gmail.com"},
+				Expiry:    expiry,
+				State:     tt.state,
+			}
+			err := AuthorizeRevocationAndRevokeIAM(ctx, TestApprovalModePolicy, a, tt.revoker, gcp.NewService(mock))
+			if errors.Is(err, ErrRevokerNotAuthorized) != tt.wantForbidden {
+				t.Fatalf("got %v, want ErrRevokerNotAuthorized: %v", err, tt.wantForbidden)
+			}
+			if tt.wantForbidden {
+				if written || a.State != tt.state {
+					t.Errorf("a forbidden revocation changed the grant")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !written || a.State != StateRevoked {
+				t.Errorf("got written %v state %s, want the binding removed and revoked", written, a.State)
+			}
+			if last := a.History[len(a.History)-1]; last.Actor != tt.revoker {
+				t.Errorf("got actor %s, want %s", last.Actor, tt.revoker)
+			}
+		})
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		state         State
+		canceller     string
+		wantForbidden bool
+	}{
+		{"requestor", StatePending, "user@gmail.com", false},
+		{"someone else", StatePending, "approver@gmail.com", true},
+		{"already granted", StateActive, "user@gmail.com", true},
+		{"already denied", StateDenied, "user@gmail.com", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			mock := gcp.NewMockGoogler()
+			mock.NowF = func() time.Time { return at }
+			a := NewEscalationApproval(&EscalationRequest{
+				Requestor: "user@gmail.com",
+				Role:      "roles/browser",
+				Resource:  "organizations/0000000000",
+			}, at.Add(-time.Minute))
+			if tt.state != StatePending {
+				if err := a.TransitionTo(tt.state, "approver@gmail.com", at.Add(-time.Minute), ""); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			err := CancelRequest(a, tt.canceller, gcp.NewService(mock))
+			if errors.Is(err, ErrCancellerNotAuthorized) != tt.wantForbidden {
+				t.Fatalf("got %v, want ErrCancellerNotAuthorized: %v", err, tt.wantForbidden)
+			}
+			if tt.wantForbidden {
+				if a.State != tt.state {
+					t.Errorf("a forbidden cancellation changed the request to %s", a.State)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			last := a.History[len(a.History)-1]
+			if a.State != StateCancelled || last.Actor != tt.canceller || !last.At.Equal(at) {
+				t.Errorf("got state %s by %s at %s, want cancelled by %s at %s", a.State, last.Actor, last.At, tt.canceller, at)
+			}
+		})
+	}
+}
+
+var TestExtensionPolicy = &PolicyRules{
+	PolicyRules: []Rule{
+		{
+			Groups: map[Group]struct{}{
+				"prod-db-access@gmail.com": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/cloudsql.admin": {},
+			},
+			Resources: map[Resource]struct{}{
+				"projects/testing": {},
+			},
+			MaxDuration:           Duration(time.Hour),
+			MaxCumulativeDuration: Duration(3 * time.Hour),
+		},
+		{
+			Groups: map[Group]struct{}{
+				"on-call@example.io": {},
+			},
+			Roles: map[Role]struct{}{
+				"roles/viewer": {},
+			},
+			Resources: map[Resource]struct{}{
+				"projects/testing": {},
+			},
+			MaxDuration: Duration(time.Hour),
+		},
+	},
+}
+
+func TestAuthorizeRequestExtension(t *testing.T) {
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		role         Role
+		grantedSince time.Time
+		duration     time.Duration
+		expected     bool
+	}{
+		{"within the cumulative duration", "roles/cloudsql.admin", at.Add(-30 * time.Minute), time.Hour, true},
+		{"up to the cumulative duration", "roles/cloudsql.admin", at.Add(-time.Hour), time.Hour, true},
+		{"past the cumulative duration", "roles/cloudsql.admin", at.Add(-90 * time.Minute), time.Hour, false},
+		{"extended by more than the max duration", "roles/cloudsql.admin", at, 2 * time.Hour, false},
+		{"cumulative duration defaults to the max duration", "roles/viewer", at.Add(-30 * time.Minute), time.Hour, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := &EscalationRequest{
+				Requestor:     "user@gmail.com",
+				Role:          tt.role,
+				Resource:      "projects/testing",
+				Duration:      Duration(tt.duration),
+				ExtensionOf:   "0123456789abcdef0123456789abcdef",
+				ExtendsExpiry: at.Add(time.Hour).Format(time.RFC3339),
+				GrantedSince:  tt.grantedSince.Format(time.RFC3339),
+			}
+			ok, err := AuthorizeRequest(context.Background(), TestExtensionPolicy, r, gcp.NewService(gcp.NewMockGoogler()))
+			if ok != tt.expected {
+				t.Errorf("got %v, want %v: %v", ok, tt.expected, err)
+			}
+			if !tt.expected && !errors.Is(err, ErrDurationTooLong) {
+				t.Errorf("got %v, want %v", err, ErrDurationTooLong)
+			}
+		})
+	}
+}
+
+func TestExtendGrant(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	policy := &cloudresourcemanager.Policy{}
+	mock := gcp.NewMockGoogler()
+	mock.NowF = func() time.Time { return at }
+	mock.GetIamPolicyF = func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+		return policy, nil
+	}
+	mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+		policy = setiampolicyrequest.Policy
+		return nil, nil
+	}
+	gs := gcp.NewService(mock)
+
+	original := NewEscalationApproval(&EscalationRequest{
+		ID:        "original",
+		Requestor: "user@gmail.com",
+		Role:      "roles/cloudsql.admin",
+		Resource:  "projects/testing",
+		Duration:  Duration(time.Hour),
+	}, at.Add(-time.Minute))
+	original.Approver = "approver@gmail.com"
+	original.Status = Approved
+	if err := AuthorizeApprovalAndGrantIAM(ctx, TestExtensionPolicy, original, gs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := PrepareExtension(original, &EscalationRequest{Requestor: "someone-else@gmail.com"}); !errors.Is(err, ErrExtenderNotAuthorized) {
+		t.Errorf("got %v, want ErrExtenderNotAuthorized for someone else's grant", err)
+	}
+	r := &EscalationRequest{ID: "extension", Requestor: "user@gmail.com", Reason: "still debugging", Duration: Duration(time.Hour)}
+	if err := PrepareExtension(original, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	extension := NewEscalationApproval(r, at)
+	extension.Approver = "approver@gmail.com"
+	extension.Status = Approved
+	if err := AuthorizeApprovalAndGrantIAM(ctx, TestExtensionPolicy, extension, gs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantExpiry := at.Add(2 * time.Hour).Format(time.RFC3339)
+	if extension.State != StateActive || extension.Expiry != wantExpiry {
+		t.Errorf("got state %s expiry %s, want active until %s", extension.State, extension.Expiry, wantExpiry)
+	}
+	// The binding is replaced, not appended to
+	if len(policy.Bindings) != 1 || policy.Bindings[0].Condition.Title != fmt.Sprintf("Until: %s", wantExpiry) {
+		t.Errorf("got bindings %+v, want a single binding until %s", policy.Bindings, wantExpiry)
+	}
+
+	if err := MarkExtended(original, extension, gs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if original.State != StateExtended || original.Expiry != wantExpiry {
+		t.Errorf("got state %s expiry %s, want extended until %s", original.State, original.Expiry, wantExpiry)
+	}
+	if err := PrepareExtension(original, &EscalationRequest{Requestor: "user@gmail.com"}); !errors.Is(err, ErrExtenderNotAuthorized) {
+		t.Errorf("got %v, want ErrExtenderNotAuthorized once the grant has been extended", err)
+	}
+}
+
+func TestAuthorizeApprovalStaleGroups(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	down := false
+	mock := gcp.NewMockGoogler()
+	list := mock.ListF
+	mock.NowF = func() time.Time { return now }
+	mock.ListF = func(domain, requestor string) (*admin.Groups, error) {
+		if down {
+			return nil, fmt.Errorf("can't reach google")
+		}
+		return list(domain, requestor)
+	}
+	gs := gcp.NewService(gcp.NewGroupCache(mock, time.Minute, 15*time.Minute))
+	r := &EscalationRequest{
+		Requestor: "user@gmail.com",
+		Role:      "organizations/0000000000/roles/on_call_elevated",
+		Resource:  "organizations/0000000000",
+	}
+	if ok, err := AuthorizeRequest(ctx, TestPolicy, r, gs); !ok {
+		t.Fatalf("request wasn't authorized: %v", err)
+	}
+	if len(r.StaleGroups) != 0 {
+		t.Errorf("got stale groups %v before the directory went down", r.StaleGroups)
+	}
+
+	// The directory goes down, the groups cached when the request was made are still used
+	now = now.Add(5 * time.Minute)
+	down = true
+	a := &EscalationApproval{EscalationRequest: r, Approver: "approver@gmail.com", Status: Approved}
+	if err := AuthorizeApprovalAndGrantIAM(ctx, TestPolicy, a, gs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(a.StaleGroups) != 1 || !strings.Contains(a.StaleGroups[0], "can't reach google") {
+		t.Errorf("got stale groups %v, want the outage recorded", a.StaleGroups)
+	}
+	if !strings.Contains(a.String(), "Stale groups: ") {
+		t.Errorf("audit record doesn't show the stale groups: %s", a)
+	}
+
+	// Once the cached groups are older than the staleness bound they aren't used
+	now = now.Add(15 * time.Minute)
+	r2 := &EscalationRequest{Requestor: r.Requestor, Role: r.Role, Resource: r.Resource}
+	if ok, err := AuthorizeRequest(ctx, TestPolicy, r2, gs); ok || err == nil {
+		t.Errorf("got authorized %v with error %v, want the lookup to fail", ok, err)
+	}
+}
+
+func TestAuthorizeRequestGroupSources(t *testing.T) {
+	p := &PolicyRules{PolicyRules: []Rule{
+		{
+			Groups:    Groups{"static:sre": {}},
+			Roles:     map[Role]struct{}{"organizations/0000000000/roles/sre": {}},
+			Resources: map[Resource]struct{}{"organizations/0000000000": {}},
+		},
+		{
+			Groups:    Groups{"on-call@example.io": {}},
+			Roles:     map[Role]struct{}{"organizations/0000000000/roles/on_call_elevated": {}},
+			Resources: map[Resource]struct{}{"organizations/0000000000": {}},
+		},
+	}}
+	static, err := groups.ParseStaticGroups([]byte(`{"groups": {"sre": ["user@gmail.com"], "on-call@example.io": ["other@gmail.com"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock := gcp.NewMockGoogler()
+	mock.ListF = gcp.MockGroupMemberships(map[string][]string{"user@gmail.com": {"on-call@example.io"}})
+	gs := gcp.NewService(mock)
+	gs = gs.WithGroupSource(groups.Union(gcp.DirectoryGroups(gs, "gmail.com"), static))
+	tests := []struct {
+		name      string
+		requestor Requestor
+		role      Role
+		expected  bool
+	}{
+		{"static group", "user@gmail.com", "organizations/0000000000/roles/sre", true},
+		{"directory group", "user@gmail.com", "organizations/0000000000/roles/on_call_elevated", true},
+		{"static group named like a directory group", "other@gmail.com", "organizations/0000000000/roles/on_call_elevated", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			r := &EscalationRequest{Requestor: tt.requestor, Role: tt.role, Resource: "organizations/0000000000"}
+			ok, err := AuthorizeRequest(context.Background(), p, r, gs)
+			if ok != tt.expected {
+				t.Errorf("got %v (%v), want %v", ok, err, tt.expected)
+			}
+		})
+	}
+}
+
+// slackDirectory is a slack workspace for the slack group source, with everyone's user ID by their slack email
+type slackDirectory struct {
+	users      map[string]string
+	userGroups []slack.UserGroup
+}
+
+func (s slackDirectory) GetUserByEmailContext(ctx context.Context, email string) (*slack.User, error) {
+	id, ok := s.users[email]
+	if !ok {
+		return nil, slack.SlackErrorResponse{Err: "users_not_found"}
+	}
+	return &slack.User{ID: id}, nil
+}
+
+func (s slackDirectory) GetUserInfoContext(ctx context.Context, user string) (*slack.User, error) {
+	for _, id := range s.users {
+		if id == user {
+			return &slack.User{ID: id}, nil
+		}
+	}
+	return nil, slack.SlackErrorResponse{Err: "user_not_found"}
+}
+
+func (s slackDirectory) GetUserGroupsContext(ctx context.Context, options ...slack.GetUserGroupsOption) ([]slack.UserGroup, error) {
+	return s.userGroups, nil
+}
+
+func TestAuthorizeRequestSlackGroupsMappedIdentity(t *testing.T) {
+	p := &PolicyRules{PolicyRules: []Rule{{
+		Groups:    Groups{"slack:oncall": {}},
+		Roles:     map[Role]struct{}{"organizations/0000000000/roles/on_call_elevated": {}},
+		Resources: map[Resource]struct{}{"organizations/0000000000": {}},
+	}}}
+	client := slackDirectory{
+		users:      map[string]string{"contractor@vendor.com": "U1"},
+		userGroups: []slack.UserGroup{{ID: "S1", Handle: "oncall", Users: []string{"U1"}}},
+	}
+	gs := gcp.NewService(gcp.NewMockGoogler()).WithGroupSource(groups.NewSlackGroups(client, 0))
+	// The slack email was mapped to a google identity that slack doesn't know about, the slack user ID on the request still finds them
+	r := &EscalationRequest{
+		Requestor:     "contractor.ext@gmail.com",
+		Role:          "organizations/0000000000/roles/on_call_elevated",
+		Resource:      "organizations/0000000000",
+		SlackPostures: map[string]SlackPosture{"contractor.ext@gmail.com": {UserID: "U1", Email: "contractor@vendor.com"}},
+	}
+	ok, err := AuthorizeRequest(context.Background(), p, r, gs)
+	if err != nil || !ok {
+		t.Errorf("got %v (%v), want authorized", ok, err)
+	}
+	if diff := cmp.Diff(r.Groups, Groups{"slack:oncall": {}}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
+
+func TestAuthorizeRequestAccountRequirements(t *testing.T) {
+	rule := func(groups Groups, role Role) Rule {
+		return Rule{Groups: groups, Roles: map[Role]struct{}{role: {}}, Resources: map[Resource]struct{}{"organizations/0000000000": {}}}
+	}
+	strict := rule(Groups{"on-call@example.io": {}}, "organizations/0000000000/roles/on_call_elevated")
+	strict.Require2SV = true
+	strict.DenySuspended = true
+	strict.DenyArchived = true
+	lenient := rule(Groups{"on-call@example.io": {}}, "organizations/0000000000/roles/viewer")
+	p := &PolicyRules{PolicyRules: []Rule{strict, lenient}}
+	tests := []struct {
+		name       string
+		role       Role
+		user       *admin.User
+		lookupErr  error
+		expected   bool
+		wantReason string
+	}{
+		{"healthy account", "organizations/0000000000/roles/on_call_elevated", &admin.User{IsEnrolledIn2Sv: true}, nil, true, ""},
+		{"suspended", "organizations/0000000000/roles/on_call_elevated", &admin.User{IsEnrolledIn2Sv: true, Suspended: true}, nil, false, "the account is suspended"},
+		{"archived", "organizations/0000000000/roles/on_call_elevated", &admin.User{IsEnrolledIn2Sv: true, Archived: true}, nil, false, "the account is archived"},
+		{"no 2-step verification", "organizations/0000000000/roles/on_call_elevated", &admin.User{}, nil, false, "2-Step Verification isn't turned on"},
+		{"every problem", "organizations/0000000000/roles/on_call_elevated", &admin.User{Suspended: true, Archived: true}, nil, false, "the account is suspended, the account is archived, 2-Step Verification isn't turned on"},
+		{"can't look up the account", "organizations/0000000000/roles/on_call_elevated", nil, fmt.Errorf("can't reach google"), false, "the account couldn't be checked"},
+		{"rule without requirements", "organizations/0000000000/roles/viewer", &admin.User{Suspended: true}, nil, true, ""},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			mock := gcp.NewMockGoogler()
+			lookups := 0
+			mock.GetUserF = func(ctx context.Context, email string) (*admin.User, error) {
+				lookups++
+				return tt.user, tt.lookupErr
+			}
+			r := &EscalationRequest{Requestor: "user@gmail.com", Role: tt.role, Resource: "organizations/0000000000"}
+			ok, err := AuthorizeRequest(context.Background(), p, r, gcp.NewService(mock))
+			if ok != tt.expected {
+				t.Errorf("got %v (%v), want %v", ok, err, tt.expected)
+			}
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, ErrAccountRequirements) || !strings.HasSuffix(err.Error(), ": "+tt.wantReason) {
+				t.Errorf("got %v, want ErrAccountRequirements with %q", err, tt.wantReason)
+			}
+			// The account is only looked up when a rule that could authorize the request checks it
+			wantLookups := 1
+			if tt.role == "organizations/0000000000/roles/viewer" {
+				wantLookups = 0
+			}
+			if lookups != wantLookups {
+				t.Errorf("got %d account lookups, want %d", lookups, wantLookups)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// ErrCancellerNotAuthorized is wrapped with the reason the request can't be cancelled, so it can be shown to whoever tried
+var ErrCancellerNotAuthorized = errors.New("you can't cancel this request")
+
+// CancelRequest withdraws a request that's still waiting on approvals. Only its requestor can cancel it.
+func CancelRequest(a *EscalationApproval, canceller string, gs *gcp.Service) error {
+	if a.CurrentState() != StatePending {
+		return fmt.Errorf("%w: the request is %s, only pending requests can be cancelled", ErrCancellerNotAuthorized, a.CurrentState())
+	}
+	if canceller != string(a.Requestor) {
+		return fmt.Errorf("%w: only %s can cancel it", ErrCancellerNotAuthorized, a.Requestor)
+	}
+	return transition(a, StateCancelled, canceller, gs, "")
+}
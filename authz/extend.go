@@ -0,0 +1,56 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// ErrExtenderNotAuthorized is wrapped with the reason the grant can't be extended, so it can be shown to whoever tried
+var ErrExtenderNotAuthorized = errors.New("you can't extend this grant")
+
+// AuthorizeExtender checks the grant is still active and that it's the requestor asking to extend it
+func AuthorizeExtender(original *EscalationApproval, extender string) error {
+	if original.CurrentState() != StateActive {
+		return fmt.Errorf("%w: the request is %s, only active grants can be extended", ErrExtenderNotAuthorized, original.CurrentState())
+	}
+	if extender != string(original.Requestor) {
+		return fmt.Errorf("%w: only %s can extend it", ErrExtenderNotAuthorized, original.Requestor)
+	}
+	return nil
+}
+
+// PrepareExtension links a new request to the active grant it extends, it's then authorized and approved like any other request.
+// The requestor, reason and duration come from the extension, the role and resource from the grant.
+func PrepareExtension(original *EscalationApproval, r *EscalationRequest) error {
+	if err := AuthorizeExtender(original, string(r.Requestor)); err != nil {
+		return err
+	}
+	r.Role = original.Role
+	r.Resource = original.Resource
+	r.ExtensionOf = original.ID
+	r.ExtendsExpiry = original.Expiry
+	r.GrantedSince = original.GrantStart().Format(time.RFC3339)
+	return nil
+}
+
+// MarkExtended moves the original request to extended once its extension has been granted, along with the new expiry of its binding
+func MarkExtended(original, extension *EscalationApproval, gs *gcp.Service) error {
+	if extension.ExtensionOf != original.ID || extension.CurrentState() != StateActive {
+		return fmt.Errorf("request %s hasn't extended request %s", extension.ID, original.ID)
+	}
+	original.Expiry = extension.Expiry
+	return transition(original, StateExtended, extension.Approver, gs, fmt.Sprintf("extended until %s by request %s", extension.Expiry, extension.ID))
+}
+
+// withinCumulativeDuration checks an extension doesn't make the grant last longer in total than the rule allows
+func withinCumulativeDuration(pol Rule, r *EscalationRequest, fallback time.Duration) bool {
+	total, err := r.CumulativeDuration()
+	if err != nil {
+		return false
+	}
+	return total <= pol.GrantMaxCumulativeDuration(fallback)
+}
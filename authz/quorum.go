@@ -0,0 +1,153 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// listGroups looks up a user's groups, following nested groups when the policy turns them on.
+// The slack account recorded for the user on the request is passed along, for the sources that look users up in slack.
+// Groups that came from the cache because the directory couldn't be reached are used, and noted on the request for the audit.
+func listGroups(ctx context.Context, p *PolicyRules, r *EscalationRequest, user Requestor, gs *gcp.Service) (Groups, error) {
+	if posture, ok := r.SlackPostures[string(user)]; ok {
+		ctx = gcp.WithSlackUser(ctx, user, posture.UserID)
+	}
+	groups, err := gs.ListGroups(ctx, user, p.GroupDepth())
+	stale := gcp.StaleGroups(err)
+	if len(stale) == 0 {
+		return groups, err
+	}
+	for _, s := range stale {
+		slog.Warn(s.Error())
+		if !slices.Contains(r.StaleGroups, s.Error()) {
+			r.StaleGroups = append(r.StaleGroups, s.Error())
+		}
+	}
+	return groups, nil
+}
+
+// listApproverGroups looks up the groups of every approver, only when one of the rules has approver groups to check them against
+func listApproverGroups(ctx context.Context, p *PolicyRules, r *EscalationRequest, rules []Rule, approvers []string, gs *gcp.Service) (map[string]Groups, error) {
+	approverGroups := make(map[string]Groups, len(approvers))
+	needed := false
+	for _, pol := range rules {
+		if len(pol.ApproverGroups) > 0 {
+			needed = true
+		}
+	}
+	if !needed {
+		return approverGroups, nil
+	}
+	for _, approver := range approvers {
+		groups, err := listGroups(ctx, p, r, Requestor(approver), gs)
+		if err != nil {
+			return nil, fmt.Errorf("can't get group membership for approver: %v: %s", approver, err)
+		}
+		approverGroups[approver] = groups
+	}
+	return approverGroups, nil
+}
+
+// authorizeApprover checks the approver is in an approver group of one of the rules that authorized the request.
+// A rule without approver groups can be approved by anyone from the valid domain.
+func authorizeApprover(rules []Rule, approver string, requestor Requestor, approverGroups map[string]Groups) error {
+	required := map[string]struct{}{}
+	for _, pol := range rules {
+		if len(eligibleGroups(pol, approver, requestor, approverGroups)) > 0 {
+			return nil
+		}
+		for g := range pol.ApproverGroups {
+			required[string(g)] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(required))
+	for g := range required {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("%w: %s isn't a member of any approver group for this role and resource, one of these is needed: %s",
+		ErrApproverNotAuthorized, approver, strings.Join(names, ", "))
+}
+
+// approvalsRemaining is how many more approvals are needed before the least demanding of the rules is satisfied
+func approvalsRemaining(rules []Rule, approvers []string, requestor Requestor, approverGroups map[string]Groups) int {
+	remaining := -1
+	for _, pol := range rules {
+		needed := max(pol.RequiredApprovals, 1) - countApprovals(pol, approvers, requestor, approverGroups)
+		if remaining == -1 || needed < remaining {
+			remaining = needed
+		}
+	}
+	return max(remaining, 0)
+}
+
+// countApprovals counts the approvers who can approve under the rule.
+// When the rule needs distinct approver groups, each approver is matched to a different group, and only matched approvers count.
+func countApprovals(pol Rule, approvers []string, requestor Requestor, approverGroups map[string]Groups) int {
+	eligible := make(map[string][]Group)
+	for _, approver := range approvers {
+		if groups := eligibleGroups(pol, approver, requestor, approverGroups); len(groups) > 0 {
+			eligible[approver] = groups
+		}
+	}
+	if !pol.DistinctApproverGroups || len(pol.ApproverGroups) == 0 {
+		return len(eligible)
+	}
+	// A small bipartite matching of approvers to groups, there are only ever a handful of approvers
+	matchedTo := make(map[Group]string)
+	var assign func(approver string, seen map[Group]bool) bool
+	assign = func(approver string, seen map[Group]bool) bool {
+		for _, g := range eligible[approver] {
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+			if other, ok := matchedTo[g]; !ok || assign(other, seen) {
+				matchedTo[g] = approver
+				return true
+			}
+		}
+		return false
+	}
+	count := 0
+	for _, approver := range approvers {
+		if _, ok := eligible[approver]; ok && assign(approver, map[Group]bool{}) {
+			count++
+		}
+	}
+	return count
+}
+
+// eligibleGroups returns the approver groups of the rule the approver can approve through.
+// A rule without approver groups returns a single empty group for anyone that isn't the requestor and is from the valid domain.
+// Under self or auto approval the requestor can always approve, regardless of the approver groups.
+func eligibleGroups(pol Rule, approver string, requestor Requestor, approverGroups map[string]Groups) []Group {
+	if !strings.HasSuffix(approver, fmt.Sprintf("@%s", config.Cfg.ValidDomain)) {
+		return nil
+	}
+	if approver == string(requestor) {
+		if pol.Mode() == PeerApproval {
+			return nil
+		}
+		return []Group{""}
+	}
+	if len(pol.ApproverGroups) == 0 {
+		return []Group{""}
+	}
+	var groups []Group
+	for g := range approverGroups[approver] {
+		if _, ok := pol.ApproverGroups[g]; ok {
+			groups = append(groups, g)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i] < groups[j] })
+	return groups
+}
@@ -0,0 +1,74 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// ErrRevokerNotAuthorized is wrapped with the reason the grant can't be revoked, so it can be shown to whoever tried
+var ErrRevokerNotAuthorized = errors.New("you can't revoke this grant")
+
+// AuthorizeRevocationAndRevokeIAM removes an active grant before it expires.
+// The requestor, anyone who approved it, or anyone who could approve it under the policy can revoke it.
+func AuthorizeRevocationAndRevokeIAM(ctx context.Context, p *PolicyRules, a *EscalationApproval, revoker string, gs *gcp.Service) error {
+	if a.CurrentState() != StateActive {
+		return fmt.Errorf("%w: the request is %s, only active grants can be revoked", ErrRevokerNotAuthorized, a.CurrentState())
+	}
+	if !strings.HasSuffix(revoker, fmt.Sprintf("@%s", config.Cfg.ValidDomain)) {
+		return fmt.Errorf("%w: %v isn't from %s", ErrRevokerNotAuthorized, revoker, config.Cfg.ValidDomain)
+	}
+	if !involved(a, revoker) {
+		if err := authorizeRevoker(ctx, p, a, revoker, gs); err != nil {
+			return err
+		}
+	}
+	found, err := gcp.RevokeIAMPolicy(ctx, a, gs)
+	if err != nil {
+		return fmt.Errorf("couldn't revoke IAM policy: %w", err)
+	}
+	note := ""
+	if !found {
+		note = "the binding had already been removed"
+	}
+	return transition(a, StateRevoked, revoker, gs, note)
+}
+
+// involved is whether the revoker requested or approved the grant
+func involved(a *EscalationApproval, revoker string) bool {
+	if revoker == string(a.Requestor) || revoker == a.Approver {
+		return true
+	}
+	for _, approver := range a.Approvals {
+		if approver == revoker {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeRevoker checks the revoker could approve the request under the rules that authorize it now
+func authorizeRevoker(ctx context.Context, p *PolicyRules, a *EscalationApproval, revoker string, gs *gcp.Service) error {
+	r := *a.EscalationRequest
+	ok, err := AuthorizeRequest(ctx, p, &r, gs)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: only the requestor or an approver can revoke a grant the policy no longer allows", ErrRevokerNotAuthorized)
+	}
+	rules := authorizingRules(p, &r)
+	approverGroups, err := listApproverGroups(ctx, p, &r, rules, []string{revoker}, gs)
+	if err != nil {
+		return err
+	}
+	if err := authorizeApprover(rules, revoker, r.Requestor, approverGroups); err != nil {
+		return fmt.Errorf("%w: only the requestor, an approver, or someone who could approve it can revoke it", ErrRevokerNotAuthorized)
+	}
+	return nil
+}
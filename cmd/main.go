@@ -1,16 +1,41 @@
 package main
 
 import (
+	"context"
 	"log"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/seslattery/gcpsudobot"
+	"github.com/seslattery/gcpsudobot/config"
 )
 
 func main() {
+	if config.Cfg.ReaperIntervalInMinutes > 0 {
+		go reapPeriodically(context.Background(), time.Duration(config.Cfg.ReaperIntervalInMinutes)*time.Minute)
+	} else {
+		slog.Info("REAPER_INTERVAL_MINUTES isn't positive, the reaper is disabled")
+	}
 	slog.Info("Starting http server on :8080...")
 	http.HandleFunc("/ActionHandler", gcpsudobot.ActionHandler)
 	http.HandleFunc("/SlashHandler", gcpsudobot.SlashHandler)
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+// In server mode there's no scheduler hitting the ReaperHandler, so expired grants are cleaned up from here instead.
+// The interval has to be positive.
+func reapPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := gcpsudobot.ReapExpiredGrants(ctx); err != nil {
+			slog.Error(err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// restore lists the IAM policy snapshots the bot took before its writes, and re-applies one after an operator confirms it.
+//
+//	restore -resource organizations/0000000000
+//	restore -snapshot organizations/0000000000/20240428T000000.000000000Z-<request id>.json
+//
+// Snapshots are read from wherever POLICY_SNAPSHOTS points the bot.
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+func main() {
+	resource := flag.String("resource", "", "list the snapshots of this resource")
+	name := flag.String("snapshot", "", "diff this snapshot against the live policy, and re-apply it once confirmed")
+	flag.Parse()
+	if (*resource == "") == (*name == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	snapshots, err := gcp.NewPolicySnapshotter(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if snapshots == nil {
+		log.Fatal("POLICY_SNAPSHOTS is none, there are no snapshots to restore")
+	}
+
+	if *resource != "" {
+		names, err := snapshots.List(ctx, Resource(*resource))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, n := range names {
+			fmt.Println(n)
+		}
+		return
+	}
+
+	s, err := snapshots.Load(ctx, *name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var googleService *gcp.Service
+	if config.Cfg.MockGoogleAPIs {
+		googleService = gcp.NewService(gcp.NewMockGoogler())
+	} else {
+		googleService, err = gcp.NewGoogleService()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	restored, err := gcp.RestorePolicySnapshot(ctx, s, googleService, func(diff gcp.PolicyDiff) bool {
+		printDiff(s, diff)
+		return confirm(s.Resource)
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !restored {
+		fmt.Printf("The policy on %s was not changed.\n", s.Resource)
+		return
+	}
+	fmt.Printf("Restored the policy on %s from %s.\n", s.Resource, *name)
+}
+
+func printDiff(s *gcp.PolicySnapshot, diff gcp.PolicyDiff) {
+	fmt.Printf("Re-applying the snapshot of %s taken at %s would change the live policy:\n", s.Resource, s.TakenAt)
+	for _, c := range diff.Removed {
+		fmt.Printf("- %s %s %s\n", c.Role, strings.Join(c.Members, ","), c.Condition)
+	}
+	for _, c := range diff.Added {
+		fmt.Printf("+ %s %s %s\n", c.Role, strings.Join(c.Members, ","), c.Condition)
+	}
+	if diff.AuditConfigsChanged {
+		fmt.Println("~ the audit configs")
+	}
+}
+
+// confirm makes the operator type out the resource, so a restore isn't applied by hitting enter
+func confirm(resource Resource) bool {
+	fmt.Printf("Type %s to re-apply it: ", resource)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(answer) == string(resource)
+}
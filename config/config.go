@@ -1,10 +1,15 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log/slog"
 	"strconv"
+	"strings"
+	"time"
 
 	"os"
 
@@ -14,17 +19,85 @@ import (
 type Config struct {
 	ValidDomain            string
 	GsuiteAdmin            string
-	ServiceAccount 		   string
+	ServiceAccount         string
 	SlackChannel           string
 	SlackSigningSecret     string
 	SlackToken             string
 	EscalationPolicy       *PolicyRules
 	DurationOfGrantInHours int
 	MockGoogleAPIs         bool
+	// Shared secret the scheduler must send as a bearer token to the ReaperHandler
+	ReaperSecret            string
+	ReaperIntervalInMinutes int
+	// Key for signing the approval payloads in the slack buttons, defaults to a key derived from the slack signing secret
+	PayloadSigningKey       string
+	ApprovalMaxAgeInMinutes int
+	// Where requests are kept between the modal and the approval, one of memory, file or firestore. There's no default, memory is only allowed with MockGoogleAPIs.
+	RequestStore        string
+	RequestStorePath    string
+	FirestoreProject    string
+	FirestoreCollection string
+	// How many times, and for how long, an IAM policy update is retried when the policy changes underneath it
+	IAMRetryAttempts          int
+	IAMRetryDeadlineInSeconds int
+	// How many times a binding is read back after it's written, while IAM propagates
+	IAMVerifyAttempts int
+	// Where a copy of each IAM policy is kept before it's written, one of none, local or gcs
+	PolicySnapshots        string
+	PolicySnapshotPath     string
+	PolicySnapshotBucket   string
+	PolicySnapshotEndpoint string
+	// How long group lookups are cached for, and how old they can be when the directory can't be reached, 0 turns either off
+	GroupCacheTTLInSeconds      int
+	GroupCacheMaxStaleInSeconds int
+	// Where users' groups are looked up, any of google, slack, static and scim, see the groups package
+	GroupSources     []string
+	StaticGroupsPath string
+	SCIMEndpoint     string
+	SCIMToken        string
+	// Slack emails that aren't the google identity of the same person, mapped to it, and whether to look up the rest in the directory as aliases
+	IdentityMap         map[string]string
+	ResolveEmailAliases bool
 }
 
 var Cfg *Config
 
+// DefaultGrantDuration is used for rules that don't set their own durations
+func (c *Config) DefaultGrantDuration() time.Duration {
+	return time.Duration(c.DurationOfGrantInHours) * time.Hour
+}
+
+// IAMRetryDeadline is how long an IAM policy update keeps retrying before it gives up
+func (c *Config) IAMRetryDeadline() time.Duration {
+	return time.Duration(c.IAMRetryDeadlineInSeconds) * time.Second
+}
+
+// GroupCacheTTL is how long a group lookup is used for before it's looked up again
+func (c *Config) GroupCacheTTL() time.Duration {
+	return time.Duration(c.GroupCacheTTLInSeconds) * time.Second
+}
+
+// GroupCacheMaxStale is how old a cached group lookup can be and still be used while the directory can't be reached
+func (c *Config) GroupCacheMaxStale() time.Duration {
+	return time.Duration(c.GroupCacheMaxStaleInSeconds) * time.Second
+}
+
+// ApprovalMaxAge is how long a request can be approved or denied for after it's posted
+func (c *Config) ApprovalMaxAge() time.Duration {
+	return time.Duration(c.ApprovalMaxAgeInMinutes) * time.Minute
+}
+
+// derivePayloadSigningKey derives the key for the button payloads from the slack signing secret, so the secret itself is only used to verify slack.
+// It's empty when there's no secret, so nothing can be signed.
+func derivePayloadSigningKey(slackSecret string) string {
+	if slackSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(slackSecret))
+	mac.Write([]byte("gcpsudobot approval payloads"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 func init() {
 	var b bool
 	var err error
@@ -44,6 +117,100 @@ func init() {
 		}
 	}
 
+	var reaperInterval = 15
+	if os.Getenv("REAPER_INTERVAL_MINUTES") != "" {
+		reaperInterval, err = strconv.Atoi(os.Getenv("REAPER_INTERVAL_MINUTES"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var approvalMaxAge = 24 * 60
+	if os.Getenv("APPROVAL_MAX_AGE_MINUTES") != "" {
+		approvalMaxAge, err = strconv.Atoi(os.Getenv("APPROVAL_MAX_AGE_MINUTES"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var iamRetryAttempts = 5
+	if os.Getenv("IAM_RETRY_ATTEMPTS") != "" {
+		iamRetryAttempts, err = strconv.Atoi(os.Getenv("IAM_RETRY_ATTEMPTS"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var iamRetryDeadline = 60
+	if os.Getenv("IAM_RETRY_DEADLINE_SECONDS") != "" {
+		iamRetryDeadline, err = strconv.Atoi(os.Getenv("IAM_RETRY_DEADLINE_SECONDS"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var iamVerifyAttempts = 5
+	if os.Getenv("IAM_VERIFY_ATTEMPTS") != "" {
+		iamVerifyAttempts, err = strconv.Atoi(os.Getenv("IAM_VERIFY_ATTEMPTS"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var payloadSigningKey = derivePayloadSigningKey(os.Getenv("SLACK_SECRET"))
+	if os.Getenv("PAYLOAD_SIGNING_KEY") != "" {
+		payloadSigningKey = os.Getenv("PAYLOAD_SIGNING_KEY")
+	}
+
+	var requestStorePath = "requests.json"
+	if os.Getenv("REQUEST_STORE_PATH") != "" {
+		requestStorePath = os.Getenv("REQUEST_STORE_PATH")
+	}
+
+	var firestoreCollection = "gcpsudobot-requests"
+	if os.Getenv("FIRESTORE_COLLECTION") != "" {
+		firestoreCollection = os.Getenv("FIRESTORE_COLLECTION")
+	}
+
+	var groupCacheTTL = 60
+	if os.Getenv("GROUP_CACHE_TTL_SECONDS") != "" {
+		groupCacheTTL, err = strconv.Atoi(os.Getenv("GROUP_CACHE_TTL_SECONDS"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var groupCacheMaxStale = 900
+	if os.Getenv("GROUP_CACHE_MAX_STALE_SECONDS") != "" {
+		groupCacheMaxStale, err = strconv.Atoi(os.Getenv("GROUP_CACHE_MAX_STALE_SECONDS"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
+	var groupSources = []string{"google"}
+	if os.Getenv("GROUP_SOURCES") != "" {
+		groupSources = nil
+		for _, s := range strings.Split(os.Getenv("GROUP_SOURCES"), ",") {
+			groupSources = append(groupSources, strings.TrimSpace(s))
+		}
+	}
+
+	var staticGroupsPath = "groups.yaml"
+	if os.Getenv("STATIC_GROUPS_PATH") != "" {
+		staticGroupsPath = os.Getenv("STATIC_GROUPS_PATH")
+	}
+
+	var policySnapshots = "none"
+	if os.Getenv("POLICY_SNAPSHOTS") != "" {
+		policySnapshots = os.Getenv("POLICY_SNAPSHOTS")
+	}
+
+	var policySnapshotPath = "policy-snapshots"
+	if os.Getenv("POLICY_SNAPSHOT_PATH") != "" {
+		policySnapshotPath = os.Getenv("POLICY_SNAPSHOT_PATH")
+	}
+
 	var validDomain = "gmail.com"
 	if os.Getenv("VALID_DOMAIN") != "" {
 		validDomain = os.Getenv("VALID_DOMAIN")
@@ -54,38 +221,83 @@ func init() {
 		gsuiteAdmin = os.Getenv("GSUITE_ADMIN_ACCOUNT_TO_IMPERSONATE")
 	}
 
-    var gcpServiceAccount = "service-account@gmail.com"
+	var gcpServiceAccount = "service-account@gmail.com"
 	if os.Getenv("GCP_SERVICE_ACCOUNT") != "" {
 		gcpServiceAccount = os.Getenv("GCP_SERVICE_ACCOUNT")
 	}
 
+	var identityMap map[string]string
+	if os.Getenv("IDENTITY_MAP") != "" {
+		err = json.Unmarshal([]byte(os.Getenv("IDENTITY_MAP")), &identityMap)
+		if err != nil {
+			slog.Error(fmt.Sprintf("config has invalid identity map, using slack emails as they are: %s", err))
+			identityMap = nil
+		}
+	}
+
+	var resolveEmailAliases bool
+	if os.Getenv("RESOLVE_EMAIL_ALIASES") != "" {
+		resolveEmailAliases, err = strconv.ParseBool(os.Getenv("RESOLVE_EMAIL_ALIASES"))
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s", err))
+		}
+	}
+
 	var EscalationPolicy *PolicyRules
 	if os.Getenv("POLICY_RULES") == "" {
 		EscalationPolicy = TestEscalationPolicy
 	} else {
+		EscalationPolicy = &PolicyRules{}
 		err = json.Unmarshal([]byte(os.Getenv("POLICY_RULES")), EscalationPolicy)
+		if err == nil {
+			err = EscalationPolicy.Validate()
+		}
 		if err != nil {
-			slog.Error(fmt.Sprintf("config has invalid policy: %s", err))
+			slog.Error(fmt.Sprintf("config has invalid policy, denying all requests: %s", err))
+			EscalationPolicy = &PolicyRules{}
 		}
 	}
 	Cfg = &Config{
-		ValidDomain:            validDomain,
-		GsuiteAdmin:            gsuiteAdmin,
-		ServiceAccount:  		gcpServiceAccount,
-		SlackChannel:           os.Getenv("SLACK_CHANNEL"),
-		MockGoogleAPIs:         b,
-		SlackSigningSecret:     os.Getenv("SLACK_SECRET"),
-		SlackToken:             os.Getenv("SLACK_API_TOKEN"),
-		EscalationPolicy:       EscalationPolicy,
-		DurationOfGrantInHours: duration,
+		ValidDomain:                 validDomain,
+		GsuiteAdmin:                 gsuiteAdmin,
+		ServiceAccount:              gcpServiceAccount,
+		SlackChannel:                os.Getenv("SLACK_CHANNEL"),
+		MockGoogleAPIs:              b,
+		SlackSigningSecret:          os.Getenv("SLACK_SECRET"),
+		SlackToken:                  os.Getenv("SLACK_API_TOKEN"),
+		EscalationPolicy:            EscalationPolicy,
+		DurationOfGrantInHours:      duration,
+		ReaperSecret:                os.Getenv("REAPER_SECRET"),
+		ReaperIntervalInMinutes:     reaperInterval,
+		PayloadSigningKey:           payloadSigningKey,
+		ApprovalMaxAgeInMinutes:     approvalMaxAge,
+		RequestStore:                os.Getenv("REQUEST_STORE"),
+		RequestStorePath:            requestStorePath,
+		FirestoreProject:            os.Getenv("FIRESTORE_PROJECT"),
+		FirestoreCollection:         firestoreCollection,
+		IAMRetryAttempts:            iamRetryAttempts,
+		IAMRetryDeadlineInSeconds:   iamRetryDeadline,
+		IAMVerifyAttempts:           iamVerifyAttempts,
+		PolicySnapshots:             policySnapshots,
+		PolicySnapshotPath:          policySnapshotPath,
+		PolicySnapshotBucket:        os.Getenv("POLICY_SNAPSHOT_BUCKET"),
+		PolicySnapshotEndpoint:      os.Getenv("POLICY_SNAPSHOT_ENDPOINT"),
+		GroupCacheTTLInSeconds:      groupCacheTTL,
+		GroupCacheMaxStaleInSeconds: groupCacheMaxStale,
+		GroupSources:                groupSources,
+		StaticGroupsPath:            staticGroupsPath,
+		SCIMEndpoint:                os.Getenv("SCIM_ENDPOINT"),
+		SCIMToken:                   os.Getenv("SCIM_TOKEN"),
+		IdentityMap:                 identityMap,
+		ResolveEmailAliases:         resolveEmailAliases,
 	}
 }
 
 // Without a policy defined all requests will be denied by default.
 // Policies can only allow access to roles and resources
-// No support for hierarchy
+// Hierarchy is opt-in per rule with inherit
 // No support for individual membership
-// No support for wildcards
+// Roles and resources can be globs or re: prefixed regexes
 var TestEscalationPolicy = &PolicyRules{
 	PolicyRules: []Rule{
 		{
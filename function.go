@@ -3,6 +3,7 @@ package gcpsudobot
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,18 +11,24 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/seslattery/gcpsudobot/authz"
 	"github.com/seslattery/gcpsudobot/config"
 	"github.com/seslattery/gcpsudobot/gcp"
+	"github.com/seslattery/gcpsudobot/groups"
 	"github.com/seslattery/gcpsudobot/slacking"
+	"github.com/seslattery/gcpsudobot/store"
+	"github.com/seslattery/gcpsudobot/types"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/slack-go/slack"
 )
 
 var slackClient *slack.Client
+var slackUsers *slacking.Users
 var googleService *gcp.Service
+var requestStore store.RequestStore
 
 func init() {
 	opts := &slog.HandlerOptions{
@@ -42,9 +49,33 @@ func init() {
 
 		}
 	}
+	groupSource, err := groups.NewSource(context.Background(), googleService, slackClient)
+	if err != nil {
+		slog.Error(fmt.Sprintf("%s", err))
+		return
+	}
+	googleService = googleService.WithGroupSource(groupSource)
+	// Aliases are looked up in the directory through the same service as everything else
+	var aliases gcp.UserDirectory
+	if config.Cfg.ResolveEmailAliases {
+		aliases = googleService
+	}
+	identities, err := gcp.NewIdentityResolver(config.Cfg.IdentityMap, aliases)
+	if err != nil {
+		slog.Error(fmt.Sprintf("%s", err))
+		return
+	}
+	slackUsers = &slacking.Users{API: slackClient, Identities: identities}
+	requestStore, err = newRequestStore(context.Background())
+	if err != nil {
+		slog.Error(fmt.Sprintf("%s", err))
+		return
+	}
 	// Ensure any exposed functions have verifyMessageFromSlack called as their first step
 	functions.HTTP("SlashHandler", SlashHandler)
 	functions.HTTP("ActionHandler", ActionHandler)
+	// ReaperHandler isn't called by slack, it verifies a shared secret from the scheduler instead
+	functions.HTTP("ReaperHandler", ReaperHandler)
 }
 
 func SlashHandler(w http.ResponseWriter, r *http.Request) {
@@ -62,6 +93,27 @@ func SlashHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	switch s.Command {
 	case "/sudo":
+		var controller func(context.Context, slack.SlashCommand) ([]byte, error)
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(s.Text), "revoke"):
+			controller = revokeCommandController
+		case strings.HasPrefix(strings.TrimSpace(s.Text), "cancel"):
+			controller = cancelCommandController
+		}
+		if controller != nil {
+			msg, err := controller(r.Context(), s)
+			if err != nil {
+				slog.Error(err.Error())
+				msg, err = ephemeralResponse(err.Error())
+			}
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(msg)
+			return
+		}
 		modalRequest := slacking.GenerateModalRequest(config.Cfg.EscalationPolicy)
 		_, err = slackClient.OpenView(s.TriggerID, modalRequest)
 		if err != nil {
@@ -94,9 +146,14 @@ func ActionHandler(w http.ResponseWriter, r *http.Request) {
 	case "view_submission":
 		//send an empty acceptance response
 		w.WriteHeader(http.StatusOK)
-		err = modalSubmissionController(message, slackClient, googleService)
+		if message.View.CallbackID == slacking.ExtensionCallbackID {
+			err = extensionSubmissionController(message)
+		} else {
+			err = modalSubmissionController(message, slackUsers, googleService)
+		}
+		var conflict *gcp.ConflictError
 		if err != nil {
-			if errors.Is(err, ErrUnauthorized) {
+			if errors.Is(err, ErrUnauthorized) || errors.Is(err, authz.ErrExtenderNotAuthorized) || errors.Is(err, slacking.ErrSlackPosture) || errors.As(err, &conflict) {
 				modalError(err)
 			}
 			slog.Error(err.Error())
@@ -104,12 +161,35 @@ func ActionHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	case "block_actions":
-		msg, err := approvalActionController(message)
+		if len(message.ActionCallback.BlockActions) == 0 {
+			slog.Error("block_actions callback without any actions")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var msg []byte
+		switch message.ActionCallback.BlockActions[0].ActionID {
+		case slacking.RevokeButtonID:
+			msg, err = revokeActionController(message)
+		case slacking.ExtendButtonID:
+			err = extendActionController(message)
+		default:
+			msg, err = approvalActionController(message, slackRetry(r))
+		}
+		var conflict *gcp.ConflictError
+		if errors.Is(err, authz.ErrApproverNotAuthorized) || errors.Is(err, authz.ErrRevokerNotAuthorized) || errors.Is(err, authz.ErrExtenderNotAuthorized) || errors.Is(err, authz.ErrAccountRequirements) || errors.Is(err, slacking.ErrSlackPosture) || errors.As(err, &conflict) || errors.Is(err, store.ErrConflict) {
+			// Only whoever clicked sees why, the request is left as it was
+			slog.Warn(err.Error())
+			msg, err = ephemeralResponse(err.Error())
+		}
 		if err != nil {
 			slog.Error(err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
+		// Opening the extension modal leaves the message as it was
+		if msg == nil {
+			return
+		}
 		sendHTTPResponse(w, r, message.ResponseURL, msg)
 	default:
 		slog.Error(fmt.Sprintf("unsupported action: %v", message.Type))
@@ -118,6 +198,59 @@ func ActionHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Recorded as the actor when the reaper expires a request
+const reaperActor = "gcpsudobot reaper"
+
+// ReaperHandler removes the bot's expired conditional IAM bindings. It's meant to be invoked on a schedule, e.g. by Cloud Scheduler.
+func ReaperHandler(w http.ResponseWriter, r *http.Request) {
+	slog.Debug("ReaperHandler")
+	if err := verifyReaperRequest(r, config.Cfg.ReaperSecret); err != nil {
+		slog.Error(err.Error())
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if _, err := ReapExpiredGrants(r.Context()); err != nil {
+		slog.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// ReapExpiredGrants removes expired conditional bindings the bot created on any resource in the escalation policy, or that a request was granted on.
+func ReapExpiredGrants(ctx context.Context) (int, error) {
+	// The resources in the policy are still reaped when the store can't be read
+	granted, err := store.GrantedResources(ctx, requestStore)
+	if err != nil {
+		slog.Error(fmt.Sprintf("couldn't list granted resources: %v", err))
+	}
+	// A resource that can't be reaped doesn't stop the requests from expiring, both steps always run
+	var errs []error
+	removed, err := gcp.ReapExpiredBindings(ctx, config.Cfg.EscalationPolicy, granted, googleService)
+	slog.Info(fmt.Sprintf("reaper removed %d expired bindings", removed))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("reaping expired bindings: %v", err))
+	}
+	expired, err := store.ExpireRequests(ctx, requestStore, reaperActor, gcp.Now(googleService), config.Cfg.ApprovalMaxAge())
+	slog.Info(fmt.Sprintf("reaper expired %d requests", expired))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("expiring requests: %v", err))
+	}
+	return removed, errors.Join(errs...)
+}
+
+// verifyReaperRequest checks the request carries the reaper's shared secret as a bearer token.
+// If no secret is configured every request is rejected.
+func verifyReaperRequest(r *http.Request, secret string) error {
+	if secret == "" {
+		return fmt.Errorf("reaper secret isn't configured")
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("invalid reaper token")
+	}
+	return nil
+}
+
 // verifyMessageFromSlack is what ensures the messages are coming from slack by utilizing a unique signing secret.
 func verifyMessageFromSlack(r *http.Request, signingSecret string) error {
 	slog.Debug("verifying message came from slack")
@@ -145,16 +278,295 @@ func verifyMessageFromSlack(r *http.Request, signingSecret string) error {
 	return nil
 }
 
-func approvalActionController(message slack.InteractionCallback) ([]byte, error) {
+// slackRetry reports whether slack is retrying a request it didn't get a response to in time, the first attempt may already have been acted on
+func slackRetry(r *http.Request) bool {
+	num := r.Header.Get("X-Slack-Retry-Num")
+	if num == "" {
+		return false
+	}
+	slog.Info(fmt.Sprintf("slack retry %s: %s", num, r.Header.Get("X-Slack-Retry-Reason")))
+	return true
+}
+
+func approvalActionController(message slack.InteractionCallback, retry bool) ([]byte, error) {
+	ctx := context.Background()
+	// The first attempt has already claimed the button's nonce, so the request itself is checked to say what happened to it
+	if retry {
+		if msg, ok := alreadyDecidedResponse(ctx, message); ok {
+			return msg, nil
+		}
+	}
+	escalationApproval, err := slacking.ParseEscalationRequestFromApproval(ctx, slackUsers, requestStore, message)
+	if errors.Is(err, slacking.ErrButtonUsed) {
+		if msg, ok := alreadyDecidedResponse(ctx, message); ok {
+			return msg, nil
+		}
+		return ephemeralResponse("This request is already being approved.")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse escalation request from approval: %w", err)
+	}
+	err = authz.AuthorizeApprovalAndGrantIAM(ctx, config.Cfg.EscalationPolicy, escalationApproval, googleService)
+	if err != nil && escalationApproval.State != types.StateFailed {
+		// Nothing was acted on, so the buttons can still be used, e.g. by someone who can approve, or again after an IAM conflict
+		slacking.ReleaseApproval(ctx, requestStore, escalationApproval)
+		return nil, fmt.Errorf("couldn't grant iam: %w", err)
+	}
+	if err != nil {
+		// The failure is recorded on the request and shown in the message
+		slog.Error(err.Error())
+	}
+	// The grant has already happened by now, so failing to record it shouldn't stop the message from being updated.
+	// Unless the request was changed while it was being acted on, then what was decided here doesn't stand.
+	err = requestStore.Update(ctx, escalationApproval)
+	if errors.Is(err, store.ErrConflict) {
+		undoGrant(ctx, escalationApproval)
+		slacking.ReleaseApproval(ctx, requestStore, escalationApproval)
+		return nil, err
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("couldn't save request %s: %v", escalationApproval.ID, err))
+	}
+	markExtended(ctx, escalationApproval)
+	// Still waiting on more approvers, so the request is updated in place with who has approved so far
+	var blocks []slack.Block
+	if escalationApproval.State == types.StatePending {
+		blocks, err = slacking.GenerateSlackEscalationRequestMessage(escalationApproval)
+	} else {
+		blocks, err = slacking.GenerateSlackEscalationResponseMessage(escalationApproval)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate slack message: %v", err)
+	}
+	return replaceOriginalResponse(blocks)
+}
+
+// undoGrant removes the binding an approval made, when the approval couldn't be saved, e.g. because the request had changed in the meantime.
+// Otherwise the binding would be in IAM while the stored request is e.g. denied, expired or missing, and it could never be revoked through the bot.
+func undoGrant(ctx context.Context, a *types.EscalationApproval) {
+	if a.State != types.StateActive {
+		return
+	}
+	if a.IsExtension() {
+		slog.Error(fmt.Sprintf("request %s extended its grant, but couldn't be saved, the grant's expiry has to be checked by hand", a.ID))
+		return
+	}
+	if _, err := gcp.RevokeIAMPolicy(ctx, a, googleService); err != nil {
+		slog.Error(fmt.Sprintf("couldn't remove the binding of request %s, whose grant couldn't be saved: %v", a.ID, err))
+	}
+}
+
+// alreadyDecidedResponse tells whoever clicked who decided the request, if it's no longer pending
+func alreadyDecidedResponse(ctx context.Context, message slack.InteractionCallback) ([]byte, bool) {
+	id, err := slacking.ButtonRequestID(message)
+	if err != nil {
+		return nil, false
+	}
+	a, err := requestStore.Get(ctx, id)
+	if err != nil || a.CurrentState() == types.StatePending {
+		return nil, false
+	}
+	msg, err := ephemeralResponse(fmt.Sprintf("This request was already %s.", a.Decision()))
+	if err != nil {
+		return nil, false
+	}
+	return msg, true
+}
+
+func revokeActionController(message slack.InteractionCallback) ([]byte, error) {
+	ctx := context.Background()
+	escalationApproval, revoker, err := slacking.ParseEscalationRequestFromRevocation(ctx, slackUsers, requestStore, message)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse escalation request from revocation: %w", err)
+	}
+	if err := revoke(ctx, escalationApproval, revoker); err != nil {
+		slacking.ReleaseApproval(ctx, requestStore, escalationApproval)
+		return nil, err
+	}
+	blocks, err := slacking.GenerateSlackEscalationResponseMessage(escalationApproval)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate slack message: %v", err)
+	}
+	return replaceOriginalResponse(blocks)
+}
+
+// extendActionController opens the modal for extending the grant, only its requestor can extend it
+func extendActionController(message slack.InteractionCallback) error {
+	ctx := context.Background()
+	original, extender, err := slacking.ParseEscalationRequestFromExtension(ctx, slackUsers, requestStore, message)
+	if err != nil {
+		return fmt.Errorf("couldn't parse escalation request from extension: %w", err)
+	}
+	if err := authz.AuthorizeExtender(original, extender); err != nil {
+		return err
+	}
+	if _, err := slackClient.OpenView(message.TriggerID, slacking.GenerateExtensionModalRequest(config.Cfg.EscalationPolicy, original)); err != nil {
+		return fmt.Errorf("opening view: %v", err)
+	}
+	return nil
+}
+
+// extensionSubmissionController links the extension to the grant it extends, then it's submitted like any other request
+func extensionSubmissionController(message slack.InteractionCallback) error {
+	slog.Info("extension submission")
 	ctx := context.Background()
-	escalationApproval, err := slacking.ParseEscalationRequestFromApproval(slackClient, message)
+	original, escalationRequest, err := slacking.ParseExtensionRequestFromModal(ctx, slackUsers, requestStore, message)
+	if err != nil {
+		return fmt.Errorf("couldn't parse slack modal: %w", err)
+	}
+	if err := authz.PrepareExtension(original, escalationRequest); err != nil {
+		return err
+	}
+	return submitRequest(ctx, escalationRequest)
+}
+
+// markExtended moves the grant an extension extends to extended once the extension is active, and updates its message
+func markExtended(ctx context.Context, extension *types.EscalationApproval) {
+	if !extension.IsExtension() || extension.State != types.StateActive {
+		return
+	}
+	original, err := requestStore.Get(ctx, extension.ExtensionOf)
+	if err != nil {
+		slog.Error(fmt.Sprintf("couldn't load extended request %s: %v", extension.ExtensionOf, err))
+		return
+	}
+	if err := authz.MarkExtended(original, extension, googleService); err != nil {
+		slog.Error(fmt.Sprintf("couldn't mark request %s as extended: %v", original.ID, err))
+		return
+	}
+	if err := requestStore.Update(ctx, original); err != nil {
+		slog.Error(fmt.Sprintf("couldn't save request %s: %v", original.ID, err))
+	}
+	updateRequestMessage(original)
+}
+
+// revokeCommandController handles `/sudo revoke [request id]`. Without a request id, all of the sender's active grants are revoked.
+func revokeCommandController(ctx context.Context, s slack.SlashCommand) ([]byte, error) {
+	revoker, id, err := slacking.ParseRevokeCommand(ctx, slackUsers, s)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*types.EscalationApproval
+	if id != "" {
+		a, err := requestStore.Get(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load request: %v", err)
+		}
+		targets = append(targets, a)
+	} else {
+		approvals, err := requestStore.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list requests: %v", err)
+		}
+		for _, a := range approvals {
+			if a.CurrentState() == types.StateActive && string(a.Requestor) == revoker {
+				targets = append(targets, a)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return ephemeralResponse("You don't have any active grants to revoke.")
+	}
+	var lines []string
+	for _, a := range targets {
+		if err := revoke(ctx, a, revoker); err != nil {
+			lines = append(lines, fmt.Sprintf("Couldn't revoke %s on %s: %v", a.Role, a.Resource, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("Revoked %s on %s.", a.Role, a.Resource))
+		updateRequestMessage(a)
+	}
+	return ephemeralResponse(strings.Join(lines, "\n"))
+}
+
+// cancelCommandController handles `/sudo cancel [request id]`. Without a request id, all of the sender's pending requests are cancelled.
+func cancelCommandController(ctx context.Context, s slack.SlashCommand) ([]byte, error) {
+	canceller, id, err := slacking.ParseCancelCommand(ctx, slackUsers, s)
+	if err != nil {
+		return nil, err
+	}
+	var targets []*types.EscalationApproval
+	if id != "" {
+		a, err := requestStore.Get(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load request: %v", err)
+		}
+		targets = append(targets, a)
+	} else {
+		approvals, err := requestStore.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list requests: %v", err)
+		}
+		for _, a := range approvals {
+			if a.CurrentState() == types.StatePending && string(a.Requestor) == canceller {
+				targets = append(targets, a)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return ephemeralResponse("You don't have any pending requests to cancel.")
+	}
+	var lines []string
+	for _, a := range targets {
+		if err := authz.CancelRequest(a, canceller, googleService); err != nil {
+			lines = append(lines, fmt.Sprintf("Couldn't cancel %s on %s: %v", a.Role, a.Resource, err))
+			continue
+		}
+		if err := requestStore.Update(ctx, a); err != nil {
+			lines = append(lines, fmt.Sprintf("Couldn't cancel %s on %s: %v", a.Role, a.Resource, err))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("Cancelled %s on %s.", a.Role, a.Resource))
+		updateRequestMessage(a)
+	}
+	return ephemeralResponse(strings.Join(lines, "\n"))
+}
+
+// revoke removes the grant and saves the revoked request.
+// The binding is gone by the time the request is saved, so if the request was changed in the meantime the revocation is applied to the stored request instead,
+// and when it can't be saved at all the caller is told rather than the request being left active.
+func revoke(ctx context.Context, a *types.EscalationApproval, revoker string) error {
+	if err := authz.AuthorizeRevocationAndRevokeIAM(ctx, config.Cfg.EscalationPolicy, a, revoker, googleService); err != nil {
+		return fmt.Errorf("couldn't revoke iam: %w", err)
+	}
+	err := requestStore.Update(ctx, a)
+	if errors.Is(err, store.ErrConflict) {
+		var latest *types.EscalationApproval
+		latest, err = requestStore.Get(ctx, a.ID)
+		if err == nil {
+			revoked := a.History[len(a.History)-1]
+			err = latest.TransitionTo(types.StateRevoked, revoked.Actor, revoked.At, revoked.Note)
+		}
+		if err == nil {
+			err = requestStore.Update(ctx, latest)
+		}
+		if err == nil {
+			*a = *latest
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("the binding was removed, but the request couldn't be saved as revoked: %w", err)
+	}
+	return nil
+}
+
+// updateRequestMessage brings the request's original slack message up to date, when it wasn't a click on it that changed the request
+func updateRequestMessage(a *types.EscalationApproval) {
+	if a.Channel == "" || a.MessageTS == "" {
+		return
+	}
+	blocks, err := slacking.GenerateSlackEscalationResponseMessage(a)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't parse escalation request from approval: %v", err)
+		slog.Error(fmt.Sprintf("couldn't generate slack message: %v", err))
+		return
 	}
-	if err := authz.AuthorizeApprovalAndGrantIAM(ctx, config.Cfg.EscalationPolicy, escalationApproval, googleService); err != nil {
-		return nil, fmt.Errorf("couldn't grant iam: %v", err)
+	if _, _, _, err := slackClient.UpdateMessage(a.Channel, a.MessageTS, slack.MsgOptionBlocks(blocks...)); err != nil {
+		slog.Error(fmt.Sprintf("couldn't update slack message for request %s: %v", a.ID, err))
 	}
-	blocks := slacking.GenerateSlackEscalationResponseMessage(escalationApproval)
+}
+
+// replaceOriginalResponse replaces the message that was clicked on, for everyone in the channel
+func replaceOriginalResponse(blocks []slack.Block) ([]byte, error) {
 	msg := slack.NewBlockMessage(blocks...)
 	msg.ResponseType = "in_channel"
 	msg.ReplaceOriginal = true
@@ -165,16 +577,36 @@ func approvalActionController(message slack.InteractionCallback) ([]byte, error)
 	return b, nil
 }
 
+// ephemeralResponse is only shown to the user who clicked, and leaves the original message in place
+func ephemeralResponse(text string) ([]byte, error) {
+	msg := slack.NewBlockMessage(slacking.TextToBlock(text)...)
+	msg.ResponseType = "ephemeral"
+	msg.ReplaceOriginal = false
+	b, err := json.MarshalIndent(msg, "", "    ")
+	if err != nil {
+		return nil, fmt.Errorf("marshalling json: %v", err)
+	}
+	return b, nil
+}
+
 var ErrUnauthorized = errors.New("unauthorized - please double check it's a valid role and resource combination")
 
-func modalSubmissionController(message slack.InteractionCallback, slackClient *slack.Client, googleService *gcp.Service) error {
+func modalSubmissionController(message slack.InteractionCallback, slackUsers *slacking.Users, googleService *gcp.Service) error {
 	slog.Info("modal submission")
 	ctx := context.Background()
-	escalationRequest, err := slacking.ParseEscalationRequestFromModal(slackClient, message)
+	escalationRequest, err := slacking.ParseEscalationRequestFromModal(ctx, slackUsers, message)
 	if err != nil {
-		return fmt.Errorf("couldn't parse slack modal: %v", err)
+		return fmt.Errorf("couldn't parse slack modal: %w", err)
 	}
+	return submitRequest(ctx, escalationRequest)
+}
+
+// submitRequest authorizes a new request or extension, then either grants it straight away or posts it for approval
+func submitRequest(ctx context.Context, escalationRequest *types.EscalationRequest) error {
 	approval, err := authz.AuthorizeRequest(ctx, config.Cfg.EscalationPolicy, escalationRequest, googleService)
+	if errors.Is(err, authz.ErrDurationTooLong) || errors.Is(err, authz.ErrAccountRequirements) {
+		return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
 	if err != nil {
 		return fmt.Errorf("couldn't grant iam: %v", err)
 	}
@@ -182,19 +614,70 @@ func modalSubmissionController(message slack.InteractionCallback, slackClient *s
 		return ErrUnauthorized
 	}
 
-	blocks, err := slacking.GenerateSlackEscalationRequestMessageFromModal(escalationRequest)
-	if err != nil {
-		return fmt.Errorf("couldn't generate modal slack response: %v", err)
-
+	var blocks []slack.Block
+	var posted *types.EscalationApproval
+	if authz.RequestApprovalMode(config.Cfg.EscalationPolicy, escalationRequest) == types.AutoApproval {
+		escalationApproval, err := authz.AutoApproveAndGrantIAM(ctx, config.Cfg.EscalationPolicy, escalationRequest, googleService)
+		if escalationApproval == nil {
+			return fmt.Errorf("couldn't grant iam: %w", err)
+		}
+		if err != nil {
+			// The failure is recorded on the request and shown in the message
+			slog.Error(err.Error())
+		}
+		// Without the stored request the grant couldn't be revoked or reaped, so it's taken back again
+		if err := requestStore.Create(ctx, escalationApproval); err != nil {
+			undoGrant(ctx, escalationApproval)
+			return fmt.Errorf("couldn't save request: %v", err)
+		}
+		markExtended(ctx, escalationApproval)
+		blocks, err = slacking.GenerateSlackAutoApprovalMessage(escalationApproval)
+		if err != nil {
+			return fmt.Errorf("couldn't generate modal slack response: %v", err)
+		}
+		posted = escalationApproval
+	} else {
+		escalationApproval := types.NewEscalationApproval(escalationRequest, gcp.Now(googleService))
+		if err := requestStore.Create(ctx, escalationApproval); err != nil {
+			return fmt.Errorf("couldn't save request: %v", err)
+		}
+		blocks, err = slacking.GenerateSlackEscalationRequestMessage(escalationApproval)
+		if err != nil {
+			return fmt.Errorf("couldn't generate modal slack response: %v", err)
+		}
+		posted = escalationApproval
 	}
 	msg := slack.MsgOptionBlocks(blocks...)
-	_, _, err = slackClient.PostMessage(config.Cfg.SlackChannel, msg)
+	channel, ts, err := slackClient.PostMessage(config.Cfg.SlackChannel, msg)
 	if err != nil {
 		return fmt.Errorf("can't complete modal action: %v", err)
 	}
+	// Remembered so the message can be updated when the request changes outside of slack, e.g. by /sudo revoke
+	posted.Channel, posted.MessageTS = channel, ts
+	if err := requestStore.Update(ctx, posted); err != nil {
+		slog.Error(fmt.Sprintf("couldn't save request %s: %v", posted.ID, err))
+	}
 	return nil
 }
 
+// newRequestStore picks where requests are kept from the config.
+// The memory store loses requests between instances, so it's only used along with the mocked google apis.
+func newRequestStore(ctx context.Context) (store.RequestStore, error) {
+	switch config.Cfg.RequestStore {
+	case "", "memory":
+		if !config.Cfg.MockGoogleAPIs {
+			return nil, fmt.Errorf("REQUEST_STORE has to be file or firestore, the memory store can only be used with MOCK_GOOGLE_APIS")
+		}
+		return store.NewMemoryStore(), nil
+	case "file":
+		return store.NewFileStore(config.Cfg.RequestStorePath), nil
+	case "firestore":
+		return store.NewFirestoreStore(ctx, config.Cfg.FirestoreProject, config.Cfg.FirestoreCollection)
+	default:
+		return nil, fmt.Errorf("unknown REQUEST_STORE: %q", config.Cfg.RequestStore)
+	}
+}
+
 func sendHTTPResponse(w http.ResponseWriter, r *http.Request, responseURL string, b []byte) {
 	req, err := http.NewRequestWithContext(r.Context(), "POST", responseURL, bytes.NewReader(b))
 	if err != nil {
@@ -2,9 +2,13 @@ package gcp
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand"
+	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -14,6 +18,7 @@ import (
 
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/impersonate"
 	"google.golang.org/api/option"
@@ -23,35 +28,114 @@ type ResourceType string
 
 const (
 	Projects      ResourceType = "projects"
+	Folders       ResourceType = "folders"
 	Organizations ResourceType = "organizations"
 )
 
 type Clock interface {
 	now() time.Time
+	// sleep waits for d, or returns early with the context's error if it's cancelled
+	sleep(ctx context.Context, d time.Duration) error
+}
+
+// Now is the current time according to the clock, so callers outside this package use the same one as the grants
+func Now(c Clock) time.Time {
+	return c.now()
 }
 
 type Grouper interface {
-	list(domain, requestor string) (*admin.Groups, error)
+	// list returns one page of the groups a user or group is directly in, starting from "" for the first page
+	list(ctx context.Context, domain, member, pageToken string) (*admin.Groups, error)
 }
 
 type IAMer interface {
 	getIamPolicy(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error)
 	setIamPolicy(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error)
+	// snapshot keeps a copy of the policy as it was read before it's written over, see PolicySnapshotter
+	snapshot(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error
+}
+
+// Hierarchy looks up where a resource sits in the GCP resource hierarchy
+type Hierarchy interface {
+	ancestry(ctx context.Context, resource Resource) ([]Resource, error)
+}
+
+// UserDirectory looks up users' Google Workspace accounts
+type UserDirectory interface {
+	getUser(ctx context.Context, email string) (*admin.User, error)
 }
 
 type Googler interface {
 	IAMer
 	Grouper
+	Hierarchy
+	UserDirectory
 	Clock
 }
 
+// GroupSource is somewhere users' groups are looked up. The Google Directory is used unless the Service is given another,
+// see the groups package for the others and for combining them. maxDepth is how many levels of nested groups to follow, for sources that have them.
+type GroupSource interface {
+	ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error)
+}
+
+type slackUserKey struct{}
+
+type slackUser struct {
+	user   Requestor
+	userID string
+}
+
+// WithSlackUser records the slack user ID of the user whose groups are about to be looked up.
+// Sources that look users up in slack use it, since the google identity may not be the email on their slack account.
+func WithSlackUser(ctx context.Context, user Requestor, userID string) context.Context {
+	return context.WithValue(ctx, slackUserKey{}, slackUser{user, userID})
+}
+
+// SlackUserID returns the slack user ID recorded by WithSlackUser, if it was recorded for this user
+func SlackUserID(ctx context.Context, user Requestor) (string, bool) {
+	u, ok := ctx.Value(slackUserKey{}).(slackUser)
+	if !ok || u.user != user || u.userID == "" {
+		return "", false
+	}
+	return u.userID, true
+}
+
 type Service struct {
 	Googler
+	groups GroupSource
 }
 
 // Useful for tests to pass in a mock googler
 func NewService(g Googler) *Service {
-	return &Service{g}
+	return &Service{Googler: g}
+}
+
+// WithGroupSource returns a copy of the Service that looks up groups from src instead of the Google Directory
+func (s *Service) WithGroupSource(src GroupSource) *Service {
+	return &Service{Googler: s.Googler, groups: src}
+}
+
+// ListGroups looks up a user's groups from the Service's GroupSource
+func (s *Service) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	if s.groups != nil {
+		return s.groups.ListGroups(ctx, user, maxDepth)
+	}
+	return DirectoryGroups(s.Googler, config.Cfg.ValidDomain).ListGroups(ctx, user, maxDepth)
+}
+
+// DirectoryGroups looks up groups from the Google Directory, with the group emails as their names
+func DirectoryGroups(g Grouper, domain string) GroupSource {
+	return &directoryGroups{g, domain}
+}
+
+type directoryGroups struct {
+	groups Grouper
+	domain string
+}
+
+func (d *directoryGroups) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	return ListNestedGoogleGroups(ctx, user, d.domain, maxDepth, d.groups)
 }
 
 func NewGoogleService() (*Service, error) {
@@ -59,13 +143,16 @@ func NewGoogleService() (*Service, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewService(g), nil
+	if config.Cfg.GroupCacheTTL() <= 0 && config.Cfg.GroupCacheMaxStale() <= 0 {
+		return NewService(g), nil
+	}
+	return NewService(NewGroupCache(g, config.Cfg.GroupCacheTTL(), config.Cfg.GroupCacheMaxStale())), nil
 }
 
 // Pass in a Service from NewService() that fulfils the Grouper interface
 func ListGoogleGroups(ctx context.Context, requestor Requestor, domain string, g Grouper) (Groups, error) {
-	groups, err := g.list(string(requestor), domain)
-	if err != nil {
+	groups, err := listAllGroups(ctx, domain, string(requestor), g)
+	if err != nil && !isStaleGroups(err) {
 		slog.Error(fmt.Sprintf("can't retrieve groups from google: %v", err))
 		return nil, err
 	}
@@ -76,7 +163,110 @@ func ListGoogleGroups(ctx context.Context, requestor Requestor, domain string, g
 	for _, g := range groups.Groups {
 		gm[Group(g.Email)] = struct{}{}
 	}
-	return gm, nil
+	return gm, err
+}
+
+// listAllGroups pages through every group a user or group is directly in, so none are missed for someone in a lot of groups.
+// It returns nil if the first page was nil. Pages that came from the cache are kept, and returned with their *StaleGroupsError.
+func listAllGroups(ctx context.Context, domain, member string, g Grouper) (*admin.Groups, error) {
+	var all *admin.Groups
+	var stale error
+	seen := make(map[string]struct{})
+	pageToken := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		page, err := g.list(ctx, domain, member, pageToken)
+		if err != nil && !isStaleGroups(err) {
+			return nil, err
+		}
+		stale = errors.Join(stale, err)
+		if page == nil {
+			return all, stale
+		}
+		if all == nil {
+			all = &admin.Groups{}
+		}
+		all.Groups = append(all.Groups, page.Groups...)
+		if page.NextPageToken == "" {
+			return all, stale
+		}
+		if _, ok := seen[page.NextPageToken]; ok {
+			return nil, fmt.Errorf("listing the groups of %s returned page %q twice", member, page.NextPageToken)
+		}
+		seen[page.NextPageToken] = struct{}{}
+		pageToken = page.NextPageToken
+	}
+}
+
+// ListNestedGoogleGroups returns the groups the requestor is in directly, and the groups those groups are in, up to maxDepth levels above them.
+// Each group is only looked up once, so cycles between groups end. A maxDepth of 0 returns the same groups as ListGoogleGroups.
+// If any of the lookups came from the cache, the groups are returned with every *StaleGroupsError joined together.
+func ListNestedGoogleGroups(ctx context.Context, requestor Requestor, domain string, maxDepth int, g Grouper) (Groups, error) {
+	gm, stale := ListGoogleGroups(ctx, requestor, domain, g)
+	if stale != nil && !isStaleGroups(stale) {
+		return nil, stale
+	}
+	level := make([]string, 0, len(gm))
+	for group := range gm {
+		level = append(level, string(group))
+	}
+	for depth := 1; depth <= maxDepth && len(level) > 0; depth++ {
+		sort.Strings(level)
+		var next []string
+		for _, member := range level {
+			groups, err := listAllGroups(ctx, domain, member, g)
+			if err != nil && !isStaleGroups(err) {
+				slog.Error(fmt.Sprintf("can't retrieve the groups %s is in from google: %v", member, err))
+				return nil, err
+			}
+			stale = errors.Join(stale, err)
+			if groups == nil {
+				continue
+			}
+			for _, parent := range groups.Groups {
+				if _, ok := gm[Group(parent.Email)]; ok {
+					continue
+				}
+				gm[Group(parent.Email)] = struct{}{}
+				next = append(next, parent.Email)
+			}
+		}
+		level = next
+	}
+	if len(level) > 0 {
+		slog.Debug(fmt.Sprintf("stopped following the nested groups of %s at a depth of %d, %v may be in more groups", requestor, maxDepth, level))
+	}
+	return gm, stale
+}
+
+// GetAccount looks up the state of a user's Google Workspace account, for the rules with requirements on it
+// Pass in a Service from NewService() that fulfils the UserDirectory interface
+func GetAccount(ctx context.Context, user Requestor, d UserDirectory) (*Account, error) {
+	u, err := d.getUser(ctx, string(user))
+	if err != nil {
+		slog.Error(fmt.Sprintf("can't retrieve user from google: %v", err))
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("google returned no account for %s", user)
+	}
+	return &Account{Suspended: u.Suspended, Archived: u.Archived, EnrolledIn2SV: u.IsEnrolledIn2Sv}, nil
+}
+
+// ListAncestors returns the folders and organization above a resource, closest first. The resource itself isn't included.
+// Pass in a Service from NewService() that fulfils the Hierarchy interface
+func ListAncestors(ctx context.Context, resource Resource, h Hierarchy) ([]Resource, error) {
+	if _, err := parseResourceType(resource); err != nil {
+		return nil, err
+	}
+	ancestors, err := h.ancestry(ctx, resource)
+	if err != nil {
+		slog.Error(fmt.Sprintf("can't retrieve ancestry from google: %v", err))
+		return nil, err
+	}
+	return ancestors, nil
 }
 
 // Attaches specific iam roles to a given user conditionally.
@@ -85,74 +275,449 @@ func ListGoogleGroups(ctx context.Context, requestor Requestor, domain string, g
 // it is very easy to get the gcp organization into a bad state.
 // Please take a look at the comment in the critical section before making changes
 // Can pass in a Service to satisfy IAMer
+// Binding is idempotent per request, if the request already has an active binding it's reused instead of appending a duplicate.
 func BindIAMPolicy(ctx context.Context, r *EscalationApproval, g Googler) error {
 	slog.Debug("Binding IAM Policy")
 
-	userEmail := []string{fmt.Sprintf("user:%s", r.Requestor)}
+	duration := time.Duration(r.Duration)
+	if duration == 0 {
+		duration = config.Cfg.DefaultGrantDuration()
+	}
 	start := g.now()
-	hoursFromNow := start.Add(time.Duration(config.Cfg.DurationOfGrantInHours) * time.Hour).Format(time.RFC3339)
-	slog.Debug(fmt.Sprintf("Timestamp: %s", hoursFromNow))
-	binding := &cloudresourcemanager.Binding{
+	expiry := start.Add(duration).Format(time.RFC3339)
+	slog.Debug(fmt.Sprintf("Timestamp: %s", expiry))
+	binding := newConditionalBinding(r.Role, r.Requestor, expiry, r.ID)
+	reused := ""
+	err := modifyIamPolicy(ctx, r.Resource, r.ID, g, func(existingPolicy *cloudresourcemanager.Policy) (bool, error) {
+		reused = requestBindingExpiry(existingPolicy, r, g.now())
+		if reused != "" {
+			return false, nil
+		}
+		existingPolicy.Bindings = append(existingPolicy.Bindings, binding)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if reused != "" {
+		slog.Info(fmt.Sprintf("request %s already has a binding on %s until %s, reusing it", r.ID, r.Resource, reused))
+		r.Expiry = reused
+		return nil
+	}
+	// The binding was written, so the expiry is recorded even if it can't be read back yet
+	r.Expiry = expiry
+	return verifyBinding(ctx, r.Resource, binding, g)
+}
+
+// requestBindingExpiry returns the expiry of a binding the bot already made for the request that hasn't expired, or "" if there isn't one.
+// Bindings from before request IDs were recorded never match.
+func requestBindingExpiry(policy *cloudresourcemanager.Policy, r *EscalationApproval, now time.Time) string {
+	if r.ID == "" {
+		return ""
+	}
+	for _, b := range policy.Bindings {
+		bb, ok := parseBotBinding(b)
+		if !ok || bb.requestID != r.ID || bb.role != r.Role || bb.requestor != r.Requestor {
+			continue
+		}
+		if now.Before(bb.expiresAt) {
+			return bb.expiry
+		}
+	}
+	return ""
+}
+
+// RevokeIAMPolicy removes the conditional binding BindIAMPolicy made for the approval before it expires.
+// Only a binding with exactly the role, member, condition title and expression the bot built is removed.
+// Returns whether it was found, it may already have been removed by the reaper.
+func RevokeIAMPolicy(ctx context.Context, r *EscalationApproval, g Googler) (bool, error) {
+	if r.Expiry == "" {
+		return false, fmt.Errorf("the request has no expiry, it was never granted")
+	}
+	want := newConditionalBinding(r.Role, r.Requestor, r.Expiry, r.ID)
+	found := false
+	err := modifyIamPolicy(ctx, r.Resource, r.ID, g, func(existingPolicy *cloudresourcemanager.Policy) (bool, error) {
+		found = false
+		kept := make([]*cloudresourcemanager.Binding, 0, len(existingPolicy.Bindings))
+		for _, b := range existingPolicy.Bindings {
+			if sameBinding(b, want) {
+				slog.Info(fmt.Sprintf("revoking binding on %s: %s for %v, %s", r.Resource, b.Role, b.Members, b.Condition.Title))
+				found = true
+				continue
+			}
+			kept = append(kept, b)
+		}
+		existingPolicy.Bindings = kept
+		return found, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// ExtendIAMPolicy moves the expiry of the binding an extension request extends, instead of appending a second binding.
+// The binding has to still be exactly what the bot built for the grant being extended, and can't have expired yet.
+func ExtendIAMPolicy(ctx context.Context, r *EscalationApproval, g Googler) error {
+	if !r.IsExtension() {
+		return fmt.Errorf("the request doesn't extend a grant")
+	}
+	previous, err := time.Parse(time.RFC3339, r.ExtendsExpiry)
+	if err != nil {
+		return fmt.Errorf("invalid expiry of the grant being extended: %v", err)
+	}
+	if !g.now().Before(previous) {
+		return fmt.Errorf("the grant being extended expired at %s", r.ExtendsExpiry)
+	}
+	extended, err := r.ExtendedExpiry()
+	if err != nil {
+		return err
+	}
+	expiry := extended.Format(time.RFC3339)
+	want := newConditionalBinding(r.Role, r.Requestor, r.ExtendsExpiry, r.ExtensionOf)
+	replacement := newConditionalBinding(r.Role, r.Requestor, expiry, r.ID)
+	written := false
+	err = modifyIamPolicy(ctx, r.Resource, r.ID, g, func(existingPolicy *cloudresourcemanager.Policy) (bool, error) {
+		written = false
+		// Already extended by this request, e.g. a retried approval
+		if requestBindingExpiry(existingPolicy, r, g.now()) == expiry {
+			return false, nil
+		}
+		for _, b := range existingPolicy.Bindings {
+			if sameBinding(b, want) {
+				slog.Info(fmt.Sprintf("extending binding on %s: %s for %v, from %s until %s", r.Resource, b.Role, b.Members, r.ExtendsExpiry, expiry))
+				b.Condition = replacement.Condition
+				written = true
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("the binding for the grant being extended isn't in the policy, it may have been revoked")
+	})
+	if err != nil {
+		return err
+	}
+	r.Expiry = expiry
+	if !written {
+		return nil
+	}
+	return verifyBinding(ctx, r.Resource, replacement, g)
+}
+
+// sameBinding matches on the role, member and condition, the description is left out so bindings from before request IDs were recorded still match
+func sameBinding(b, want *cloudresourcemanager.Binding) bool {
+	if b == nil || b.Condition == nil || b.Role != want.Role || len(b.Members) != 1 || b.Members[0] != want.Members[0] {
+		return false
+	}
+	return b.Condition.Title == want.Condition.Title && b.Condition.Expression == want.Condition.Expression
+}
+
+// RemoveExpiredBindings removes the conditional bindings created by BindIAMPolicy on a resource once they've expired.
+// Bindings that weren't created by the bot are never touched, even if their condition has expired.
+// Returns the number of bindings that were removed.
+func RemoveExpiredBindings(ctx context.Context, resource Resource, g Googler) (int, error) {
+	removed := 0
+	err := modifyIamPolicy(ctx, resource, "", g, func(existingPolicy *cloudresourcemanager.Policy) (bool, error) {
+		// reset on every attempt, a conflicting write means we're looking at a fresh policy
+		removed = 0
+		now := g.now()
+		kept := make([]*cloudresourcemanager.Binding, 0, len(existingPolicy.Bindings))
+		for _, b := range existingPolicy.Bindings {
+			if bb, ok := parseBotBinding(b); ok && !now.Before(bb.expiresAt) {
+				slog.Info(fmt.Sprintf("removing expired binding on %s: %s for %v, %s", resource, b.Role, b.Members, b.Condition.Title))
+				removed++
+				continue
+			}
+			kept = append(kept, b)
+		}
+		existingPolicy.Bindings = kept
+		return removed > 0, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// ReapExpiredBindings runs RemoveExpiredBindings against every resource in the policy rules, and every resource in granted.
+// The policy only lists resources exactly, so granted should have the resources requests were granted on,
+// which covers the descendants of rules with inherit, and resources matched by patterns.
+// A failure on one resource doesn't stop the others from being cleaned up.
+func ReapExpiredBindings(ctx context.Context, p *PolicyRules, granted []Resource, g Googler) (int, error) {
+	_, _, resources := p.ListOptions()
+	for _, rsc := range granted {
+		resources[string(rsc)] = struct{}{}
+	}
+	reap := make([]string, 0, len(resources))
+	for rsc := range resources {
+		reap = append(reap, rsc)
+	}
+	sort.Strings(reap)
+	total := 0
+	var errs []error
+	for _, rsc := range reap {
+		n, err := RemoveExpiredBindings(ctx, Resource(rsc), g)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reaping %s: %v", rsc, err))
+			continue
+		}
+		total += n
+	}
+	return total, errors.Join(errs...)
+}
+
+const conditionExpressionPrefix = "request.time < timestamp(\""
+const conditionExpressionSuffix = "\")"
+
+// Separates the request ID from the rest of the description
+const conditionRequestSeparator = ", request "
+
+// newConditionalBinding is the single place the bot's conditional bindings are built.
+// parseBotBinding relies on this to recognize bindings the bot owns.
+// The request ID is recorded in the description, so a request's binding can be found again. It's left out when there isn't one.
+func newConditionalBinding(role Role, requestor Requestor, expiry, requestID string) *cloudresourcemanager.Binding {
+	description := fmt.Sprintf("Grant %s on %s until %s", role, requestor, expiry)
+	if requestID != "" {
+		description += conditionRequestSeparator + requestID
+	}
+	return &cloudresourcemanager.Binding{
 		// Conditions cannot be set on primitive roles
 		// Error 400: LintValidationUnits/BindingRoleAllowConditionCheck Error: Conditions can't be set on primitive roles
-		Role:    string(r.Role),
-		Members: userEmail,
+		Role:    string(role),
+		Members: []string{fmt.Sprintf("user:%s", requestor)},
 		Condition: &cloudresourcemanager.Expr{
-			Title:       fmt.Sprintf("Until: %s", hoursFromNow),
-			Description: fmt.Sprintf("Grant %s on %s until %s", r.Role, r.Requestor, hoursFromNow),
-			Expression:  fmt.Sprintf("request.time < timestamp(\"%s\")", hoursFromNow),
+			Title:       fmt.Sprintf("Until: %s", expiry),
+			Description: description,
+			Expression:  conditionExpressionPrefix + expiry + conditionExpressionSuffix,
 		},
 	}
+}
+
+// botBinding is what's recorded in a binding the bot made
+type botBinding struct {
+	role      Role
+	requestor Requestor
+	expiry    string
+	expiresAt time.Time
+	// Empty for bindings from before request IDs were recorded
+	requestID string
+}
+
+// parseBotBinding reads a binding if, and only if, it is exactly what newConditionalBinding would have built.
+func parseBotBinding(b *cloudresourcemanager.Binding) (botBinding, bool) {
+	if b == nil || b.Condition == nil || len(b.Members) != 1 {
+		return botBinding{}, false
+	}
+	requestor, ok := strings.CutPrefix(b.Members[0], "user:")
+	if !ok {
+		return botBinding{}, false
+	}
+	expiry, ok := strings.CutPrefix(b.Condition.Expression, conditionExpressionPrefix)
+	if !ok {
+		return botBinding{}, false
+	}
+	expiry, ok = strings.CutSuffix(expiry, conditionExpressionSuffix)
+	if !ok {
+		return botBinding{}, false
+	}
+	t, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return botBinding{}, false
+	}
+	legacy := newConditionalBinding(Role(b.Role), Requestor(requestor), expiry, "")
+	requestID := ""
+	if b.Condition.Description != legacy.Condition.Description {
+		requestID, ok = strings.CutPrefix(b.Condition.Description, legacy.Condition.Description+conditionRequestSeparator)
+		if !ok || requestID == "" {
+			return botBinding{}, false
+		}
+	}
+	want := newConditionalBinding(Role(b.Role), Requestor(requestor), expiry, requestID)
+	if want.Condition.Title != b.Condition.Title || want.Condition.Description != b.Condition.Description || want.Condition.Expression != b.Condition.Expression {
+		return botBinding{}, false
+	}
+	return botBinding{role: Role(b.Role), requestor: Requestor(requestor), expiry: expiry, expiresAt: t, requestID: requestID}, true
+}
+
+// ConflictError is returned when the IAM policy on a resource kept changing while the bot was updating it, and it gave up retrying
+type ConflictError struct {
+	Resource Resource
+	Attempts int
+	// The last conflict, or why the retries stopped early
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("the iam policy on %s kept changing while it was being updated, gave up after %d attempts, please try again: %v", e.Resource, e.Attempts, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// The backoff between attempts doubles from retryBaseDelay up to retryMaxDelay, with jitter so concurrent writers spread out
+const (
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 8 * time.Second
+)
+
+// Swapped out by tests
+var jitter = rand.Int63n
+
+// backoff is how long to wait after the given attempt, a random duration in the upper half of the exponential delay
+func backoff(attempt int) time.Duration {
+	d := retryMaxDelay
+	if attempt < 5 {
+		d = min(retryBaseDelay<<attempt, retryMaxDelay)
+	}
+	return d/2 + time.Duration(jitter(int64(d/2)))
+}
+
+// isConflict reports whether the error is a 409 from the IAM api, which means the policy changed since it was read, and is safe to retry
+func isConflict(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == http.StatusConflict
+}
+
+// modifyIamPolicy does an etag protected read-modify-write of the IAM policy on a resource.
+// modify is handed the freshly read policy and reports whether it changed anything, nothing is written if it didn't.
+// When the policy changes underneath it the whole cycle is retried against the new policy, with backoff,
+// up to the configured number of attempts and deadline. Running out returns a *ConflictError.
+// The policy is snapshotted before every write, under the ID of the request that's changing it if there is one.
+func modifyIamPolicy(ctx context.Context, resource Resource, requestID string, g Googler, modify func(*cloudresourcemanager.Policy) (bool, error)) error {
+	deadline := g.now().Add(config.Cfg.IAMRetryDeadline())
+	attempts := max(config.Cfg.IAMRetryAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := modifyIamPolicyOnce(ctx, resource, requestID, g, modify)
+		if !isConflict(err) {
+			return err
+		}
+		if attempt >= attempts {
+			return &ConflictError{Resource: resource, Attempts: attempt, Err: err}
+		}
+		delay := backoff(attempt - 1)
+		if g.now().Add(delay).After(deadline) {
+			return &ConflictError{Resource: resource, Attempts: attempt, Err: fmt.Errorf("retry deadline of %v reached: %w", config.Cfg.IAMRetryDeadline(), err)}
+		}
+		slog.Warn(fmt.Sprintf("iam policy on %s changed while it was being updated, retrying in %v, attempt %d of %d", resource, delay, attempt, attempts))
+		if err := g.sleep(ctx, delay); err != nil {
+			return &ConflictError{Resource: resource, Attempts: attempt, Err: err}
+		}
+	}
+}
+
+// ErrGrantNotVisible is returned when a binding was written, but still couldn't be read back after retrying.
+// IAM is eventually consistent, so the grant has most likely been made and just hasn't propagated yet.
+var ErrGrantNotVisible = errors.New("granted but not yet visible")
+
+// verifyBinding re-reads the policy after a write until the exact binding, condition and all, shows up in it.
+// The read is retried with backoff while IAM propagates, up to the configured number of attempts.
+func verifyBinding(ctx context.Context, resource Resource, want *cloudresourcemanager.Binding, g Googler) error {
 	getIamPolicyRequest := &cloudresourcemanager.GetIamPolicyRequest{
 		Options: &cloudresourcemanager.GetPolicyOptions{
 			RequestedPolicyVersion: 3,
 		},
 	}
-	//folderService := cloudresourcemanager.NewFoldersService(cloudResourceManagerService)
-	for {
-		existingPolicy, err := g.getIamPolicy(ctx, r.Resource, getIamPolicyRequest)
-		if e, ok := err.(*googleapi.Error); ok {
-			if e.Code == 409 {
-				time.Sleep(5000 * time.Millisecond)
-				continue
-			}
+	attempts := max(config.Cfg.IAMVerifyAttempts, 1)
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		policy, err := g.getIamPolicy(ctx, resource, getIamPolicyRequest)
+		switch {
+		case err != nil:
+			lastErr = fmt.Errorf("failed to retrieve iam policy: %v", err)
+		case policy == nil:
+			lastErr = fmt.Errorf("no existing iam policy was found")
+		case hasExactBinding(policy, want):
+			return nil
+		default:
+			lastErr = fmt.Errorf("the binding isn't in the policy")
 		}
-		if err != nil {
-			return fmt.Errorf("failed to retrieve iam policy: %v", err)
-		}
-
-		// CAUTION!!!
-		// It is important that the existing policy is appeneded to.
-		// If it is not, the new policy will overwrite the existing policy.
-		// This could remove all existing permissions at the gcp org level!
-		if existingPolicy == nil {
-			return fmt.Errorf("no existing iam policy was found")
+		if attempt >= attempts {
+			break
 		}
-		existingPolicy.Bindings = append(existingPolicy.Bindings, binding)
-		// In order to use conditional IAM, must set version to 3
-		// See https://cloud.google.com/iam/docs/policies#versions
-		existingPolicy.Version = 3
-		setIamPolicyRequest := &cloudresourcemanager.SetIamPolicyRequest{
-			Policy: existingPolicy,
-		}
-		_, err = g.setIamPolicy(ctx, r.Resource, setIamPolicyRequest)
-		if e, ok := err.(*googleapi.Error); ok {
-			if e.Code == 409 {
-				time.Sleep(5000 * time.Millisecond)
-				continue
-			}
+		delay := backoff(attempt - 1)
+		slog.Warn(fmt.Sprintf("binding %s for %v on %s isn't visible yet, reading it again in %v, attempt %d of %d: %v", want.Role, want.Members, resource, delay, attempt, attempts, lastErr))
+		if err := g.sleep(ctx, delay); err != nil {
+			lastErr = err
+			break
 		}
-		if err != nil {
-			return fmt.Errorf("failed to set iam policy: %v", err)
+	}
+	return fmt.Errorf("%w: %s for %v on %s after %d reads: %v", ErrGrantNotVisible, want.Role, want.Members, resource, attempts, lastErr)
+}
+
+// hasExactBinding is stricter than sameBinding, the description has to match too
+func hasExactBinding(policy *cloudresourcemanager.Policy, want *cloudresourcemanager.Binding) bool {
+	for _, b := range policy.Bindings {
+		if sameBinding(b, want) && b.Condition.Description == want.Condition.Description {
+			return true
 		}
+	}
+	return false
+}
+
+// modifyIamPolicyOnce is a single read-modify-write, a conflict is returned wrapped so the caller can retry it
+func modifyIamPolicyOnce(ctx context.Context, resource Resource, requestID string, g IAMer, modify func(*cloudresourcemanager.Policy) (bool, error)) error {
+	getIamPolicyRequest := &cloudresourcemanager.GetIamPolicyRequest{
+		Options: &cloudresourcemanager.GetPolicyOptions{
+			RequestedPolicyVersion: 3,
+		},
+	}
+	existingPolicy, err := g.getIamPolicy(ctx, resource, getIamPolicyRequest)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve iam policy: %w", err)
+	}
+
+	// CAUTION!!!
+	// It is important that the existing policy is appeneded to.
+	// If it is not, the new policy will overwrite the existing policy.
+	// This could remove all existing permissions at the gcp org level!
+	// checkPolicyChange refuses any write that drops or changes something the bot doesn't own.
+	if existingPolicy == nil {
+		return fmt.Errorf("no existing iam policy was found")
+	}
+	// Kept aside so modify can't change which version of the policy the write is checked against
+	etag := existingPolicy.Etag
+	// A copy of the policy as it was read, so the write can be checked against it
+	before := &cloudresourcemanager.Policy{}
+	if err := convertPolicy(existingPolicy, before); err != nil {
+		return err
+	}
+	changed, err := modify(existingPolicy)
+	if err != nil {
+		return err
+	}
+	if !changed {
 		return nil
 	}
+	// In order to use conditional IAM, must set version to 3
+	// See https://cloud.google.com/iam/docs/policies#versions
+	existingPolicy.Version = 3
+	// The etag from the read is sent back with the write, so it's rejected with a 409 if anyone changed the policy in between
+	existingPolicy.Etag = etag
+	diff, err := checkPolicyChange(resource, before, existingPolicy)
+	logPolicyDiff(resource, diff, err)
+	if err != nil {
+		return err
+	}
+	// Without a copy of what's being written over there'd be no way back from a bad write, so it's not made
+	if err := g.snapshot(ctx, resource, requestID, before); err != nil {
+		return fmt.Errorf("couldn't snapshot iam policy on %s, not writing it: %w", resource, err)
+	}
+	setIamPolicyRequest := &cloudresourcemanager.SetIamPolicyRequest{
+		Policy: existingPolicy,
+	}
+	if _, err := g.setIamPolicy(ctx, resource, setIamPolicyRequest); err != nil {
+		return fmt.Errorf("failed to set iam policy: %w", err)
+	}
+	return nil
 }
 
 func parseResourceType(resource Resource) (ResourceType, error) {
 	if strings.HasPrefix(string(resource), "projects/") {
 		return Projects, nil
 	}
+	if strings.HasPrefix(string(resource), "folders/") {
+		return Folders, nil
+	}
 	if strings.HasPrefix(string(resource), "organizations/") {
 		return Organizations, nil
 	}
@@ -160,15 +725,20 @@ func parseResourceType(resource Resource) (ResourceType, error) {
 }
 
 type googleService struct {
-	iamClient    *cloudresourcemanager.Service
-	groupsClient *admin.GroupsService
+	iamClient *cloudresourcemanager.Service
+	// Folders aren't in the v1 api, the v3 api is only used for them
+	foldersClient *crmv3.FoldersService
+	groupsClient  *admin.GroupsService
+	usersClient   *admin.UsersService
+	// nil when snapshots are turned off
+	snapshots PolicySnapshotter
 }
 
 func newGoogleService() (*googleService, error) {
 	ctx := context.Background()
 	ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
 		TargetPrincipal: config.Cfg.ServiceAccount,
-		Scopes:          []string{admin.AdminDirectoryGroupReadonlyScope},
+		Scopes:          directoryScopes(),
 		// User must be a GSuite admin.
 		Subject: config.Cfg.GsuiteAdmin,
 	})
@@ -187,16 +757,43 @@ func newGoogleService() (*googleService, error) {
 		return nil, fmt.Errorf("failed to initialize google cloudresourcemanager: %v", err)
 	}
 
-	return &googleService{cloudResourceManagerService, admin.NewGroupsService(srv)}, nil
+	cloudResourceManagerV3Service, err := crmv3.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize google cloudresourcemanager v3: %v", err)
+	}
+
+	snapshots, err := NewPolicySnapshotter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &googleService{cloudResourceManagerService, cloudResourceManagerV3Service.Folders, admin.NewGroupsService(srv), admin.NewUsersService(srv), snapshots}, nil
+}
+
+// directoryScopes only asks for users when a rule checks accounts or aliases are resolved, so the domain-wide delegation doesn't need it otherwise
+func directoryScopes() []string {
+	scopes := []string{admin.AdminDirectoryGroupReadonlyScope}
+	if config.Cfg.EscalationPolicy.ChecksAccounts() || config.Cfg.ResolveEmailAliases {
+		scopes = append(scopes, admin.AdminDirectoryUserReadonlyScope)
+	}
+	return scopes
 }
 
 // googleService is concrete implementation of IAMer and Grouper
 // ListGoogleGroups(g Grouper)
 // BindIAMPolicy(i IAMer)
 
-func (g *googleService) list(domain, requestor string) (*admin.Groups, error) {
-	// return g.groupsClient.List().Domain(domain).UserKey(requestor).Do()
-	return g.groupsClient.List().UserKey(requestor).Do()
+func (g *googleService) list(ctx context.Context, domain, member, pageToken string) (*admin.Groups, error) {
+	// return g.groupsClient.List().Domain(domain).UserKey(member).Do()
+	call := g.groupsClient.List().UserKey(member).MaxResults(200).Context(ctx)
+	if pageToken != "" {
+		call = call.PageToken(pageToken)
+	}
+	return call.Do()
+}
+
+func (g *googleService) getUser(ctx context.Context, email string) (*admin.User, error) {
+	return g.usersClient.Get(email).Context(ctx).Do()
 }
 
 func (g *googleService) getIamPolicy(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
@@ -212,6 +809,20 @@ func (g *googleService) getIamPolicy(ctx context.Context, resource Resource, get
 	case Organizations:
 		gcpResource = string(resource)
 		return g.iamClient.Organizations.GetIamPolicy(gcpResource, getiampolicyrequest).Context(ctx).Do()
+	case Folders:
+		req := &crmv3.GetIamPolicyRequest{}
+		if err := convertPolicy(getiampolicyrequest, req); err != nil {
+			return nil, err
+		}
+		p, err := g.foldersClient.GetIamPolicy(string(resource), req).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		policy := &cloudresourcemanager.Policy{}
+		if err := convertPolicy(p, policy); err != nil {
+			return nil, err
+		}
+		return policy, nil
 	}
 	return nil, fmt.Errorf("unable to get iam policy")
 }
@@ -239,10 +850,107 @@ func (g *googleService) setIamPolicy(ctx context.Context, resource Resource, set
 	case Organizations:
 		gcpResource = string(resource)
 		return g.iamClient.Organizations.SetIamPolicy(gcpResource, setiampolicyrequest).Context(ctx).Do()
+	case Folders:
+		req := &crmv3.SetIamPolicyRequest{}
+		if err := convertPolicy(setiampolicyrequest, req); err != nil {
+			return nil, err
+		}
+		if req.Policy == nil {
+			return nil, fmt.Errorf("no existing policy was found")
+		}
+		p, err := g.foldersClient.SetIamPolicy(string(resource), req).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		policy := &cloudresourcemanager.Policy{}
+		if err := convertPolicy(p, policy); err != nil {
+			return nil, err
+		}
+		return policy, nil
 	}
 	return nil, fmt.Errorf("unable to set iam policy")
 }
 
+// GCP doesn't allow folders to be nested deeper than this
+const maxFolderDepth = 10
+
+func (g *googleService) ancestry(ctx context.Context, resource Resource) ([]Resource, error) {
+	rscType, err := parseResourceType(resource)
+	if err != nil {
+		return nil, err
+	}
+	switch rscType {
+	case Projects:
+		gcpResource := strings.Split(string(resource), "/")[1]
+		resp, err := g.iamClient.Projects.GetAncestry(gcpResource, &cloudresourcemanager.GetAncestryRequest{}).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		var ancestors []Resource
+		for _, a := range resp.Ancestor {
+			if a.ResourceId == nil {
+				continue
+			}
+			switch a.ResourceId.Type {
+			case "folder":
+				ancestors = append(ancestors, Resource(fmt.Sprintf("folders/%s", a.ResourceId.Id)))
+			case "organization":
+				ancestors = append(ancestors, Resource(fmt.Sprintf("organizations/%s", a.ResourceId.Id)))
+			}
+		}
+		return ancestors, nil
+	case Folders:
+		var ancestors []Resource
+		name := string(resource)
+		for i := 0; i <= maxFolderDepth; i++ {
+			folder, err := g.foldersClient.Get(name).Context(ctx).Do()
+			if err != nil {
+				return nil, err
+			}
+			ancestors = append(ancestors, Resource(folder.Parent))
+			if !strings.HasPrefix(folder.Parent, "folders/") {
+				return ancestors, nil
+			}
+			name = folder.Parent
+		}
+		return nil, fmt.Errorf("folder hierarchy above %s is deeper than %d", resource, maxFolderDepth)
+	case Organizations:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unable to get ancestry")
+}
+
+// convertPolicy copies a policy or policy request between the v1 and v3 cloudresourcemanager apis.
+// The types are identical on the wire, so a json round trip is lossless.
+func convertPolicy(from, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return fmt.Errorf("converting iam policy: %v", err)
+	}
+	if err := json.Unmarshal(b, to); err != nil {
+		return fmt.Errorf("converting iam policy: %v", err)
+	}
+	return nil
+}
+
+func (g *googleService) snapshot(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error {
+	if g.snapshots == nil {
+		return nil
+	}
+	return g.snapshots.Snapshot(ctx, resource, requestID, policy)
+}
+
 func (g *googleService) now() time.Time {
 	return time.Now()
 }
+
+func (g *googleService) sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -2,6 +2,9 @@ package gcp
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	. "github.com/seslattery/gcpsudobot/types"
@@ -11,13 +14,23 @@ import (
 )
 
 type MockGoogler struct {
-	ListF         func(domain, requestor string) (*admin.Groups, error)
+	ListF func(domain, requestor string) (*admin.Groups, error)
+	// Optional, for paging through groups. ListF is used when it isn't set, and returns every group on the first page
+	ListPageF     func(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error)
 	GetIamPolicyF func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error)
 	SetIamPolicyF func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error)
+	AncestryF     func(ctx context.Context, resource Resource) ([]Resource, error)
+	GetUserF      func(ctx context.Context, email string) (*admin.User, error)
 	NowF          func() time.Time
+	SleepF        func(ctx context.Context, d time.Duration) error
+	// Optional, snapshots aren't kept if it isn't set
+	SnapshotF func(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error
 }
 
-func (m *MockGoogler) list(domain, requestor string) (*admin.Groups, error) {
+func (m *MockGoogler) list(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error) {
+	if m.ListPageF != nil {
+		return m.ListPageF(ctx, domain, requestor, pageToken)
+	}
 	return m.ListF(domain, requestor)
 }
 func (m *MockGoogler) getIamPolicy(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
@@ -26,13 +39,64 @@ func (m *MockGoogler) getIamPolicy(ctx context.Context, resource Resource, getia
 func (m *MockGoogler) setIamPolicy(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
 	return m.SetIamPolicyF(ctx, resource, setiampolicyrequest)
 }
+func (m *MockGoogler) snapshot(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error {
+	if m.SnapshotF == nil {
+		return nil
+	}
+	return m.SnapshotF(ctx, resource, requestID, policy)
+}
+func (m *MockGoogler) ancestry(ctx context.Context, resource Resource) ([]Resource, error) {
+	return m.AncestryF(ctx, resource)
+}
+func (m *MockGoogler) getUser(ctx context.Context, email string) (*admin.User, error) {
+	return m.GetUserF(ctx, email)
+}
 func (m *MockGoogler) now() time.Time {
 	return m.NowF()
 }
+func (m *MockGoogler) sleep(ctx context.Context, d time.Duration) error {
+	return m.SleepF(ctx, d)
+}
+
+// MockGroupMemberships lists the groups each user or group is directly in, for nesting groups in a mock's ListF
+func MockGroupMemberships(memberships map[string][]string) func(domain, requestor string) (*admin.Groups, error) {
+	return func(domain, requestor string) (*admin.Groups, error) {
+		groups := &admin.Groups{}
+		for _, email := range memberships[requestor] {
+			groups.Groups = append(groups.Groups, &admin.Group{Email: email})
+		}
+		return groups, nil
+	}
+}
+
+// MockGroupPages splits the groups a user is in across pages, for a mock's ListPageF
+func MockGroupPages(pages ...[]string) func(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error) {
+	return func(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error) {
+		i := 0
+		if pageToken != "" {
+			if _, err := fmt.Sscanf(pageToken, "page-%d", &i); err != nil || i <= 0 || i >= len(pages) {
+				return nil, fmt.Errorf("invalid page token %q", pageToken)
+			}
+		}
+		groups := &admin.Groups{}
+		for _, email := range pages[i] {
+			groups.Groups = append(groups.Groups, &admin.Group{Email: email})
+		}
+		if i+1 < len(pages) {
+			groups.NextPageToken = fmt.Sprintf("page-%d", i+1)
+		}
+		return groups, nil
+	}
+}
 
 func NewMockGoogler() *MockGoogler {
+	// Each resource's policy is what was last written to it, so a grant can be read back after it's made
+	var mu sync.Mutex
+	policies := make(map[Resource]*cloudresourcemanager.Policy)
 	return &MockGoogler{
 		NowF: func() time.Time { return time.Now() },
+		// The mock doesn't wait between retries
+		SleepF: func(ctx context.Context, d time.Duration) error { return ctx.Err() },
 		ListF: func(domain, requestor string) (*admin.Groups, error) {
 			return &admin.Groups{Groups: []*admin.Group{
 				{Email: "prod-db-access@gmail.com"},
@@ -40,6 +104,12 @@ func NewMockGoogler() *MockGoogler {
 			}}, nil
 		},
 		GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if written, ok := policies[resource]; ok {
+				policy := &cloudresourcemanager.Policy{}
+				return policy, convertPolicy(written, policy)
+			}
 			return &cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{
 				{
 					Members: []string{"user:bob@gmail.com", "user:foo@gmail.com", "user:bar@gmail.com", "user:baz@gmail.com"},
@@ -48,7 +118,24 @@ func NewMockGoogler() *MockGoogler {
 			}}, nil
 		},
 		SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			policy := &cloudresourcemanager.Policy{}
+			if err := convertPolicy(setiampolicyrequest.Policy, policy); err != nil {
+				return nil, err
+			}
+			policies[resource] = policy
 			return nil, nil
 		},
+		// Everything lives directly under the test organization
+		AncestryF: func(ctx context.Context, resource Resource) ([]Resource, error) {
+			if strings.HasPrefix(string(resource), "organizations/") {
+				return nil, nil
+			}
+			return []Resource{"organizations/0000000000"}, nil
+		},
+		GetUserF: func(ctx context.Context, email string) (*admin.User, error) {
+			return &admin.User{PrimaryEmail: email, IsEnrolledIn2Sv: true}, nil
+		},
 	}
 }
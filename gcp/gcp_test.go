@@ -2,6 +2,7 @@ package gcp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
 	"time"
@@ -12,6 +13,8 @@ import (
 	"github.com/google/go-cmp/cmp"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/cloudresourcemanager/v1"
+	crmv3 "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/googleapi"
 )
 
 var CurrentTime = time.Date(2024, 04, 28, 00, 00, 00, 0, time.UTC)
@@ -49,13 +52,38 @@ func TestListGoogleGroups(t *testing.T) {
 			map[Group]struct{}{"test1@gmail.com": {}, "test2@gmail.com": {}},
 			false,
 		},
+		{
+			"groups across pages",
+			&MockGoogler{ListPageF: MockGroupPages([]string{"test1@gmail.com"}, []string{}, []string{"test3@gmail.com", "test4@gmail.com"})},
+			map[Group]struct{}{"test1@gmail.com": {}, "test3@gmail.com": {}, "test4@gmail.com": {}},
+			false,
+		},
+		{
+			"error on a later page",
+			&MockGoogler{ListPageF: func(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error) {
+				if pageToken == "" {
+					return &admin.Groups{Groups: []*admin.Group{{Email: "test1@gmail.com"}}, NextPageToken: "page-1"}, nil
+				}
+				return nil, fmt.Errorf("can't reach google")
+			}},
+			nil,
+			true,
+		},
+		{
+			"same page returned again",
+			&MockGoogler{ListPageF: func(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error) {
+				return &admin.Groups{Groups: []*admin.Group{{Email: "test1@gmail.com"}}, NextPageToken: "page-1"}, nil
+			}},
+			nil,
+			true,
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
 			ctx := context.Background()
-			got, err := ListGoogleGroups(ctx, "example.com", "sean.slattery203@gmail.com", tt.mock)
+			got, err := ListGoogleGroups(ctx, "sean.slattery203@gmail.com", "example.com", tt.mock)
 			if err != nil {
 				if !tt.wantError {
 					t.Errorf("unexpected error: %v", err)
@@ -68,6 +96,74 @@ func TestListGoogleGroups(t *testing.T) {
 	}
 }
 
+func TestListGoogleGroupsCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pages := 0
+	list := MockGroupPages([]string{"test1@gmail.com"}, []string{"test2@gmail.com"}, []string{"test3@gmail.com"})
+	mock := &MockGoogler{ListPageF: func(ctx context.Context, domain, requestor, pageToken string) (*admin.Groups, error) {
+		pages++
+		// The deadline passes while the first page is being read
+		cancel()
+		return list(ctx, domain, requestor, pageToken)
+	}}
+	if _, err := ListGoogleGroups(ctx, "bob@gmail.com", "gmail.com", mock); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+	if pages != 1 {
+		t.Errorf("got %d pages read, want 1", pages)
+	}
+}
+
+func TestListNestedGoogleGroups(t *testing.T) {
+	memberships := map[string][]string{
+		"user@gmail.com":        {"sre@example.io", "eng@example.io"},
+		"sre@example.io":        {"on-call@example.io"},
+		"on-call@example.io":    {"responders@example.io"},
+		"responders@example.io": {"everyone@example.io"},
+		// A cycle back to a group that's already been found
+		"everyone@example.io": {"sre@example.io"},
+	}
+	groups := func(emails ...string) Groups {
+		g := Groups{}
+		for _, e := range emails {
+			g[Group(e)] = struct{}{}
+		}
+		return g
+	}
+	tests := []struct {
+		name      string
+		maxDepth  int
+		listErr   string
+		want      Groups
+		wantError bool
+	}{
+		{"direct groups only", 0, "", groups("sre@example.io", "eng@example.io"), false},
+		{"one level", 1, "", groups("sre@example.io", "eng@example.io", "on-call@example.io"), false},
+		{"stops at the depth limit", 2, "", groups("sre@example.io", "eng@example.io", "on-call@example.io", "responders@example.io"), false},
+		{"cycles end", 10, "", groups("sre@example.io", "eng@example.io", "on-call@example.io", "responders@example.io", "everyone@example.io"), false},
+		{"error on a nested group", 3, "on-call@example.io", nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			list := MockGroupMemberships(memberships)
+			mock := &MockGoogler{ListF: func(domain, requestor string) (*admin.Groups, error) {
+				if requestor == tt.listErr {
+					return nil, fmt.Errorf("can't reach google")
+				}
+				return list(domain, requestor)
+			}}
+			got, err := ListNestedGoogleGroups(context.Background(), "user@gmail.com", "gmail.com", tt.maxDepth, mock)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
 func TestBindIAMPolicy(t *testing.T) {
 
 	tests := []struct {
@@ -87,11 +183,11 @@ func TestBindIAMPolicy(t *testing.T) {
 					return nil, nil
 				}},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: Requestor("test@example.com"),
 				},
-				"default",
-				Denied,
+				Approver: "default",
+				Status:   Denied,
 			},
 			true,
 		},
@@ -136,12 +232,12 @@ func TestBindIAMPolicy(t *testing.T) {
 					return nil, nil
 				}},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: Requestor("bob@gmail.com"),
 					Role:      "roles/editor",
 				},
-				"default",
-				Denied,
+				Approver: "default",
+				Status:   Denied,
 			},
 			false,
 		},
@@ -194,12 +290,12 @@ func TestBindIAMPolicy(t *testing.T) {
 					return nil, nil
 				}},
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: Requestor("foo@gmail.com"),
 					Role:      "roles/owner2",
 				},
-				"default",
-				Denied,
+				Approver: "default",
+				Status:   Denied,
 			},
 			false,
 		},
@@ -208,17 +304,420 @@ func TestBindIAMPolicy(t *testing.T) {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.Background()
-			err := BindIAMPolicy(ctx, tt.ea, tt.mock)
+			err := BindIAMPolicy(ctx, tt.ea, readsBackWrites(tt.mock))
+			if !tt.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantError && err == nil {
+				t.Errorf("expected error not found")
+			}
+		})
+	}
+}
+
+func TestBindIAMPolicyDuration(t *testing.T) {
+	t.Run("uses the requested duration and records the expiry", func(t *testing.T) {
+		expiry := CurrentTime.Add(45 * time.Minute).Format(time.RFC3339)
+		var got *cloudresourcemanager.Binding
+		mock := &MockGoogler{
+			NowF: func() time.Time { return CurrentTime },
+			GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				return &cloudresourcemanager.Policy{}, nil
+			},
+			SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				got = setiampolicyrequest.Policy.Bindings[0]
+				return nil, nil
+			},
+		}
+		ea := &EscalationApproval{
+			EscalationRequest: &EscalationRequest{
+				Requestor: "bob@gmail.com",
+				Role:      "roles/editor",
+				Resource:  "projects/testing",
+				Duration:  Duration(45 * time.Minute),
+			},
+			Approver: "approver@gmail.com",
+			Status:   Approved,
+		}
+		if err := BindIAMPolicy(context.Background(), ea, readsBackWrites(mock)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(got, newConditionalBinding("roles/editor", "bob@gmail.com", expiry, "")); diff != "" {
+			t.Errorf("diff: %v", diff)
+		}
+		if ea.Expiry != expiry {
+			t.Errorf("got expiry %v, want %v", ea.Expiry, expiry)
+		}
+	})
+}
+
+func TestBindIAMPolicyIdempotent(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	expiry := CurrentTime.Add(time.Duration(config.Cfg.DurationOfGrantInHours) * time.Hour).Format(time.RFC3339)
+	earlier := CurrentTime.Add(30 * time.Minute).Format(time.RFC3339)
+	expired := CurrentTime.Add(-time.Minute).Format(time.RFC3339)
+	tests := []struct {
+		name       string
+		existing   []*cloudresourcemanager.Binding
+		wantWrite  bool
+		wantExpiry string
+	}{
+		{"first approval", nil, true, expiry},
+		{"request already has a binding", []*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", earlier, id)}, false, earlier},
+		{"request's binding has expired", []*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", expired, id)}, true, expiry},
+		{"another request's binding", []*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", earlier, "fedcba9876543210fedcba9876543210")}, true, expiry},
+		{"binding from before request ids", []*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", earlier, "")}, true, expiry},
+		{"same request id for another role", []*cloudresourcemanager.Binding{newConditionalBinding("roles/viewer", "bob@gmail.com", earlier, id)}, true, expiry},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			written := false
+			mock := &MockGoogler{
+				NowF: func() time.Time { return CurrentTime },
+				GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					return &cloudresourcemanager.Policy{Bindings: append([]*cloudresourcemanager.Binding{}, tt.existing...)}, nil
+				},
+				SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					written = true
+					got := setiampolicyrequest.Policy.Bindings[len(setiampolicyrequest.Policy.Bindings)-1]
+					if diff := cmp.Diff(got, newConditionalBinding("roles/editor", "bob@gmail.com", expiry, id)); diff != "" {
+						return nil, fmt.Errorf("testing. unexpected diff: %v", diff)
+					}
+					return nil, nil
+				},
+			}
+			ea := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{ID: id, Requestor: "bob@gmail.com", Role: "roles/editor", Resource: "projects/testing"},
+			}
+			if err := BindIAMPolicy(context.Background(), ea, readsBackWrites(mock)); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if written != tt.wantWrite {
+				t.Errorf("got written %v, want %v", written, tt.wantWrite)
+			}
+			if ea.Expiry != tt.wantExpiry {
+				t.Errorf("got expiry %v, want %v", ea.Expiry, tt.wantExpiry)
+			}
+		})
+	}
+}
+
+func TestBindIAMPolicyVerifies(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name string
+		// The policy the reads after the write return in turn, nil is an error, the last one repeats
+		reads          []*cloudresourcemanager.Binding
+		readErrs       []bool
+		wantReads      int
+		wantSleeps     []time.Duration
+		wantNotVisible bool
+	}{
+		{"visible straight away", []*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, id)}, []bool{false}, 1, nil, false},
+		{
+			"visible once propagated",
+			[]*cloudresourcemanager.Binding{nil, nil, newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, id)},
+			[]bool{false, true, false},
+			3, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond}, false,
+		},
+		{"never visible", []*cloudresourcemanager.Binding{nil}, []bool{false}, 5, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second}, true},
+		{
+			"another request's binding",
+			[]*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, "fedcba9876543210fedcba9876543210")},
+			[]bool{false},
+			5, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second}, true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			origJitter := jitter
+			defer func() { jitter = origJitter }()
+			jitter = func(n int64) int64 { return 0 }
+
+			written := false
+			reads := 0
+			var sleeps []time.Duration
+			mock := &MockGoogler{
+				NowF: func() time.Time { return CurrentTime },
+				SleepF: func(ctx context.Context, d time.Duration) error {
+					sleeps = append(sleeps, d)
+					return nil
+				},
+				GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					if !written {
+						return &cloudresourcemanager.Policy{}, nil
+					}
+					reads++
+					i := min(reads, len(tt.reads)) - 1
+					if tt.readErrs[i] {
+						return nil, fmt.Errorf("testing. iam is unavailable")
+					}
+					policy := &cloudresourcemanager.Policy{}
+					if tt.reads[i] != nil {
+						policy.Bindings = []*cloudresourcemanager.Binding{tt.reads[i]}
+					}
+					return policy, nil
+				},
+				SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					written = true
+					return nil, nil
+				},
+			}
+			ea := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{ID: id, Requestor: "bob@gmail.com", Role: "roles/editor", Resource: "projects/testing"},
+			}
+			err := BindIAMPolicy(context.Background(), ea, mock)
+			if errors.Is(err, ErrGrantNotVisible) != tt.wantNotVisible {
+				t.Fatalf("got %v, want ErrGrantNotVisible: %v", err, tt.wantNotVisible)
+			}
+			if !tt.wantNotVisible && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// The binding was written either way, so its expiry is kept
+			if ea.Expiry != ExpiryTime {
+				t.Errorf("got expiry %v, want %v", ea.Expiry, ExpiryTime)
+			}
+			if reads != tt.wantReads {
+				t.Errorf("got %d reads after the write, want %d", reads, tt.wantReads)
+			}
+			if diff := cmp.Diff(sleeps, tt.wantSleeps); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestRemoveExpiredBindings(t *testing.T) {
+	expired := CurrentTime.Add(-time.Minute).Format(time.RFC3339)
+	active := CurrentTime.Add(time.Hour).Format(time.RFC3339)
+	owner := &cloudresourcemanager.Binding{
+		Members: []string{"user:bob@gmail.com", "user:foo@gmail.com"},
+		Role:    "roles/owner",
+	}
+	// An expired condition that someone other than the bot set up, this must be left alone
+	foreign := &cloudresourcemanager.Binding{
+		Members: []string{"user:foo@gmail.com"},
+		Role:    "roles/editor",
+		Condition: &cloudresourcemanager.Expr{
+			Title:      "temporary access",
+			Expression: fmt.Sprintf(`request.time < timestamp("%s")`, expired),
+		},
+	}
+	// Looks like a bot binding but has been edited to include a second member
+	edited := newConditionalBinding("roles/viewer", "bob@gmail.com", expired, "")
+	edited.Members = append(edited.Members, "user:foo@gmail.com")
+
+	tests := []struct {
+		name        string
+		policy      *cloudresourcemanager.Policy
+		want        []*cloudresourcemanager.Binding
+		wantRemoved int
+		wantError   bool
+	}{
+		{
+			"removes only expired bot bindings",
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{
+				owner,
+				newConditionalBinding("roles/editor", "bob@gmail.com", expired, ""),
+				foreign,
+				newConditionalBinding("roles/editor", "foo@gmail.com", active, ""),
+				edited,
+			}},
+			[]*cloudresourcemanager.Binding{
+				owner,
+				foreign,
+				newConditionalBinding("roles/editor", "foo@gmail.com", active, ""),
+				edited,
+			},
+			1,
+			false,
+		},
+		{
+			"removes expired bindings with a request id",
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{
+				owner,
+				newConditionalBinding("roles/editor", "bob@gmail.com", expired, "0123456789abcdef0123456789abcdef"),
+				newConditionalBinding("roles/editor", "foo@gmail.com", active, "0123456789abcdef0123456789abcdef"),
+			}},
+			[]*cloudresourcemanager.Binding{
+				owner,
+				newConditionalBinding("roles/editor", "foo@gmail.com", active, "0123456789abcdef0123456789abcdef"),
+			},
+			1,
+			false,
+		},
+		{
+			"expires exactly now",
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{
+				owner,
+				newConditionalBinding("roles/editor", "bob@gmail.com", CurrentTime.Format(time.RFC3339), ""),
+			}},
+			[]*cloudresourcemanager.Binding{owner},
+			1,
+			false,
+		},
+		{
+			"nothing expired doesn't write",
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{
+				owner,
+				foreign,
+				newConditionalBinding("roles/editor", "foo@gmail.com", active, ""),
+			}},
+			nil,
+			0,
+			false,
+		},
+		{
+			"no policy found",
+			nil,
+			nil,
+			0,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := &MockGoogler{
+				NowF: func() time.Time { return CurrentTime },
+				GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					return tt.policy, nil
+				},
+				SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					if tt.want == nil {
+						return nil, fmt.Errorf("testing. unexpected write")
+					}
+					want := &cloudresourcemanager.SetIamPolicyRequest{Policy: &cloudresourcemanager.Policy{
+						Etag:     "etag-1",
+						Version:  3,
+						Bindings: tt.want,
+					}}
+					if diff := cmp.Diff(setiampolicyrequest, want); diff != "" {
+						return nil, fmt.Errorf("testing. unexpected diff: %v", diff)
+					}
+					return nil, nil
+				},
+			}
+			removed, err := RemoveExpiredBindings(ctx, "projects/testing", mock)
+			if !tt.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantError && err == nil {
+				t.Errorf("expected error not found")
+			}
+			if removed != tt.wantRemoved {
+				t.Errorf("got %d removed, want %d", removed, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestReapExpiredBindings(t *testing.T) {
+	expired := CurrentTime.Add(-time.Minute).Format(time.RFC3339)
+	p := &PolicyRules{PolicyRules: []Rule{{
+		Roles:     map[Role]struct{}{"roles/editor": {}},
+		Resources: map[Resource]struct{}{"folders/1111111111": {}},
+		Inherit:   true,
+	}, {
+		Roles:     map[Role]struct{}{"roles/editor": {}},
+		Resources: map[Resource]struct{}{"projects/prod-*": {}},
+	}}}
+	reaped := make(map[Resource]int)
+	mock := &MockGoogler{
+		NowF:   func() time.Time { return CurrentTime },
+		SleepF: func(ctx context.Context, d time.Duration) error { return nil },
+		GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+			if resource == "projects/broken" {
+				return nil, fmt.Errorf("testing. no policy")
+			}
+			return &cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{
+				newConditionalBinding("roles/editor", "bob@gmail.com", expired, ""),
+			}}, nil
+		},
+		SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+			reaped[resource]++
+			return nil, nil
+		},
+	}
+	// A project beneath the folder, granted through inherit, one matched by a pattern, and the folder itself recorded on a request as well.
+	// The pattern itself isn't a resource, so it's never reaped.
+	granted := []Resource{"projects/beneath-folder", "projects/prod-db", "folders/1111111111", "projects/broken"}
+	removed, err := ReapExpiredBindings(context.Background(), p, granted, mock)
+	if err == nil {
+		t.Errorf("expected error not found")
+	}
+	if removed != 3 {
+		t.Errorf("got %d removed, want 3", removed)
+	}
+	want := map[Resource]int{"folders/1111111111": 1, "projects/beneath-folder": 1, "projects/prod-db": 1}
+	if diff := cmp.Diff(reaped, want); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
+
+func TestParseResourceType(t *testing.T) {
+	tests := []struct {
+		name      string
+		resource  Resource
+		want      ResourceType
+		wantError bool
+	}{
+		{"project", "projects/testing", Projects, false},
+		{"folder", "folders/1234", Folders, false},
+		{"organization", "organizations/0000000000", Organizations, false},
+		{"unknown", "billingAccounts/1234", "", true},
+		{"missing slash", "folders", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseResourceType(tt.resource)
 			if !tt.wantError && err != nil {
 				t.Errorf("unexpected error: %v", err)
 			}
 			if tt.wantError && err == nil {
 				t.Errorf("expected error not found")
 			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
 		})
 	}
 }
 
+func TestConvertPolicy(t *testing.T) {
+	t.Run("round trips through the folders api types", func(t *testing.T) {
+		want := &cloudresourcemanager.Policy{
+			Etag:    "etag-1",
+			Version: 3,
+			Bindings: []*cloudresourcemanager.Binding{
+				{
+					Members: []string{"user:bob@gmail.com"},
+					Role:    "roles/owner",
+				},
+				newConditionalBinding("roles/editor", "foo@gmail.com", ExpiryTime, ""),
+			},
+			AuditConfigs: []*cloudresourcemanager.AuditConfig{
+				{Service: "allServices", AuditLogConfigs: []*cloudresourcemanager.AuditLogConfig{{LogType: "DATA_READ"}}},
+			},
+		}
+		v3 := &crmv3.Policy{}
+		if err := convertPolicy(want, v3); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := &cloudresourcemanager.Policy{}
+		if err := convertPolicy(v3, got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("diff: %v", diff)
+		}
+	})
+}
+
 // TODO: Setup ADC test credentials for CI
 //func TestGetIamPolicy(t *testing.T) {
 //	t.Run("invalid resource type", func(t *testing.T) {
@@ -251,3 +750,314 @@ func TestBindIAMPolicy(t *testing.T) {
 //		}
 //	})
 //}
+
+func TestRevokeIAMPolicy(t *testing.T) {
+	expiry := CurrentTime.Add(time.Hour).Format(time.RFC3339)
+	granted := newConditionalBinding("roles/editor", "bob@gmail.com", expiry, "")
+	// Same role and member, but from a different grant
+	otherGrant := newConditionalBinding("roles/editor", "bob@gmail.com", CurrentTime.Add(2*time.Hour).Format(time.RFC3339), "")
+	unconditional := &cloudresourcemanager.Binding{
+		Members: []string{"user:bob@gmail.com"},
+		Role:    "roles/editor",
+	}
+	tests := []struct {
+		name      string
+		expiry    string
+		policy    *cloudresourcemanager.Policy
+		want      []*cloudresourcemanager.Binding
+		wantFound bool
+		wantError bool
+	}{
+		{
+			"removes exactly the granted binding",
+			expiry,
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{unconditional, granted, otherGrant}},
+			[]*cloudresourcemanager.Binding{unconditional, otherGrant},
+			true,
+			false,
+		},
+		{
+			"already removed doesn't write",
+			expiry,
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{unconditional, otherGrant}},
+			nil,
+			false,
+			false,
+		},
+		{
+			"never granted",
+			"",
+			&cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{granted}},
+			nil,
+			false,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			mock := &MockGoogler{
+				NowF: func() time.Time { return CurrentTime },
+				GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					return tt.policy, nil
+				},
+				SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					if tt.want == nil {
+						return nil, fmt.Errorf("testing. unexpected write")
+					}
+					want := &cloudresourcemanager.SetIamPolicyRequest{Policy: &cloudresourcemanager.Policy{
+						Etag:     "etag-1",
+						Version:  3,
+						Bindings: tt.want,
+					}}
+					if diff := cmp.Diff(setiampolicyrequest, want); diff != "" {
+						return nil, fmt.Errorf("testing. unexpected diff: %v", diff)
+					}
+					return nil, nil
+				},
+			}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{Requestor: "bob@gmail.com", Role: "roles/editor", Resource: "projects/testing"},
+				Expiry:            tt.expiry,
+			}
+			found, err := RevokeIAMPolicy(ctx, a, mock)
+			if !tt.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantError && err == nil {
+				t.Errorf("expected error not found")
+			}
+			if found != tt.wantFound {
+				t.Errorf("got found %v, want %v", found, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestExtendIAMPolicy(t *testing.T) {
+	expiry := CurrentTime.Add(time.Hour).Format(time.RFC3339)
+	extended := CurrentTime.Add(3 * time.Hour).Format(time.RFC3339)
+	granted := newConditionalBinding("roles/editor", "bob@gmail.com", expiry, "")
+	otherUser := newConditionalBinding("roles/editor", "alice@gmail.com", expiry, "")
+	tests := []struct {
+		name          string
+		extendsExpiry string
+		policy        []*cloudresourcemanager.Binding
+		want          []*cloudresourcemanager.Binding
+		wantError     bool
+	}{
+		{
+			"replaces the expiry in place",
+			expiry,
+			[]*cloudresourcemanager.Binding{otherUser, granted},
+			[]*cloudresourcemanager.Binding{otherUser, newConditionalBinding("roles/editor", "bob@gmail.com", extended, "")},
+			false,
+		},
+		{
+			"binding was revoked",
+			expiry,
+			[]*cloudresourcemanager.Binding{otherUser},
+			nil,
+			true,
+		},
+		{
+			"grant already expired",
+			CurrentTime.Format(time.RFC3339),
+			[]*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", CurrentTime.Format(time.RFC3339), "")},
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			written := false
+			mock := &MockGoogler{
+				NowF: func() time.Time { return CurrentTime },
+				GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					// A fresh copy each time, so the extension can't change what the test compares against
+					bindings := make([]*cloudresourcemanager.Binding, 0, len(tt.policy))
+					for _, b := range tt.policy {
+						c := *b
+						bindings = append(bindings, &c)
+					}
+					return &cloudresourcemanager.Policy{Etag: "etag-1", Bindings: bindings}, nil
+				},
+				SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					written = true
+					if diff := cmp.Diff(setiampolicyrequest.Policy.Bindings, tt.want); diff != "" {
+						return nil, fmt.Errorf("testing. unexpected diff: %v", diff)
+					}
+					return nil, nil
+				},
+			}
+			a := &EscalationApproval{
+				EscalationRequest: &EscalationRequest{
+					Requestor:     "bob@gmail.com",
+					Role:          "roles/editor",
+					Resource:      "projects/testing",
+					Duration:      Duration(2 * time.Hour),
+					ExtensionOf:   "0123456789abcdef0123456789abcdef",
+					ExtendsExpiry: tt.extendsExpiry,
+				},
+			}
+			err := ExtendIAMPolicy(ctx, a, readsBackWrites(mock))
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("expected error not found")
+				}
+				if written {
+					t.Errorf("the policy shouldn't be written")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if a.Expiry != extended {
+				t.Errorf("got expiry %s, want %s", a.Expiry, extended)
+			}
+		})
+	}
+}
+
+func TestModifyIamPolicyRetries(t *testing.T) {
+	conflict := &googleapi.Error{Code: 409, Message: "there were concurrent policy changes"}
+	tests := []struct {
+		name string
+		// The result of each write in turn, the last one repeats
+		writes       []error
+		deadline     int
+		cancel       bool
+		wantWrites   int
+		wantSleeps   []time.Duration
+		wantConflict bool
+		wantError    bool
+	}{
+		{"no conflict", []error{nil}, 60, false, 1, nil, false, false},
+		{"succeeds after conflicts", []error{conflict, conflict, nil}, 60, false, 3, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond}, false, false},
+		{"runs out of attempts", []error{conflict}, 60, false, 5, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second}, true, true},
+		{"reaches the deadline", []error{conflict}, 1, false, 3, []time.Duration{250 * time.Millisecond, 500 * time.Millisecond}, true, true},
+		{"cancelled while waiting", []error{conflict}, 60, true, 1, []time.Duration{250 * time.Millisecond}, true, true},
+		{"other errors aren't retried", []error{&googleapi.Error{Code: 403, Message: "permission denied"}}, 60, false, 1, nil, false, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			origDeadline, origJitter := config.Cfg.IAMRetryDeadlineInSeconds, jitter
+			defer func() { config.Cfg.IAMRetryDeadlineInSeconds, jitter = origDeadline, origJitter }()
+			config.Cfg.IAMRetryDeadlineInSeconds = tt.deadline
+			jitter = func(n int64) int64 { return 0 }
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			now := CurrentTime
+			reads, writes := 0, 0
+			var sleeps []time.Duration
+			mock := &MockGoogler{
+				NowF: func() time.Time { return now },
+				SleepF: func(ctx context.Context, d time.Duration) error {
+					sleeps = append(sleeps, d)
+					now = now.Add(d)
+					if tt.cancel {
+						cancel()
+					}
+					return ctx.Err()
+				},
+				GetIamPolicyF: func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					reads++
+					return &cloudresourcemanager.Policy{Etag: fmt.Sprintf("etag-%d", reads)}, nil
+				},
+				SetIamPolicyF: func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+					writes++
+					// Every write is checked against the policy it read
+					if setiampolicyrequest.Policy.Etag != fmt.Sprintf("etag-%d", reads) {
+						return nil, fmt.Errorf("testing. got etag %s, want etag-%d", setiampolicyrequest.Policy.Etag, reads)
+					}
+					return nil, tt.writes[min(writes, len(tt.writes))-1]
+				},
+			}
+			err := modifyIamPolicy(ctx, "projects/testing", "", mock, func(p *cloudresourcemanager.Policy) (bool, error) {
+				// Even if modify loses the etag, the write still sends the one that was read
+				p.Etag = ""
+				p.Bindings = append(p.Bindings, newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, ""))
+				return true, nil
+			})
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			var conflictErr *ConflictError
+			if errors.As(err, &conflictErr) != tt.wantConflict {
+				t.Errorf("got %v, want a ConflictError: %v", err, tt.wantConflict)
+			}
+			if writes != tt.wantWrites {
+				t.Errorf("got %d writes, want %d", writes, tt.wantWrites)
+			}
+			if diff := cmp.Diff(sleeps, tt.wantSleeps); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := min(retryBaseDelay<<attempt, retryMaxDelay)
+		for i := 0; i < 100; i++ {
+			if got := backoff(attempt); got < d/2 || got >= d {
+				t.Fatalf("attempt %d got %v, want between %v and %v", attempt, got, d/2, d)
+			}
+		}
+	}
+}
+
+// readsBackWrites makes reads return the last policy that was written, as IAM does once a write has propagated
+func readsBackWrites(m *MockGoogler) *MockGoogler {
+	get, set := m.GetIamPolicyF, m.SetIamPolicyF
+	var written *cloudresourcemanager.Policy
+	m.GetIamPolicyF = func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+		if written != nil {
+			return written, nil
+		}
+		return get(ctx, resource, getiampolicyrequest)
+	}
+	m.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+		p, err := set(ctx, resource, setiampolicyrequest)
+		if err == nil {
+			written = setiampolicyrequest.Policy
+		}
+		return p, err
+	}
+	return m
+}
+
+func TestGetAccount(t *testing.T) {
+	tests := []struct {
+		name      string
+		user      *admin.User
+		err       error
+		want      *Account
+		wantError bool
+	}{
+		{"healthy", &admin.User{IsEnrolledIn2Sv: true}, nil, &Account{EnrolledIn2SV: true}, false},
+		{"suspended and archived", &admin.User{Suspended: true, Archived: true}, nil, &Account{Suspended: true, Archived: true}, false},
+		{"can't reach google", nil, fmt.Errorf("can't reach google"), nil, true},
+		{"no account", nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			mock := &MockGoogler{GetUserF: func(ctx context.Context, email string) (*admin.User, error) { return tt.user, tt.err }}
+			got, err := GetAccount(context.Background(), "bob@gmail.com", mock)
+			if (err != nil) != tt.wantError {
+				t.Errorf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// StaleGroupsError is returned along with cached groups when the directory couldn't be reached to refresh them.
+// The groups can still be used, but the error should be recorded so the audit shows they were stale.
+type StaleGroupsError struct {
+	Member   string
+	CachedAt time.Time
+	Err      error
+}
+
+func (e *StaleGroupsError) Error() string {
+	return fmt.Sprintf("used the groups of %s cached at %s, the directory couldn't be reached: %v", e.Member, e.CachedAt.UTC().Format(time.RFC3339), e.Err)
+}
+
+func (e *StaleGroupsError) Unwrap() error {
+	return e.Err
+}
+
+// StaleGroups returns every *StaleGroupsError in an error from ListNestedGoogleGroups, which joins them together
+func StaleGroups(err error) []*StaleGroupsError {
+	switch e := err.(type) {
+	case *StaleGroupsError:
+		return []*StaleGroupsError{e}
+	case interface{ Unwrap() []error }:
+		var all []*StaleGroupsError
+		for _, err := range e.Unwrap() {
+			all = append(all, StaleGroups(err)...)
+		}
+		return all
+	}
+	return nil
+}
+
+// isStaleGroups reports whether err is the groups having come from the cache, rather than a lookup that failed
+func isStaleGroups(err error) bool {
+	var stale *StaleGroupsError
+	return errors.As(err, &stale)
+}
+
+type cachedGroups struct {
+	groups    *admin.Groups
+	fetchedAt time.Time
+}
+
+// groupCache is a Googler whose group lookups are cached, every other call goes straight through
+type groupCache struct {
+	Googler
+	ttl      time.Duration
+	maxStale time.Duration
+	mu       sync.Mutex
+	entries  map[string]cachedGroups
+}
+
+// NewGroupCache caches every group a user or group is in for ttl. When the directory can't be reached, groups up to maxStale old
+// are used instead, with a *StaleGroupsError. Nothing older than maxStale is ever used, so someone removed from a group longer ago
+// than that can't keep access through the cache. A maxStale shorter than the ttl is raised to it.
+func NewGroupCache(g Googler, ttl, maxStale time.Duration) Googler {
+	return &groupCache{Googler: g, ttl: ttl, maxStale: max(maxStale, ttl), entries: make(map[string]cachedGroups)}
+}
+
+// list returns every group on the first page, so what's cached is always a complete set
+func (c *groupCache) list(ctx context.Context, domain, member, pageToken string) (*admin.Groups, error) {
+	if pageToken != "" {
+		return nil, fmt.Errorf("the group cache returns every group on the first page, got a request for page %q", pageToken)
+	}
+	key := domain + "/" + member
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Sub(entry.fetchedAt) < c.ttl {
+		return entry.groups, nil
+	}
+	groups, err := listAllGroups(ctx, domain, member, c.Googler)
+	if err == nil {
+		c.store(key, cachedGroups{groups: groups, fetchedAt: now})
+		return groups, nil
+	}
+	// The directory answering with a 4xx, e.g. the user was deleted or access was taken away, is an answer, so the cache is dropped
+	if !directoryUnavailable(err) {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return nil, err
+	}
+	// A done context is the caller giving up, not the directory being down
+	if ctx.Err() != nil || !ok || now.Sub(entry.fetchedAt) >= c.maxStale {
+		return nil, err
+	}
+	return entry.groups, &StaleGroupsError{Member: member, CachedAt: entry.fetchedAt, Err: err}
+}
+
+// directoryUnavailable reports whether the lookup failed because the directory couldn't be reached or had a 5xx, which the cache can cover for.
+// Any other response from the directory is returned as it is.
+func directoryUnavailable(err error) bool {
+	var e *googleapi.Error
+	if errors.As(err, &e) {
+		return e.Code >= http.StatusInternalServerError
+	}
+	return true
+}
+
+// store saves a lookup and drops the entries that are too old to ever be used again
+func (c *groupCache) store(key string, entry cachedGroups) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if entry.fetchedAt.Sub(e.fetchedAt) >= c.maxStale {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
@@ -0,0 +1,177 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	. "github.com/seslattery/gcpsudobot/types"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestGroupCache(t *testing.T) {
+	errDown := fmt.Errorf("can't reach google")
+	errUnavailable := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	errNotFound := &googleapi.Error{Code: http.StatusNotFound}
+	errForbidden := &googleapi.Error{Code: http.StatusForbidden}
+	type lookup struct {
+		// How long after the first lookup this one is made, and what the directory returns if it's asked
+		after     time.Duration
+		directory []string
+		// What the directory fails with, if it does
+		down      error
+		want      Groups
+		wantCalls int
+		wantStale bool
+		wantError bool
+	}
+	tests := []struct {
+		name    string
+		lookups []lookup
+	}{
+		{
+			"cached for the ttl",
+			[]lookup{
+				{0, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{59 * time.Second, []string{"b@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{time.Minute, []string{"b@gmail.com"}, nil, Groups{"b@gmail.com": {}}, 2, false, false},
+			},
+		},
+		{
+			"stale while the directory is down",
+			[]lookup{
+				{0, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{5 * time.Minute, nil, errDown, Groups{"a@gmail.com": {}}, 2, true, false},
+				{10 * time.Minute, []string{"b@gmail.com"}, nil, Groups{"b@gmail.com": {}}, 3, false, false},
+			},
+		},
+		{
+			"too stale to use",
+			[]lookup{
+				{0, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{14 * time.Minute, nil, errDown, Groups{"a@gmail.com": {}}, 2, true, false},
+				{15 * time.Minute, nil, errDown, nil, 3, false, true},
+			},
+		},
+		{
+			"removal is seen as soon as the directory answers",
+			[]lookup{
+				{0, []string{"a@gmail.com", "prod@gmail.com"}, nil, Groups{"a@gmail.com": {}, "prod@gmail.com": {}}, 1, false, false},
+				{2 * time.Minute, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 2, false, false},
+				{4 * time.Minute, nil, errDown, Groups{"a@gmail.com": {}}, 3, true, false},
+			},
+		},
+		{
+			"stale while the directory returns 5xx",
+			[]lookup{
+				{0, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{5 * time.Minute, nil, errUnavailable, Groups{"a@gmail.com": {}}, 2, true, false},
+			},
+		},
+		{
+			"deleted user isn't served from the cache",
+			[]lookup{
+				{0, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{5 * time.Minute, nil, errNotFound, nil, 2, false, true},
+				// Nothing is left cached to fall back on either
+				{6 * time.Minute, nil, errDown, nil, 3, false, true},
+			},
+		},
+		{
+			"forbidden isn't served from the cache",
+			[]lookup{
+				{0, []string{"a@gmail.com"}, nil, Groups{"a@gmail.com": {}}, 1, false, false},
+				{5 * time.Minute, nil, errForbidden, nil, 2, false, true},
+			},
+		},
+		{
+			"nothing cached to fall back on",
+			[]lookup{
+				{0, nil, errDown, nil, 1, false, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var current lookup
+			now := start
+			calls := 0
+			mock := &MockGoogler{
+				NowF: func() time.Time { return now },
+				ListF: func(domain, requestor string) (*admin.Groups, error) {
+					calls++
+					if current.down != nil {
+						return nil, current.down
+					}
+					return MockGroupMemberships(map[string][]string{requestor: current.directory})(domain, requestor)
+				},
+			}
+			cache := NewGroupCache(mock, time.Minute, 15*time.Minute)
+			for i, l := range tt.lookups {
+				current = l
+				now = start.Add(l.after)
+				got, err := ListGoogleGroups(context.Background(), "bob@gmail.com", "gmail.com", cache)
+				var stale *StaleGroupsError
+				if errors.As(err, &stale) != l.wantStale {
+					t.Errorf("lookup %d: got %v, want stale %v", i, err, l.wantStale)
+				}
+				if (err != nil && stale == nil) != l.wantError {
+					t.Errorf("lookup %d: got %v, want error %v", i, err, l.wantError)
+				}
+				if diff := cmp.Diff(got, l.want); diff != "" {
+					t.Errorf("lookup %d diff: %v", i, diff)
+				}
+				if calls != l.wantCalls {
+					t.Errorf("lookup %d: got %d directory calls, want %d", i, calls, l.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupCacheNestedStale(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	down := false
+	list := MockGroupMemberships(map[string][]string{
+		"bob@gmail.com":  {"team@gmail.com"},
+		"team@gmail.com": {"eng@gmail.com"},
+	})
+	mock := &MockGoogler{
+		NowF: func() time.Time { return now },
+		ListF: func(domain, requestor string) (*admin.Groups, error) {
+			if down {
+				return nil, fmt.Errorf("can't reach google")
+			}
+			return list(domain, requestor)
+		},
+	}
+	cache := NewGroupCache(mock, time.Minute, 15*time.Minute)
+	cachedAt := now
+	if _, err := ListNestedGoogleGroups(context.Background(), "bob@gmail.com", "gmail.com", 1, cache); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now = now.Add(5 * time.Minute)
+	down = true
+	got, err := ListNestedGoogleGroups(context.Background(), "bob@gmail.com", "gmail.com", 1, cache)
+	if diff := cmp.Diff(got, Groups{"team@gmail.com": {}, "eng@gmail.com": {}}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	var members []string
+	for _, s := range StaleGroups(err) {
+		members = append(members, s.Member)
+		if !s.CachedAt.Equal(cachedAt) {
+			t.Errorf("got %s cached at %v, want %v", s.Member, s.CachedAt, cachedAt)
+		}
+	}
+	if diff := cmp.Diff(members, []string{"bob@gmail.com", "team@gmail.com"}); diff != "" {
+		t.Errorf("stale diff: %v", diff)
+	}
+}
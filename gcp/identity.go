@@ -0,0 +1,64 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+)
+
+// IdentityResolver maps the email on someone's slack account to the google identity they're authorized and granted roles as.
+// An email in the mapping is replaced by what it maps to. Otherwise, when there's a directory to look aliases up in,
+// an alias or secondary domain email is replaced by the primary email of its Workspace user. Anything else is used as it is.
+type IdentityResolver struct {
+	// By lowercased slack email
+	mapping map[string]string
+	// nil doesn't resolve aliases
+	directory UserDirectory
+}
+
+// NewIdentityResolver checks the mapping from slack emails to google identities, d can be nil to not look up aliases
+func NewIdentityResolver(mapping map[string]string, d UserDirectory) (*IdentityResolver, error) {
+	i := &IdentityResolver{mapping: make(map[string]string, len(mapping)), directory: d}
+	for from, to := range mapping {
+		key := strings.ToLower(strings.TrimSpace(from))
+		if !strings.Contains(key, "@") || !strings.Contains(to, "@") || strings.ContainsAny(to, ": ") {
+			return nil, fmt.Errorf("invalid identity mapping from %q to %q, both have to be emails", from, to)
+		}
+		if _, ok := i.mapping[key]; ok {
+			return nil, fmt.Errorf("identity mapping has %s more than once", key)
+		}
+		i.mapping[key] = to
+	}
+	return i, nil
+}
+
+// Resolve returns the google identity for a slack email
+func (i *IdentityResolver) Resolve(ctx context.Context, email string) (string, error) {
+	if to, ok := i.mapping[strings.ToLower(strings.TrimSpace(email))]; ok {
+		return to, nil
+	}
+	if i.directory == nil {
+		return email, nil
+	}
+	u, err := i.directory.getUser(ctx, email)
+	// Not a Workspace user, e.g. a google account outside the domain, which the domain check decides on
+	var e *googleapi.Error
+	if errors.As(err, &e) && e.Code == http.StatusNotFound {
+		return email, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("can't look up %s in the google directory: %v", email, err)
+	}
+	if u == nil || u.PrimaryEmail == "" {
+		return email, nil
+	}
+	if !strings.EqualFold(u.PrimaryEmail, email) {
+		slog.Info(fmt.Sprintf("resolved %s to its primary email %s", email, u.PrimaryEmail))
+	}
+	return u.PrimaryEmail, nil
+}
@@ -0,0 +1,69 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIdentityResolver(t *testing.T) {
+	directory := &MockGoogler{GetUserF: func(ctx context.Context, email string) (*admin.User, error) {
+		switch email {
+		case "alice@gmail.com", "alice.smith@gmail.com", "alice@corp.gmail.com":
+			return &admin.User{PrimaryEmail: "alice@gmail.com"}, nil
+		case "broken@gmail.com":
+			return nil, fmt.Errorf("can't reach google")
+		}
+		return nil, &googleapi.Error{Code: http.StatusNotFound}
+	}}
+	mapping := map[string]string{"Contractor@Vendor.com": "contractor.ext@gmail.com"}
+	tests := []struct {
+		name      string
+		directory UserDirectory
+		email     string
+		want      string
+		wantError bool
+	}{
+		{"mapped", directory, "contractor@vendor.com", "contractor.ext@gmail.com", false},
+		{"mapped without aliases", nil, "CONTRACTOR@vendor.com", "contractor.ext@gmail.com", false},
+		{"alias", directory, "alice.smith@gmail.com", "alice@gmail.com", false},
+		{"secondary domain", directory, "alice@corp.gmail.com", "alice@gmail.com", false},
+		{"primary email", directory, "alice@gmail.com", "alice@gmail.com", false},
+		{"aliases not resolved", nil, "alice.smith@gmail.com", "alice.smith@gmail.com", false},
+		{"not in the directory", directory, "someone@example.com", "someone@example.com", false},
+		{"directory can't be reached", directory, "broken@gmail.com", "", true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			i, err := NewIdentityResolver(mapping, tt.directory)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := i.Resolve(context.Background(), tt.email)
+			if (err != nil) != tt.wantError {
+				t.Errorf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewIdentityResolverInvalid(t *testing.T) {
+	for _, mapping := range []map[string]string{
+		{"contractor": "contractor.ext@gmail.com"},
+		{"contractor@vendor.com": "serviceAccount:bot@gmail.com"},
+		{"contractor@vendor.com": "a@gmail.com", "Contractor@vendor.com": "b@gmail.com"},
+	} {
+		if _, err := NewIdentityResolver(mapping, nil); err == nil {
+			t.Errorf("got no error for %v", mapping)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package gcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+)
+
+// ErrUnsafePolicyChange is returned instead of writing a policy that would change something the bot doesn't own
+var ErrUnsafePolicyChange = errors.New("refusing to write iam policy")
+
+// BindingChange is how a binding shows up in the diff that's logged for every write
+type BindingChange struct {
+	Role      string   `json:"role"`
+	Members   []string `json:"members"`
+	Condition string   `json:"condition,omitempty"`
+	BotOwned  bool     `json:"bot_owned"`
+}
+
+// PolicyDiff is the bindings a write adds and removes, a changed binding shows up as both
+type PolicyDiff struct {
+	Added               []BindingChange `json:"added"`
+	Removed             []BindingChange `json:"removed"`
+	AuditConfigsChanged bool            `json:"audit_configs_changed,omitempty"`
+}
+
+func (d PolicyDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && !d.AuditConfigsChanged
+}
+
+// diffPolicies matches up the bindings in two policies, ignoring their order and the order of their members
+func diffPolicies(before, after *cloudresourcemanager.Policy) PolicyDiff {
+	var diff PolicyDiff
+	remaining := make(map[string]int)
+	for _, b := range before.Bindings {
+		remaining[bindingKey(b)]++
+	}
+	for _, b := range after.Bindings {
+		key := bindingKey(b)
+		if remaining[key] > 0 {
+			remaining[key]--
+			continue
+		}
+		diff.Added = append(diff.Added, newBindingChange(b))
+	}
+	for _, b := range before.Bindings {
+		key := bindingKey(b)
+		if remaining[key] == 0 {
+			continue
+		}
+		remaining[key]--
+		diff.Removed = append(diff.Removed, newBindingChange(b))
+	}
+	diff.AuditConfigsChanged = !sameJSON(before.AuditConfigs, after.AuditConfigs)
+	return diff
+}
+
+// checkPolicyChange compares the policy as it was read with the policy that's about to be written.
+// The bot only ever adds its own bindings, and removes or replaces them to revoke, extend or reap a grant.
+// Any other binding, member, condition or audit config that would be added, removed or changed is refused.
+func checkPolicyChange(resource Resource, before, after *cloudresourcemanager.Policy) (PolicyDiff, error) {
+	diff := diffPolicies(before, after)
+	var problems []string
+	for _, c := range diff.Added {
+		if !c.BotOwned {
+			problems = append(problems, fmt.Sprintf("%s for %v would be added or changed", c.Role, c.Members))
+		}
+	}
+	for _, c := range diff.Removed {
+		if !c.BotOwned {
+			problems = append(problems, fmt.Sprintf("%s for %v would be removed or changed", c.Role, c.Members))
+		}
+	}
+	if diff.AuditConfigsChanged {
+		problems = append(problems, "the audit configs would be changed")
+	}
+	if len(problems) > 0 {
+		return diff, fmt.Errorf("%w on %s: %s", ErrUnsafePolicyChange, resource, strings.Join(problems, ", "))
+	}
+	return diff, nil
+}
+
+// logPolicyDiff records what a write changes, or would have changed when it was refused
+func logPolicyDiff(resource Resource, diff PolicyDiff, err error) {
+	if err != nil {
+		slog.Error("iam policy write refused", slog.String("resource", string(resource)), slog.Any("diff", diff), slog.String("error", err.Error()))
+		return
+	}
+	slog.Info("iam policy write", slog.String("resource", string(resource)), slog.Any("diff", diff))
+}
+
+func newBindingChange(b *cloudresourcemanager.Binding) BindingChange {
+	c := BindingChange{Role: b.Role, Members: b.Members}
+	if b.Condition != nil {
+		c.Condition = b.Condition.Title
+	}
+	c.BotOwned = isBotOwned(b)
+	return c
+}
+
+// isBotOwned reports whether a binding has the member, title and expression BindIAMPolicy builds.
+// Like sameBinding it ignores the description, which the bot only uses to record the request.
+func isBotOwned(b *cloudresourcemanager.Binding) bool {
+	if b == nil || b.Condition == nil || len(b.Members) != 1 {
+		return false
+	}
+	requestor, _ := strings.CutPrefix(b.Members[0], "user:")
+	expiry := strings.TrimSuffix(strings.TrimPrefix(b.Condition.Expression, conditionExpressionPrefix), conditionExpressionSuffix)
+	condition := *b.Condition
+	condition.Description = newConditionalBinding(Role(b.Role), Requestor(requestor), expiry, "").Condition.Description
+	normalized := *b
+	normalized.Condition = &condition
+	_, ok := parseBotBinding(&normalized)
+	return ok
+}
+
+// bindingKey identifies a binding by everything in it, the order of its members doesn't matter
+func bindingKey(b *cloudresourcemanager.Binding) string {
+	members := append([]string{}, b.Members...)
+	sort.Strings(members)
+	key := struct {
+		Role      string
+		Members   []string
+		Condition *cloudresourcemanager.Expr
+	}{b.Role, members, b.Condition}
+	encoded, err := json.Marshal(key)
+	if err != nil {
+		// Can't happen for these types, but a binding that can't be compared is never treated as unchanged
+		return fmt.Sprintf("%p", b)
+	}
+	return string(encoded)
+}
+
+func sameJSON(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(x) == string(y)
+}
@@ -0,0 +1,171 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/cloudresourcemanager/v1"
+)
+
+func TestCheckPolicyChange(t *testing.T) {
+	owners := func() *cloudresourcemanager.Binding {
+		return &cloudresourcemanager.Binding{Role: "roles/owner", Members: []string{"user:bob@gmail.com", "user:foo@gmail.com"}}
+	}
+	conditional := func() *cloudresourcemanager.Binding {
+		return &cloudresourcemanager.Binding{
+			Role:      "roles/viewer",
+			Members:   []string{"group:contractors@gmail.com"},
+			Condition: &cloudresourcemanager.Expr{Title: "business hours", Expression: "request.time.getHours(\"UTC\") < 18"},
+		}
+	}
+	grant := func() *cloudresourcemanager.Binding {
+		return newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, "1234")
+	}
+	auditConfigs := func() []*cloudresourcemanager.AuditConfig {
+		return []*cloudresourcemanager.AuditConfig{{Service: "allServices", AuditLogConfigs: []*cloudresourcemanager.AuditLogConfig{{LogType: "DATA_READ"}}}}
+	}
+	tests := []struct {
+		name        string
+		before      *cloudresourcemanager.Policy
+		modify      func(p *cloudresourcemanager.Policy)
+		wantAdded   int
+		wantRemoved int
+		wantError   bool
+	}{
+		{
+			"adding a grant",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners(), conditional()}},
+			func(p *cloudresourcemanager.Policy) { p.Bindings = append(p.Bindings, grant()) },
+			1, 0, false,
+		},
+		{
+			"revoking a grant",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners(), grant()}},
+			func(p *cloudresourcemanager.Policy) { p.Bindings = p.Bindings[:1] },
+			0, 1, false,
+		},
+		{
+			"revoking a grant without a description",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners(), func() *cloudresourcemanager.Binding {
+				b := grant()
+				b.Condition.Description = ""
+				return b
+			}()}},
+			func(p *cloudresourcemanager.Policy) { p.Bindings = p.Bindings[:1] },
+			0, 1, false,
+		},
+		{
+			"extending a grant",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners(), grant()}},
+			func(p *cloudresourcemanager.Policy) {
+				p.Bindings[1].Condition = newConditionalBinding("roles/editor", "bob@gmail.com", CurrentTime.Add(48*time.Hour).Format(time.RFC3339), "5678").Condition
+			},
+			1, 1, false,
+		},
+		{
+			"reordering bindings and members",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners(), conditional()}},
+			func(p *cloudresourcemanager.Policy) {
+				p.Bindings[0], p.Bindings[1] = p.Bindings[1], p.Bindings[0]
+				p.Bindings[1].Members = []string{"user:foo@gmail.com", "user:bob@gmail.com"}
+			},
+			0, 0, false,
+		},
+		{
+			"wiping the policy",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners(), conditional(), grant()}},
+			func(p *cloudresourcemanager.Policy) { p.Bindings = nil },
+			0, 3, true,
+		},
+		{
+			"removing a member",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners()}},
+			func(p *cloudresourcemanager.Policy) { p.Bindings[0].Members = p.Bindings[0].Members[:1] },
+			1, 1, true,
+		},
+		{
+			"adding a member",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners()}},
+			func(p *cloudresourcemanager.Policy) {
+				p.Bindings[0].Members = append(p.Bindings[0].Members, "user:baz@gmail.com")
+			},
+			1, 1, true,
+		},
+		{
+			"changing a condition the bot doesn't own",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{conditional()}},
+			func(p *cloudresourcemanager.Policy) { p.Bindings[0].Condition.Expression = "true" },
+			1, 1, true,
+		},
+		{
+			"adding a binding the bot doesn't own",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners()}},
+			func(p *cloudresourcemanager.Policy) {
+				p.Bindings = append(p.Bindings, &cloudresourcemanager.Binding{Role: "roles/owner", Members: []string{"user:mallory@gmail.com"}})
+			},
+			1, 0, true,
+		},
+		{
+			"removing the audit configs",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners()}, AuditConfigs: auditConfigs()},
+			func(p *cloudresourcemanager.Policy) { p.AuditConfigs = nil },
+			0, 0, true,
+		},
+		{
+			"changing the audit configs",
+			&cloudresourcemanager.Policy{Bindings: []*cloudresourcemanager.Binding{owners()}, AuditConfigs: auditConfigs()},
+			func(p *cloudresourcemanager.Policy) {
+				p.AuditConfigs[0].AuditLogConfigs[0].ExemptedMembers = []string{"user:bob@gmail.com"}
+			},
+			0, 0, true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			after := &cloudresourcemanager.Policy{}
+			if err := convertPolicy(tt.before, after); err != nil {
+				t.Fatal(err)
+			}
+			tt.modify(after)
+			diff, err := checkPolicyChange("projects/testing", tt.before, after)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if err != nil && !errors.Is(err, ErrUnsafePolicyChange) {
+				t.Errorf("got %v, want ErrUnsafePolicyChange", err)
+			}
+			if len(diff.Added) != tt.wantAdded || len(diff.Removed) != tt.wantRemoved {
+				t.Errorf("got %d added and %d removed, want %d and %d", len(diff.Added), len(diff.Removed), tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestModifyIamPolicyRefusesUnsafeChanges(t *testing.T) {
+	mock := NewMockGoogler()
+	mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+		t.Fatalf("testing. an unsafe policy was written: %v", setiampolicyrequest.Policy.Bindings)
+		return nil, nil
+	}
+	err := modifyIamPolicy(context.Background(), "organizations/0000000000", "1234", mock, func(p *cloudresourcemanager.Policy) (bool, error) {
+		// The bug the checker guards against, a policy that only has the new binding in it
+		p.Bindings = []*cloudresourcemanager.Binding{newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, "1234")}
+		return true, nil
+	})
+	if !errors.Is(err, ErrUnsafePolicyChange) {
+		t.Fatalf("got %v, want ErrUnsafePolicyChange", err)
+	}
+	var conflictErr *ConflictError
+	if errors.As(err, &conflictErr) {
+		t.Errorf("got %v, unsafe changes shouldn't be retried", err)
+	}
+	if diff := cmp.Diff(err.Error(), "refusing to write iam policy on organizations/0000000000: roles/owner for [user:bob@gmail.com user:foo@gmail.com user:bar@gmail.com user:baz@gmail.com] would be removed or changed"); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
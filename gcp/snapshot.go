@@ -0,0 +1,269 @@
+package gcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/seslattery/gcpsudobot/config"
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+var ErrSnapshotNotFound = errors.New("policy snapshot not found")
+
+// snapshotTimeFormat sorts in the order the snapshots were taken, and is safe to use in file and object names
+const snapshotTimeFormat = "20060102T150405.000000000Z"
+
+// PolicySnapshot is a copy of the IAM policy on a resource as the bot read it, before it wrote a change
+type PolicySnapshot struct {
+	Resource  Resource                     `json:"resource"`
+	RequestID string                       `json:"request_id,omitempty"`
+	TakenAt   time.Time                    `json:"taken_at"`
+	Policy    *cloudresourcemanager.Policy `json:"policy"`
+}
+
+// PolicySnapshotter keeps a copy of every IAM policy before the bot writes over it, so a bad write can be undone with cmd/restore.
+// Snapshots are named <resource>/<time taken>-<request id>.json.
+type PolicySnapshotter interface {
+	Snapshot(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error
+	// List returns the names of the snapshots of a resource, oldest first
+	List(ctx context.Context, resource Resource) ([]string, error)
+	Load(ctx context.Context, name string) (*PolicySnapshot, error)
+}
+
+// NewPolicySnapshotter picks where snapshots are kept from the config, it returns nil if they're turned off
+func NewPolicySnapshotter(ctx context.Context) (PolicySnapshotter, error) {
+	switch config.Cfg.PolicySnapshots {
+	case "none":
+		return nil, nil
+	case "local":
+		return NewLocalSnapshotter(config.Cfg.PolicySnapshotPath), nil
+	case "gcs":
+		return NewGCSSnapshotter(ctx, config.Cfg.PolicySnapshotBucket, config.Cfg.PolicySnapshotEndpoint)
+	default:
+		return nil, fmt.Errorf("unknown POLICY_SNAPSHOTS: %q", config.Cfg.PolicySnapshots)
+	}
+}
+
+func newPolicySnapshot(resource Resource, requestID string, policy *cloudresourcemanager.Policy, now time.Time) (string, []byte, error) {
+	name := path.Join(string(resource), now.UTC().Format(snapshotTimeFormat))
+	if requestID != "" {
+		name += "-" + requestID
+	}
+	name += ".json"
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return "", nil, fmt.Errorf("invalid resource for a policy snapshot: %s", resource)
+	}
+	b, err := json.MarshalIndent(&PolicySnapshot{Resource: resource, RequestID: requestID, TakenAt: now.UTC(), Policy: policy}, "", "  ")
+	if err != nil {
+		return "", nil, fmt.Errorf("can't marshal policy snapshot: %v", err)
+	}
+	return name, b, nil
+}
+
+func decodePolicySnapshot(name string, b []byte) (*PolicySnapshot, error) {
+	var s *PolicySnapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, fmt.Errorf("can't unmarshal policy snapshot %s: %v", name, err)
+	}
+	if s == nil || s.Policy == nil {
+		return nil, fmt.Errorf("policy snapshot %s has no policy", name)
+	}
+	return s, nil
+}
+
+// LocalSnapshotter keeps snapshots as files in a directory, e.g. when running cmd/main.go locally
+type LocalSnapshotter struct {
+	dir string
+	now func() time.Time
+}
+
+func NewLocalSnapshotter(dir string) *LocalSnapshotter {
+	return &LocalSnapshotter{dir: dir, now: time.Now}
+}
+
+func (l *LocalSnapshotter) Snapshot(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error {
+	name, b, err := newPolicySnapshot(resource, requestID, policy, l.now())
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(l.dir, filepath.FromSlash(name))
+	// Policies list who has access to what, so only the bot can read them
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return fmt.Errorf("can't write policy snapshot: %v", err)
+	}
+	// O_EXCL so a snapshot is never overwritten
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("can't write policy snapshot: %v", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("can't write policy snapshot: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("can't write policy snapshot: %v", err)
+	}
+	return nil
+}
+
+func (l *LocalSnapshotter) List(ctx context.Context, resource Resource) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(l.dir, filepath.FromSlash(string(resource))))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't list policy snapshots: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, path.Join(string(resource), e.Name()))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (l *LocalSnapshotter) Load(ctx context.Context, name string) (*PolicySnapshot, error) {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	b, err := os.ReadFile(filepath.Join(l.dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read policy snapshot: %v", err)
+	}
+	return decodePolicySnapshot(name, b)
+}
+
+// GCSSnapshotter keeps snapshots as objects in a bucket, so they outlive the instance that took them.
+// The endpoint can point it at any server that speaks the GCS JSON API, it defaults to GCS itself.
+type GCSSnapshotter struct {
+	objects *storage.ObjectsService
+	bucket  string
+	now     func() time.Time
+}
+
+func NewGCSSnapshotter(ctx context.Context, bucket, endpoint string) (*GCSSnapshotter, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("POLICY_SNAPSHOT_BUCKET has to be set to keep policy snapshots in GCS")
+	}
+	var opts []option.ClientOption
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	srv, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize google storage: %v", err)
+	}
+	return &GCSSnapshotter{objects: srv.Objects, bucket: bucket, now: time.Now}, nil
+}
+
+func (g *GCSSnapshotter) Snapshot(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error {
+	name, b, err := newPolicySnapshot(resource, requestID, policy, g.now())
+	if err != nil {
+		return err
+	}
+	object := &storage.Object{Name: name, ContentType: "application/json"}
+	// Generation 0 means the object can't already exist, so a snapshot is never overwritten
+	if _, err := g.objects.Insert(g.bucket, object).Media(bytes.NewReader(b)).IfGenerationMatch(0).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("can't write policy snapshot to gs://%s/%s: %v", g.bucket, name, err)
+	}
+	return nil
+}
+
+func (g *GCSSnapshotter) List(ctx context.Context, resource Resource) ([]string, error) {
+	var names []string
+	err := g.objects.List(g.bucket).Prefix(string(resource)+"/").Pages(ctx, func(objects *storage.Objects) error {
+		for _, o := range objects.Items {
+			rest := strings.TrimPrefix(o.Name, string(resource)+"/")
+			// Skip the snapshots of resources nested under this one's name
+			if !strings.Contains(rest, "/") && strings.HasSuffix(rest, ".json") {
+				names = append(names, o.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("can't list policy snapshots in gs://%s: %v", g.bucket, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (g *GCSSnapshotter) Load(ctx context.Context, name string) (*PolicySnapshot, error) {
+	resp, err := g.objects.Get(g.bucket, name).Context(ctx).Download()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrSnapshotNotFound, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read policy snapshot gs://%s/%s: %v", g.bucket, name, err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("can't read policy snapshot gs://%s/%s: %v", g.bucket, name, err)
+	}
+	return decodePolicySnapshot(name, b)
+}
+
+// restoreRequestID is what the snapshot of the live policy taken before a restore is recorded under
+const restoreRequestID = "restore"
+
+// RestorePolicySnapshot writes the bindings and audit configs in a snapshot back over the live policy on its resource.
+// confirm is shown what that would change and nothing is written unless it returns true, it isn't called if nothing would change.
+// A restore can change anything, so it isn't held to checkPolicyChange, and the live policy is snapshotted first so it can be undone too.
+// The write carries the etag of the policy that was diffed, so if it's changed since confirm saw it the restore fails instead of being retried.
+func RestorePolicySnapshot(ctx context.Context, s *PolicySnapshot, g Googler, confirm func(PolicyDiff) bool) (bool, error) {
+	getIamPolicyRequest := &cloudresourcemanager.GetIamPolicyRequest{
+		Options: &cloudresourcemanager.GetPolicyOptions{
+			RequestedPolicyVersion: 3,
+		},
+	}
+	live, err := g.getIamPolicy(ctx, s.Resource, getIamPolicyRequest)
+	if err != nil {
+		return false, fmt.Errorf("failed to retrieve iam policy: %w", err)
+	}
+	if live == nil {
+		return false, fmt.Errorf("no existing iam policy was found")
+	}
+	restored := &cloudresourcemanager.Policy{}
+	if err := convertPolicy(s.Policy, restored); err != nil {
+		return false, err
+	}
+	restored.Etag = live.Etag
+	// In order to use conditional IAM, must set version to 3
+	restored.Version = 3
+	diff := diffPolicies(live, restored)
+	if diff.Empty() || !confirm(diff) {
+		return false, nil
+	}
+	if err := g.snapshot(ctx, s.Resource, restoreRequestID, live); err != nil {
+		return false, fmt.Errorf("couldn't snapshot iam policy on %s, not restoring it: %w", s.Resource, err)
+	}
+	logPolicyDiff(s.Resource, diff, nil)
+	if _, err := g.setIamPolicy(ctx, s.Resource, &cloudresourcemanager.SetIamPolicyRequest{Policy: restored}); err != nil {
+		return false, fmt.Errorf("failed to set iam policy: %w", err)
+	}
+	return true, nil
+}
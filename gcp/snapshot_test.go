@@ -0,0 +1,200 @@
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/cloudresourcemanager/v1"
+)
+
+func TestLocalSnapshotter(t *testing.T) {
+	ctx := context.Background()
+	now := CurrentTime
+	l := NewLocalSnapshotter(t.TempDir())
+	l.now = func() time.Time { return now }
+	policy := &cloudresourcemanager.Policy{Etag: "etag-1", Bindings: []*cloudresourcemanager.Binding{
+		{Role: "roles/owner", Members: []string{"user:bob@gmail.com"}},
+	}}
+	if err := l.Snapshot(ctx, "organizations/0000000000", "1234", policy); err != nil {
+		t.Fatal(err)
+	}
+	// A snapshot is never overwritten
+	if err := l.Snapshot(ctx, "organizations/0000000000", "1234", policy); err == nil {
+		t.Errorf("want an error overwriting a snapshot")
+	}
+	now = now.Add(time.Minute)
+	if err := l.Snapshot(ctx, "organizations/0000000000", "", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Snapshot(ctx, "projects/testing", "5678", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Snapshot(ctx, "../testing", "5678", policy); err == nil {
+		t.Errorf("want an error for a resource outside the snapshot directory")
+	}
+
+	names, err := l.List(ctx, "organizations/0000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"organizations/0000000000/20240428T000000.000000000Z-1234.json",
+		"organizations/0000000000/20240428T000100.000000000Z.json",
+	}
+	if diff := cmp.Diff(names, want); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	s, err := l.Load(ctx, names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(s, &PolicySnapshot{Resource: "organizations/0000000000", RequestID: "1234", TakenAt: CurrentTime, Policy: policy}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	if _, err := l.Load(ctx, "organizations/0000000000/missing.json"); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("got %v, want ErrSnapshotNotFound", err)
+	}
+	if names, err := l.List(ctx, "folders/1"); err != nil || names != nil {
+		t.Errorf("got %v %v, want no snapshots", names, err)
+	}
+}
+
+func TestModifyIamPolicySnapshots(t *testing.T) {
+	tests := []struct {
+		name          string
+		changed       bool
+		snapshotErr   error
+		wantSnapshots int
+		wantWrites    int
+		wantError     bool
+	}{
+		{"snapshot before the write", true, nil, 1, 1, false},
+		{"no snapshot when nothing changed", false, nil, 0, 0, false},
+		{"no write without a snapshot", true, fmt.Errorf("bucket is gone"), 1, 0, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			snapshots, writes := 0, 0
+			mock := NewMockGoogler()
+			mock.SnapshotF = func(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error {
+				snapshots++
+				if resource != "projects/testing" || requestID != "1234" {
+					t.Errorf("got a snapshot of %s for %s, want projects/testing for 1234", resource, requestID)
+				}
+				// The snapshot is of the policy as it was read, not as it's about to be written
+				if len(policy.Bindings) != 1 {
+					t.Errorf("got %d bindings in the snapshot, want 1", len(policy.Bindings))
+				}
+				return tt.snapshotErr
+			}
+			mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				writes++
+				return nil, nil
+			}
+			err := modifyIamPolicy(context.Background(), "projects/testing", "1234", mock, func(p *cloudresourcemanager.Policy) (bool, error) {
+				p.Bindings = append(p.Bindings, newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, "1234"))
+				return tt.changed, nil
+			})
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if snapshots != tt.wantSnapshots || writes != tt.wantWrites {
+				t.Errorf("got %d snapshots and %d writes, want %d and %d", snapshots, writes, tt.wantSnapshots, tt.wantWrites)
+			}
+		})
+	}
+}
+
+func TestRestorePolicySnapshot(t *testing.T) {
+	grant := newConditionalBinding("roles/editor", "bob@gmail.com", ExpiryTime, "1234")
+	owners := &cloudresourcemanager.Binding{Role: "roles/owner", Members: []string{"user:bob@gmail.com", "user:foo@gmail.com"}}
+	snapshot := &PolicySnapshot{
+		Resource:  "organizations/0000000000",
+		RequestID: "1234",
+		TakenAt:   CurrentTime,
+		Policy:    &cloudresourcemanager.Policy{Etag: "etag-old", Version: 3, Bindings: []*cloudresourcemanager.Binding{owners}},
+	}
+	tests := []struct {
+		name         string
+		live         []*cloudresourcemanager.Binding
+		confirm      bool
+		wantDiff     *PolicyDiff
+		wantRestored bool
+	}{
+		{
+			"restores once confirmed",
+			[]*cloudresourcemanager.Binding{grant},
+			true,
+			&PolicyDiff{
+				Added:   []BindingChange{{Role: "roles/owner", Members: owners.Members}},
+				Removed: []BindingChange{{Role: "roles/editor", Members: grant.Members, Condition: grant.Condition.Title, BotOwned: true}},
+			},
+			true,
+		},
+		{
+			"not confirmed",
+			[]*cloudresourcemanager.Binding{grant},
+			false,
+			&PolicyDiff{
+				Added:   []BindingChange{{Role: "roles/owner", Members: owners.Members}},
+				Removed: []BindingChange{{Role: "roles/editor", Members: grant.Members, Condition: grant.Condition.Title, BotOwned: true}},
+			},
+			false,
+		},
+		{"already matches", []*cloudresourcemanager.Binding{owners}, true, nil, false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var written *cloudresourcemanager.Policy
+			var snapshotted []string
+			mock := NewMockGoogler()
+			mock.GetIamPolicyF = func(ctx context.Context, resource Resource, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				return &cloudresourcemanager.Policy{Etag: "etag-live", Version: 3, Bindings: tt.live}, nil
+			}
+			mock.SetIamPolicyF = func(ctx context.Context, resource Resource, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) (*cloudresourcemanager.Policy, error) {
+				written = setiampolicyrequest.Policy
+				return nil, nil
+			}
+			mock.SnapshotF = func(ctx context.Context, resource Resource, requestID string, policy *cloudresourcemanager.Policy) error {
+				snapshotted = append(snapshotted, requestID)
+				return nil
+			}
+			var gotDiff *PolicyDiff
+			restored, err := RestorePolicySnapshot(context.Background(), snapshot, mock, func(diff PolicyDiff) bool {
+				gotDiff = &diff
+				return tt.confirm
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored != tt.wantRestored {
+				t.Errorf("got restored %v, want %v", restored, tt.wantRestored)
+			}
+			if diff := cmp.Diff(gotDiff, tt.wantDiff); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+			if !tt.wantRestored {
+				if written != nil || snapshotted != nil {
+					t.Errorf("got a write or snapshot, want neither")
+				}
+				return
+			}
+			// The write is checked against the live policy that was diffed, not the one in the snapshot
+			want := &cloudresourcemanager.Policy{Etag: "etag-live", Version: 3, Bindings: []*cloudresourcemanager.Binding{owners}}
+			if diff := cmp.Diff(written, want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+			if diff := cmp.Diff(snapshotted, []string{"restore"}); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+// Package groups has the places other than the Google Directory that users' groups can be looked up, and combines them.
+// Groups from these sources are named with the source first, like slack:oncall, so they can't be confused with each other
+// or with the Google groups, which keep their emails as their names.
+package groups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+const (
+	SlackPrefix  = "slack:"
+	StaticPrefix = "static:"
+	SCIMPrefix   = "scim:"
+)
+
+// NewSource builds the group source from the sources named in the config, more than one are combined with Union.
+// gs is used for the google source and slackClient for the slack one.
+func NewSource(ctx context.Context, gs *gcp.Service, slackClient SlackClient) (gcp.GroupSource, error) {
+	var sources []gcp.GroupSource
+	for _, name := range config.Cfg.GroupSources {
+		switch name {
+		case "google":
+			sources = append(sources, gcp.DirectoryGroups(gs, config.Cfg.ValidDomain))
+		case "slack":
+			sources = append(sources, NewSlackGroups(slackClient, config.Cfg.GroupCacheTTL()))
+		case "static":
+			s, err := LoadStaticGroups(config.Cfg.StaticGroupsPath)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, s)
+		case "scim":
+			if config.Cfg.SCIMEndpoint == "" {
+				return nil, fmt.Errorf("GROUP_SOURCES has scim but SCIM_ENDPOINT isn't set")
+			}
+			sources = append(sources, NewSCIMGroups(config.Cfg.SCIMEndpoint, config.Cfg.SCIMToken, nil))
+		default:
+			return nil, fmt.Errorf("unknown group source in GROUP_SOURCES: %q", name)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("GROUP_SOURCES doesn't have any group sources")
+	}
+	if len(sources) == 1 {
+		return sources[0], nil
+	}
+	return Union(sources...), nil
+}
+
+// Union looks a user up in every source and returns all of their groups.
+// If any source can't be read the lookup fails, rather than authorizing against some of the groups.
+// Groups a source returned from its cache are used, with the source's *gcp.StaleGroupsError.
+func Union(sources ...gcp.GroupSource) gcp.GroupSource {
+	return union(sources)
+}
+
+type union []gcp.GroupSource
+
+func (u union) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	all := Groups{}
+	var stale error
+	for _, s := range u {
+		groups, err := s.ListGroups(ctx, user, maxDepth)
+		if err != nil && len(gcp.StaleGroups(err)) == 0 {
+			return nil, err
+		}
+		stale = errors.Join(stale, err)
+		for g := range groups {
+			all[g] = struct{}{}
+		}
+	}
+	return all, stale
+}
+
+// validEmail keeps an email from changing the meaning of the queries and filters it's put into
+func validEmail(user Requestor) error {
+	if strings.ContainsFunc(string(user), unsafeInFilter) || !strings.Contains(string(user), "@") {
+		return fmt.Errorf("invalid email: %q", user)
+	}
+	return nil
+}
+
+func unsafeInFilter(r rune) bool {
+	return r == '"' || r == '\\' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
@@ -0,0 +1,361 @@
+package groups
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+	"github.com/slack-go/slack"
+)
+
+type fixedGroups struct {
+	groups Groups
+	err    error
+}
+
+func (f fixedGroups) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	return f.groups, f.err
+}
+
+func TestUnion(t *testing.T) {
+	stale := &gcp.StaleGroupsError{Member: "bob@gmail.com", CachedAt: time.Now(), Err: fmt.Errorf("can't reach google")}
+	tests := []struct {
+		name      string
+		sources   []gcp.GroupSource
+		want      Groups
+		wantStale int
+		wantError bool
+	}{
+		{
+			"every source's groups",
+			[]gcp.GroupSource{
+				fixedGroups{groups: Groups{"sre@gmail.com": {}}},
+				fixedGroups{groups: Groups{"slack:oncall": {}}},
+				fixedGroups{groups: Groups{}},
+			},
+			Groups{"sre@gmail.com": {}, "slack:oncall": {}},
+			0,
+			false,
+		},
+		{
+			"a source can't be read",
+			[]gcp.GroupSource{
+				fixedGroups{groups: Groups{"sre@gmail.com": {}}},
+				fixedGroups{err: fmt.Errorf("can't reach slack")},
+			},
+			nil,
+			0,
+			true,
+		},
+		{
+			"stale groups are used",
+			[]gcp.GroupSource{
+				fixedGroups{groups: Groups{"sre@gmail.com": {}}, err: stale},
+				fixedGroups{groups: Groups{"static:sre": {}}},
+			},
+			Groups{"sre@gmail.com": {}, "static:sre": {}},
+			1,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := Union(tt.sources...).ListGroups(context.Background(), "bob@gmail.com", 0)
+			if len(gcp.StaleGroups(err)) != tt.wantStale {
+				t.Errorf("got %v, want %d stale", err, tt.wantStale)
+			}
+			if (err != nil && tt.wantStale == 0) != tt.wantError {
+				t.Errorf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestStaticGroups(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		user      Requestor
+		want      Groups
+		wantError bool
+	}{
+		{
+			"yaml",
+			"groups:\n  sre:\n    - Bob@gmail.com\n    - alice@gmail.com\n  oncall:\n    - bob@gmail.com\n",
+			"bob@gmail.com",
+			Groups{"static:sre": {}, "static:oncall": {}},
+			false,
+		},
+		{
+			"json",
+			`{"groups": {"sre": ["bob@gmail.com"], "dba": ["alice@gmail.com"]}}`,
+			"bob@gmail.com",
+			Groups{"static:sre": {}},
+			false,
+		},
+		{
+			"not in any groups",
+			`{"groups": {"sre": ["alice@gmail.com"]}}`,
+			"bob@gmail.com",
+			Groups{},
+			false,
+		},
+		{
+			"invalid member",
+			`{"groups": {"sre": ["bob"]}}`,
+			"bob@gmail.com",
+			nil,
+			true,
+		},
+		{
+			"invalid file",
+			`groups: [`,
+			"bob@gmail.com",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			s, err := ParseStaticGroups([]byte(tt.file))
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if err != nil {
+				return
+			}
+			got, err := s.ListGroups(context.Background(), tt.user, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+type mockSlackClient struct {
+	users      map[string]slack.User
+	userGroups []slack.UserGroup
+	err        error
+	listCalls  int
+}
+
+func (m *mockSlackClient) GetUserByEmailContext(ctx context.Context, email string) (*slack.User, error) {
+	u, ok := m.users[email]
+	if !ok {
+		return nil, slack.SlackErrorResponse{Err: "users_not_found"}
+	}
+	return &u, nil
+}
+
+func (m *mockSlackClient) GetUserInfoContext(ctx context.Context, user string) (*slack.User, error) {
+	for _, u := range m.users {
+		if u.ID == user {
+			return &u, nil
+		}
+	}
+	return nil, slack.SlackErrorResponse{Err: "user_not_found"}
+}
+
+func (m *mockSlackClient) GetUserGroupsContext(ctx context.Context, options ...slack.GetUserGroupsOption) ([]slack.UserGroup, error) {
+	m.listCalls++
+	return m.userGroups, m.err
+}
+
+func TestSlackGroups(t *testing.T) {
+	client := &mockSlackClient{
+		users: map[string]slack.User{
+			"bob@gmail.com":   {ID: "U1"},
+			"alice@gmail.com": {ID: "U2"},
+			"eve@gmail.com":   {ID: "U3", Deleted: true},
+		},
+		userGroups: []slack.UserGroup{{ID: "S1", Handle: "oncall", Users: []string{"U1", "U3"}}, {ID: "S2", Handle: "dba", Users: []string{"U2"}}},
+	}
+	tests := []struct {
+		name      string
+		user      Requestor
+		err       error
+		want      Groups
+		wantError bool
+	}{
+		{"in a group", "bob@gmail.com", nil, Groups{"slack:oncall": {}}, false},
+		{"not in slack", "mallory@gmail.com", nil, Groups{}, false},
+		{"deactivated", "eve@gmail.com", nil, Groups{}, false},
+		{"can't list user groups", "bob@gmail.com", fmt.Errorf("ratelimited"), nil, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			c := *client
+			c.err = tt.err
+			got, err := NewSlackGroups(&c, 0).ListGroups(context.Background(), tt.user, 0)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestSlackGroupsByUserID(t *testing.T) {
+	client := &mockSlackClient{
+		users: map[string]slack.User{
+			"contractor@vendor.com": {ID: "U1"},
+			"eve@gmail.com":         {ID: "U3", Deleted: true},
+		},
+		userGroups: []slack.UserGroup{{ID: "S1", Handle: "oncall", Users: []string{"U1", "U3"}}},
+	}
+	tests := []struct {
+		name   string
+		user   Requestor
+		userID string
+		want   Groups
+	}{
+		// The google identity the slack email was mapped to isn't in slack, the user is found by their slack user ID instead
+		{"mapped identity", "contractor.ext@gmail.com", "U1", Groups{"slack:oncall": {}}},
+		{"mapped identity without a slack user", "contractor.ext@gmail.com", "", Groups{}},
+		{"deactivated", "eve@gmail.com", "U3", Groups{}},
+		{"unknown slack user", "mallory@gmail.com", "U9", Groups{}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := gcp.WithSlackUser(context.Background(), tt.user, tt.userID)
+			got, err := NewSlackGroups(client, 0).ListGroups(ctx, tt.user, 0)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+	// A slack user ID recorded for someone else isn't used
+	ctx := gcp.WithSlackUser(context.Background(), "someone@gmail.com", "U1")
+	got, err := NewSlackGroups(client, 0).ListGroups(ctx, "contractor.ext@gmail.com", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got %v, want no groups", got)
+	}
+}
+
+func TestSlackGroupsCached(t *testing.T) {
+	client := &mockSlackClient{
+		users: map[string]slack.User{
+			"bob@gmail.com":   {ID: "U1"},
+			"alice@gmail.com": {ID: "U2"},
+		},
+		userGroups: []slack.UserGroup{{ID: "S1", Handle: "oncall", Users: []string{"U1"}}, {ID: "S2", Handle: "dba", Users: []string{"U2"}}},
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewSlackGroups(client, time.Minute)
+	s.now = func() time.Time { return now }
+	lookup := func(user Requestor, want Groups, wantCalls int) {
+		t.Helper()
+		got, err := s.ListGroups(context.Background(), user, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(got, want); diff != "" {
+			t.Errorf("diff: %v", diff)
+		}
+		if client.listCalls != wantCalls {
+			t.Errorf("got %d usergroups.list calls, want %d", client.listCalls, wantCalls)
+		}
+	}
+	// Every user is looked up from the same listing, with its members included, until it's older than the ttl
+	lookup("bob@gmail.com", Groups{"slack:oncall": {}}, 1)
+	lookup("alice@gmail.com", Groups{"slack:dba": {}}, 1)
+	client.userGroups = []slack.UserGroup{{ID: "S1", Handle: "oncall", Users: []string{"U1", "U2"}}}
+	now = now.Add(59 * time.Second)
+	lookup("alice@gmail.com", Groups{"slack:dba": {}}, 1)
+	now = now.Add(time.Second)
+	lookup("alice@gmail.com", Groups{"slack:oncall": {}}, 2)
+}
+
+func TestSCIMGroups(t *testing.T) {
+	groups := []string{"Engineering", "SRE", "On Call"}
+	var filters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		filter := r.URL.Query().Get("filter")
+		filters = append(filters, filter)
+		resp := scimListResponse{}
+		type resource = struct {
+			ID          string `json:"id"`
+			DisplayName string `json:"displayName"`
+		}
+		switch r.URL.Path {
+		case "/scim/v2/Users":
+			if filter == `userName eq "bob@gmail.com"` {
+				resp.Resources = append(resp.Resources, resource{ID: "2819c223"})
+			}
+		case "/scim/v2/Groups":
+			if filter != `members.value eq "2819c223"` {
+				break
+			}
+			// Two groups a page, whatever count was asked for
+			start, _ := strconv.Atoi(r.URL.Query().Get("startIndex"))
+			resp.TotalResults = len(groups)
+			for i := start - 1; i < len(groups) && i < start+1; i++ {
+				resp.Resources = append(resp.Resources, resource{ID: strconv.Itoa(i), DisplayName: groups[i]})
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	s := NewSCIMGroups(srv.URL+"/scim/v2/", "secret", srv.Client())
+	got, err := s.ListGroups(context.Background(), "bob@gmail.com", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, Groups{"scim:Engineering": {}, "scim:SRE": {}, "scim:On Call": {}}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	if len(filters) != 3 {
+		t.Errorf("got %d requests, want the user and two pages of groups: %v", len(filters), filters)
+	}
+
+	got, err = s.ListGroups(context.Background(), "alice@gmail.com", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(got, Groups{}); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+
+	if _, err := s.ListGroups(context.Background(), `bob@gmail.com" or userName pr "`, 0); err == nil {
+		t.Errorf("got no error for an email that would change the filter")
+	}
+	if _, err := NewSCIMGroups(srv.URL+"/scim/v2", "wrong", srv.Client()).ListGroups(context.Background(), "bob@gmail.com", 0); err == nil {
+		t.Errorf("got no error when scim refused the token")
+	}
+}
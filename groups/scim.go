@@ -0,0 +1,115 @@
+package groups
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// scimPageSize is how many groups are asked for at a time, servers can return fewer
+const scimPageSize = 100
+
+// NewSCIMGroups looks up groups from a SCIM 2.0 server, named scim:<displayName>.
+// endpoint is the base URL that /Users and /Groups are under, and token is sent as a bearer token if it's set.
+func NewSCIMGroups(endpoint, token string, client *http.Client) *SCIMGroups {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &SCIMGroups{endpoint: strings.TrimSuffix(endpoint, "/"), token: token, client: client}
+}
+
+type SCIMGroups struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+type scimListResponse struct {
+	TotalResults int `json:"totalResults"`
+	ItemsPerPage int `json:"itemsPerPage"`
+	StartIndex   int `json:"startIndex"`
+	Resources    []struct {
+		ID          string `json:"id"`
+		DisplayName string `json:"displayName"`
+	} `json:"Resources"`
+}
+
+// ListGroups finds the user by their userName, then pages through the groups that have them as a member
+func (s *SCIMGroups) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	if err := validEmail(user); err != nil {
+		return nil, err
+	}
+	users, err := s.list(ctx, "Users", fmt.Sprintf(`userName eq "%s"`, user), 1)
+	if err != nil {
+		return nil, err
+	}
+	groups := Groups{}
+	if len(users.Resources) == 0 {
+		return groups, nil
+	}
+	if len(users.Resources) > 1 {
+		return nil, fmt.Errorf("scim has %d users with the userName %s", len(users.Resources), user)
+	}
+	id := users.Resources[0].ID
+	if id == "" || strings.ContainsFunc(id, unsafeInFilter) {
+		return nil, fmt.Errorf("scim returned an invalid id for %s: %q", user, id)
+	}
+	for start := 1; ; {
+		page, err := s.list(ctx, "Groups", fmt.Sprintf(`members.value eq "%s"`, id), start)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range page.Resources {
+			if g.DisplayName == "" {
+				continue
+			}
+			groups[Group(SCIMPrefix+g.DisplayName)] = struct{}{}
+		}
+		start += len(page.Resources)
+		if len(page.Resources) == 0 || start > page.TotalResults {
+			return groups, nil
+		}
+	}
+}
+
+func (s *SCIMGroups) list(ctx context.Context, resource, filter string, startIndex int) (*scimListResponse, error) {
+	q := url.Values{}
+	q.Set("filter", filter)
+	q.Set("startIndex", strconv.Itoa(startIndex))
+	q.Set("count", strconv.Itoa(scimPageSize))
+	if resource == "Groups" {
+		q.Set("attributes", "displayName")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s?%s", s.endpoint, resource, q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/scim+json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach scim: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, fmt.Errorf("can't read scim %s: %v", resource, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scim returned %s for %s: %s", resp.Status, resource, body)
+	}
+	var list scimListResponse
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("can't parse scim %s: %v", resource, err)
+	}
+	return &list, nil
+}
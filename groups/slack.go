@@ -0,0 +1,96 @@
+package groups
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/seslattery/gcpsudobot/gcp"
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"github.com/slack-go/slack"
+)
+
+// SlackClient is the part of the slack client that's needed to look up user groups
+type SlackClient interface {
+	GetUserByEmailContext(ctx context.Context, email string) (*slack.User, error)
+	GetUserInfoContext(ctx context.Context, user string) (*slack.User, error)
+	GetUserGroupsContext(ctx context.Context, options ...slack.GetUserGroupsOption) ([]slack.UserGroup, error)
+}
+
+// NewSlackGroups looks up the slack user groups a user is in, named slack:<handle>.
+// The user is looked up by the slack user ID recorded with gcp.WithSlackUser when there is one, and by their email otherwise.
+// Every user group is listed along with its members in a single call, which is cached for ttl, since usergroups.list is rate limited.
+// The slack app needs the users:read.email and usergroups:read scopes.
+func NewSlackGroups(client SlackClient, ttl time.Duration) *SlackGroups {
+	return &SlackGroups{client: client, ttl: ttl, now: time.Now}
+}
+
+type SlackGroups struct {
+	client SlackClient
+	ttl    time.Duration
+	// Swapped out by tests
+	now func() time.Time
+
+	mu sync.Mutex
+	// The groups of each slack user ID, as of fetchedAt
+	members   map[string]Groups
+	fetchedAt time.Time
+}
+
+func (s *SlackGroups) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	var u *slack.User
+	var err error
+	if userID, ok := gcp.SlackUserID(ctx, user); ok {
+		u, err = s.client.GetUserInfoContext(ctx, userID)
+	} else {
+		u, err = s.client.GetUserByEmailContext(ctx, string(user))
+	}
+	var slackErr slack.SlackErrorResponse
+	if errors.As(err, &slackErr) && (slackErr.Err == "users_not_found" || slackErr.Err == "user_not_found") {
+		return Groups{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't look up %s in slack: %v", user, err)
+	}
+	if u.Deleted {
+		return Groups{}, nil
+	}
+	members, err := s.userGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := Groups{}
+	for g := range members[u.ID] {
+		groups[g] = struct{}{}
+	}
+	return groups, nil
+}
+
+// userGroups returns the groups of every slack user, listing them again once the last listing is older than the ttl
+func (s *SlackGroups) userGroups(ctx context.Context) (map[string]Groups, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if s.members != nil && now.Sub(s.fetchedAt) < s.ttl {
+		return s.members, nil
+	}
+	// Disabled user groups aren't listed
+	userGroups, err := s.client.GetUserGroupsContext(ctx, slack.GetUserGroupsOptionIncludeUsers(true))
+	if err != nil {
+		return nil, fmt.Errorf("can't list slack user groups: %v", err)
+	}
+	members := make(map[string]Groups)
+	for _, g := range userGroups {
+		for _, m := range g.Users {
+			if members[m] == nil {
+				members[m] = Groups{}
+			}
+			members[m][Group(SlackPrefix+g.Handle)] = struct{}{}
+		}
+	}
+	s.members, s.fetchedAt = members, now
+	return members, nil
+}
@@ -0,0 +1,69 @@
+package groups
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StaticGroups are groups listed in a file, named static:<group>. The file is YAML or JSON, with the members of each group:
+//
+//	groups:
+//	  sre:
+//	    - alice@example.com
+//	    - bob@example.com
+type StaticGroups struct {
+	// The groups each lowercased email is in
+	members map[string]Groups
+}
+
+type staticGroupsFile struct {
+	Groups map[string][]string `yaml:"groups" json:"groups"`
+}
+
+// LoadStaticGroups reads the groups from a file, it's only read once so the bot has to be redeployed to pick up changes
+func LoadStaticGroups(path string) (*StaticGroups, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read static groups: %v", err)
+	}
+	return ParseStaticGroups(b)
+}
+
+// ParseStaticGroups parses the groups from YAML or JSON, which is also YAML
+func ParseStaticGroups(b []byte) (*StaticGroups, error) {
+	var f staticGroupsFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("can't parse static groups: %v", err)
+	}
+	s := &StaticGroups{members: make(map[string]Groups)}
+	for group, members := range f.Groups {
+		if group == "" {
+			return nil, fmt.Errorf("static groups has a group without a name")
+		}
+		for _, m := range members {
+			if err := validEmail(Requestor(m)); err != nil {
+				return nil, fmt.Errorf("static group %s: %v", group, err)
+			}
+			email := strings.ToLower(m)
+			if s.members[email] == nil {
+				s.members[email] = Groups{}
+			}
+			s.members[email][Group(StaticPrefix+group)] = struct{}{}
+		}
+	}
+	return s, nil
+}
+
+func (s *StaticGroups) ListGroups(ctx context.Context, user Requestor, maxDepth int) (Groups, error) {
+	groups := Groups{}
+	for g := range s.members[strings.ToLower(string(user))] {
+		groups[g] = struct{}{}
+	}
+	return groups, nil
+}
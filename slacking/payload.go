@@ -0,0 +1,142 @@
+package slacking
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/store"
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// Slack rejects button values longer than this
+const maxButtonValueLength = 2000
+
+var ErrInvalidPayload = errors.New("invalid approval payload")
+
+// ErrButtonUsed is wrapped along with ErrInvalidPayload when a button's nonce has already been claimed, e.g. by a double click or a slack retry
+var ErrButtonUsed = errors.New("this button has already been used")
+
+// These are swapped out by tests
+var (
+	now      = time.Now
+	newNonce = func() (string, error) {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(b), nil
+	}
+)
+
+// minNonceRetention is the least time a used nonce is remembered for.
+// Buttons without a max age, or a max age of 0, would otherwise have their nonces forgotten as soon as they're claimed.
+const minNonceRetention = 7 * 24 * time.Hour
+
+// ButtonPayload is carried in the Approve and Deny buttons. The request itself is kept in the store, so only its ID is needed.
+type ButtonPayload struct {
+	RequestID string `json:"request_id"`
+	// The button the payload was made for, so it can't be moved to another button
+	ActionID string   `json:"action_id"`
+	Status   Approval `json:"status"`
+	Nonce    string   `json:"nonce"`
+	IssuedAt int64    `json:"issued_at"`
+}
+
+// signPayload serializes the payload for a button value, prefixed with an HMAC of the JSON so it can't be changed in slack
+func signPayload(p *ButtonPayload) (string, error) {
+	key, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("can't marshal json: %v", err)
+	}
+	value := fmt.Sprintf("%s.%s", sign(key, b), b)
+	if len(value) > maxButtonValueLength {
+		return "", fmt.Errorf("approval payload is %d characters, slack only allows %d", len(value), maxButtonValueLength)
+	}
+	return value, nil
+}
+
+// verifyPayload checks the button value was signed by us and isn't older than maxAge, it doesn't check for replays.
+// A maxAge of 0 doesn't limit the age.
+func verifyPayload(value string, maxAge time.Duration) (*ButtonPayload, error) {
+	key, err := signingKey()
+	if err != nil {
+		return nil, err
+	}
+	sig, payload, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, fmt.Errorf("%w: not signed", ErrInvalidPayload)
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(key, []byte(payload)))) {
+		return nil, fmt.Errorf("%w: signature doesn't match", ErrInvalidPayload)
+	}
+	var p *ButtonPayload
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		return nil, fmt.Errorf("can't unmarshal block action: %v", err)
+	}
+	if p.RequestID == "" || p.Nonce == "" {
+		return nil, fmt.Errorf("%w: missing request id or nonce", ErrInvalidPayload)
+	}
+	issued := time.Unix(p.IssuedAt, 0)
+	if maxAge > 0 && now().Sub(issued) > maxAge {
+		return nil, fmt.Errorf("%w: the request was made at %s and has expired, please make a new one", ErrInvalidPayload, issued.UTC().Format(time.RFC3339))
+	}
+	return p, nil
+}
+
+// claimNonce marks the payload's nonce as used in the store, so the button can't be clicked again on any instance.
+// It's remembered until the payload expires, and for at least minNonceRetention.
+func claimNonce(ctx context.Context, s store.NonceStore, p *ButtonPayload, maxAge time.Duration) error {
+	t := now()
+	expires := time.Unix(p.IssuedAt, 0).Add(maxAge)
+	if least := t.Add(minNonceRetention); expires.Before(least) {
+		expires = least
+	}
+	err := s.ClaimNonce(ctx, p.Nonce, t, expires)
+	if errors.Is(err, store.ErrNonceUsed) {
+		return fmt.Errorf("%w: %w", ErrInvalidPayload, ErrButtonUsed)
+	}
+	if err != nil {
+		return fmt.Errorf("can't claim nonce: %v", err)
+	}
+	return nil
+}
+
+// releaseNonce lets the button be clicked again. It can only fail in the store, and then the button stays used.
+func releaseNonce(ctx context.Context, s store.NonceStore, nonce string) {
+	if err := s.ReleaseNonce(ctx, nonce); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+// ReleaseApproval lets the approval's buttons be clicked again, for when acting on it failed
+func ReleaseApproval(ctx context.Context, s store.NonceStore, a *EscalationApproval) {
+	releaseNonce(ctx, s, a.Nonce)
+}
+
+func sign(key string, b []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signingKey() (string, error) {
+	if config.Cfg.PayloadSigningKey == "" {
+		return "", fmt.Errorf("no key to sign approval payloads with, set PAYLOAD_SIGNING_KEY")
+	}
+	return config.Cfg.PayloadSigningKey, nil
+}
@@ -0,0 +1,103 @@
+package slacking
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/seslattery/gcpsudobot/store"
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVerifyPayload(t *testing.T) {
+	testSigning(t)
+	p := &ButtonPayload{
+		RequestID: "0123456789abcdef0123456789abcdef",
+		ActionID:  DenialButtonID,
+		Status:    Denied,
+		Nonce:     "0123456789abcdef",
+		IssuedAt:  now().Unix(),
+	}
+	signed, err := signPayload(p)
+	if err != nil {
+		t.Fatalf("couldn't sign payload: %v", err)
+	}
+	tests := []struct {
+		name    string
+		value   string
+		age     time.Duration
+		maxAge  time.Duration
+		wantErr bool
+	}{
+		{"signed", signed, 0, 24 * time.Hour, false},
+		{"within the max age", signed, 23 * time.Hour, 24 * time.Hour, false},
+		{"older than the max age", signed, 25 * time.Hour, 24 * time.Hour, true},
+		{"no max age", signed, 25 * time.Hour, 0, false},
+		{"status changed", strings.Replace(signed, `"status":false`, `"status":true`, 1), 0, 24 * time.Hour, true},
+		{"request id changed", strings.Replace(signed, `"request_id":"0`, `"request_id":"1`, 1), 0, 24 * time.Hour, true},
+		{"button changed", strings.Replace(signed, `"action_id":"dny-id"`, `"action_id":"apprv-id"`, 1), 0, 24 * time.Hour, true},
+		{"unsigned", signed[strings.Index(signed, ".")+1:], 0, 24 * time.Hour, true},
+		{"signed with another key", sign("another-key", []byte(signed[strings.Index(signed, ".")+1:])) + signed[strings.Index(signed, "."):], 0, 24 * time.Hour, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			issued := now()
+			now = func() time.Time { return issued.Add(tt.age) }
+			defer func() { now = func() time.Time { return issued } }()
+			got, err := verifyPayload(tt.value, tt.maxAge)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPayload) {
+					t.Errorf("got %v, want ErrInvalidPayload", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(got, p); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestClaimNonce(t *testing.T) {
+	testSigning(t)
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	issued := now()
+	p := &ButtonPayload{RequestID: "0123456789abcdef0123456789abcdef", ActionID: RevokeButtonID, Nonce: "a", IssuedAt: issued.Unix()}
+	// Without a max age the nonce is still remembered once it's claimed
+	if err := claimNonce(ctx, s, p, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := claimNonce(ctx, s, p, 0); !errors.Is(err, ErrInvalidPayload) || !errors.Is(err, ErrButtonUsed) {
+		t.Errorf("replay got %v, want ErrInvalidPayload and ErrButtonUsed", err)
+	}
+	// Claiming another nonce later on doesn't forget it while it's within the retention
+	now = func() time.Time { return issued.Add(minNonceRetention - time.Minute) }
+	if err := claimNonce(ctx, s, &ButtonPayload{Nonce: "b", IssuedAt: issued.Unix()}, 0); err != nil {
+		t.Errorf("a different nonce got %v", err)
+	}
+	if err := claimNonce(ctx, s, p, 0); !errors.Is(err, ErrButtonUsed) {
+		t.Errorf("replay within the retention got %v, want ErrButtonUsed", err)
+	}
+	// A max age longer than the retention keeps it for the max age
+	long := &ButtonPayload{Nonce: "c", IssuedAt: issued.Unix()}
+	if err := claimNonce(ctx, s, long, 2*minNonceRetention); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now = func() time.Time { return issued.Add(minNonceRetention + time.Hour) }
+	if err := claimNonce(ctx, s, long, 2*minNonceRetention); !errors.Is(err, ErrButtonUsed) {
+		t.Errorf("replay within the max age got %v, want ErrButtonUsed", err)
+	}
+	ReleaseApproval(ctx, s, &EscalationApproval{Nonce: "a"})
+	if err := claimNonce(ctx, s, p, 0); err != nil {
+		t.Errorf("released nonce got %v", err)
+	}
+}
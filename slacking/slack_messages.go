@@ -1,8 +1,10 @@
 package slacking
 
 import (
-	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/seslattery/gcpsudobot/config"
 	. "github.com/seslattery/gcpsudobot/types"
@@ -13,140 +15,398 @@ import (
 const (
 	ApprovalButtonID = "apprv-id"
 	DenialButtonID   = "dny-id"
+	RevokeButtonID   = "rvk-id"
+	ExtendButtonID   = "xtnd-id"
 	ResourceActionID = "resourcez"
 	RoleActionID     = "rolez"
 	ReasonActionID   = "reasonz"
 	ResourceBlockID  = "gcp_resource"
 	RoleBlockID      = "gcp_role"
 	ReasonBlockID    = "gcp_reason"
+	// Only shown when a rule inherits or has patterns, so values that can't be listed can be typed in
+	RoleTextActionID     = "roletextz"
+	RoleTextBlockID      = "gcp_role_text"
+	ResourceTextActionID = "resourcetextz"
+	ResourceTextBlockID  = "gcp_resource_text"
+	DurationActionID     = "durationz"
+	DurationBlockID      = "gcp_duration"
+	// Set on the modal for extending a grant, so its submission can be told apart from a new request
+	ExtensionCallbackID = "extend_grant"
 )
 
+// The durations offered in the modal, longer ones are left out when no rule allows them
+var durationChoices = []time.Duration{
+	15 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	2 * time.Hour,
+	4 * time.Hour,
+	8 * time.Hour,
+	12 * time.Hour,
+	24 * time.Hour,
+}
+
 // slash command goes to function handler
 
 func GenerateModalRequest(p *PolicyRules) slack.ModalViewRequest {
 	_, roles, resources := p.ListOptions()
-	roleOpts := createOptionBlockObjects(roles)
-	resourceOpts := createOptionBlockObjects(resources)
+	rolePatterns, resourcePatterns := p.ListPatterns()
+	roleSelect := &slack.SelectBlockElement{
+		Type:     slack.OptTypeStatic,
+		ActionID: RoleActionID,
+		Options:  createOptionBlockObjects(roles),
+	}
+	resourceSelect := &slack.SelectBlockElement{
+		Type:         slack.OptTypeStatic,
+		ActionID:     ResourceActionID,
+		OptionGroups: createResourceOptionGroups(resources),
+	}
+
+	blocks := []slack.Block{
+		&slack.SectionBlock{
+			Type: slack.MBTSection,
+			Text: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Please fill in the following info"},
+		},
+		&slack.InputBlock{
+			Type:    slack.MBTInput,
+			BlockID: ReasonBlockID,
+			Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Reason"},
+			Element: &slack.PlainTextInputBlockElement{
+				Type:        slack.METPlainTextInput,
+				ActionID:    ReasonActionID,
+				Placeholder: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Enter the reason for the request"},
+			},
+		},
+	}
+	blocks = append(blocks, selectOrTextInputs("Role", RoleBlockID, roleSelect, len(roles) > 0,
+		RoleTextBlockID, RoleTextActionID, roleHint(rolePatterns))...)
+	blocks = append(blocks, selectOrTextInputs("Resource", ResourceBlockID, resourceSelect, len(resources) > 0,
+		ResourceTextBlockID, ResourceTextActionID, resourceHint(p.Inherits(), resourcePatterns))...)
+	blocks = append(blocks, &slack.InputBlock{
+		Type:    slack.MBTInput,
+		BlockID: DurationBlockID,
+		Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Duration"},
+		Hint:    &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Leave empty for the rule's default, durations longer than the rule allows are denied"},
+		Element: &slack.SelectBlockElement{
+			Type:        slack.OptTypeStatic,
+			ActionID:    DurationActionID,
+			Placeholder: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Rule default"},
+			Options:     createDurationOptions(p),
+		},
+		Optional: true,
+	})
 
 	return slack.ModalViewRequest{
 		Type:   slack.ViewType("modal"),
 		Title:  &slack.TextBlockObject{Type: slack.PlainTextType, Text: "IAM Escalation Request"},
 		Close:  &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Close"},
 		Submit: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Submit"},
-		Blocks: slack.Blocks{
-			BlockSet: []slack.Block{
-				&slack.SectionBlock{
-					Type: slack.MBTSection,
-					Text: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Please fill in the following info"},
-				},
-				&slack.InputBlock{
-					Type:    slack.MBTInput,
-					BlockID: ReasonBlockID,
-					Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Reason"},
-					Element: &slack.PlainTextInputBlockElement{
-						Type:        slack.METPlainTextInput,
-						ActionID:    ReasonActionID,
-						Placeholder: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Enter the reason for the request"},
-					},
-				},
-				&slack.InputBlock{
-					Type:    slack.MBTInput,
-					BlockID: RoleBlockID,
-					Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Role"},
-					Element: &slack.SelectBlockElement{
-						Type:     slack.OptTypeStatic,
-						ActionID: RoleActionID,
-						Options:  roleOpts,
-					},
-				},
-				&slack.InputBlock{
-					Type:    slack.MBTInput,
-					BlockID: ResourceBlockID,
-					Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Resource"},
-					Element: &slack.SelectBlockElement{
-						Type:     slack.OptTypeStatic,
-						ActionID: ResourceActionID,
-						Options:  resourceOpts,
-					},
-				},
+		Blocks: slack.Blocks{BlockSet: blocks},
+	}
+}
+
+// GenerateExtensionModalRequest asks for the reason and how much longer the grant is needed.
+// The modal carries the ID of the request being extended, slack doesn't let the user change it.
+func GenerateExtensionModalRequest(p *PolicyRules, original *EscalationApproval) slack.ModalViewRequest {
+	blocks := []slack.Block{
+		&slack.SectionBlock{
+			Type: slack.MBTSection,
+			Text: &slack.TextBlockObject{Type: slack.MarkdownType, Text: fmt.Sprintf("Extend *%s* on *%s*, currently granted until %s.", original.Role, original.Resource, formatTime(original.Expiry))},
+		},
+		&slack.InputBlock{
+			Type:    slack.MBTInput,
+			BlockID: ReasonBlockID,
+			Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Reason"},
+			Element: &slack.PlainTextInputBlockElement{
+				Type:        slack.METPlainTextInput,
+				ActionID:    ReasonActionID,
+				Placeholder: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Enter why the grant needs to be extended"},
+			},
+		},
+		&slack.InputBlock{
+			Type:    slack.MBTInput,
+			BlockID: DurationBlockID,
+			Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Extend by"},
+			Hint:    &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Added on to the current expiry. Leave empty for the rule's default, extensions past the rule's total duration are denied"},
+			Element: &slack.SelectBlockElement{
+				Type:        slack.OptTypeStatic,
+				ActionID:    DurationActionID,
+				Placeholder: &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Rule default"},
+				Options:     createDurationOptions(p),
 			},
+			Optional: true,
+		},
+	}
+	return slack.ModalViewRequest{
+		Type:            slack.ViewType("modal"),
+		Title:           &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Extend IAM Grant"},
+		Close:           &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Close"},
+		Submit:          &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Submit"},
+		Blocks:          slack.Blocks{BlockSet: blocks},
+		CallbackID:      ExtensionCallbackID,
+		PrivateMetadata: original.ID,
+	}
+}
+
+// selectOrTextInputs builds the select for the listed options, plus a text input when a hint says what else can be typed in.
+// With both, either can be filled in, the parser prefers the text input.
+// Slack won't show a select without options, so in that case only the required text input is shown.
+func selectOrTextInputs(label, selectBlockID string, sel *slack.SelectBlockElement, hasOptions bool, textBlockID, textActionID, hint string) []slack.Block {
+	if hint == "" {
+		return []slack.Block{&slack.InputBlock{
+			Type:    slack.MBTInput,
+			BlockID: selectBlockID,
+			Label:   &slack.TextBlockObject{Type: slack.PlainTextType, Text: label},
+			Element: sel,
+		}}
+	}
+	var blocks []slack.Block
+	textLabel := label
+	if hasOptions {
+		blocks = append(blocks, &slack.InputBlock{
+			Type:     slack.MBTInput,
+			BlockID:  selectBlockID,
+			Label:    &slack.TextBlockObject{Type: slack.PlainTextType, Text: label},
+			Element:  sel,
+			Optional: true,
+		})
+		textLabel = fmt.Sprintf("Or enter a %s", strings.ToLower(label))
+	}
+	return append(blocks, &slack.InputBlock{
+		Type:     slack.MBTInput,
+		BlockID:  textBlockID,
+		Label:    &slack.TextBlockObject{Type: slack.PlainTextType, Text: textLabel},
+		Hint:     &slack.TextBlockObject{Type: slack.PlainTextType, Text: hint},
+		Optional: hasOptions,
+		Element: &slack.PlainTextInputBlockElement{
+			Type:     slack.METPlainTextInput,
+			ActionID: textActionID,
 		},
+	})
+}
+
+func roleHint(patterns map[string]struct{}) string {
+	if len(patterns) == 0 {
+		return ""
 	}
+	return fmt.Sprintf("A role matching one of: %s", strings.Join(sortedKeys(patterns), ", "))
 }
 
-func GenerateSlackEscalationRequestMessageFromModal(r *EscalationRequest) ([]slack.Block, error) {
-	// TODO: better default values / This is where the shift from a EscalationRequest to an EscalationApproval happens
-	a := &EscalationApproval{
-		r,
-		"default",
-		Denied,
+func resourceHint(inherits bool, patterns map[string]struct{}) string {
+	var hints []string
+	if inherits {
+		hints = append(hints, "A folder or project beneath one of the listed resources, e.g. projects/my-project or folders/1234.")
+	}
+	if len(patterns) > 0 {
+		hints = append(hints, fmt.Sprintf("A resource matching one of: %s", strings.Join(sortedKeys(patterns), ", ")))
+	}
+	return strings.Join(hints, " ")
+}
+
+// GenerateSlackEscalationRequestMessage builds the message with the Approve and Deny buttons.
+// When approvals have been recorded, it's updated in place to show them. The buttons only carry the request's ID.
+func GenerateSlackEscalationRequestMessage(a *EscalationApproval) ([]slack.Block, error) {
+	r := a.EscalationRequest
+	if r.ID == "" {
+		return nil, fmt.Errorf("request hasn't been saved, it has no id")
+	}
+	// Both buttons share a nonce, so once either is used the other can't be
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, fmt.Errorf("can't generate nonce: %v", err)
 	}
+	payload := &ButtonPayload{RequestID: r.ID, ActionID: DenialButtonID, Status: Denied, Nonce: nonce, IssuedAt: now().Unix()}
 	// Approve and Deny Buttons
-	denialPayload, err := json.Marshal(&a)
+	denialPayload, err := signPayload(payload)
 	if err != nil {
-		return nil, fmt.Errorf("can't marshal json: %v", err)
+		return nil, err
 	}
 	denyBtn := &slack.ButtonBlockElement{
 		Type:     slack.METButton,
 		ActionID: DenialButtonID,
-		Value:    string(denialPayload),
+		Value:    denialPayload,
 		Text:     &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Deny"},
 	}
 
-	a.Status = Approved
-	approvalPayload, err := json.Marshal(&a)
+	payload.ActionID = ApprovalButtonID
+	payload.Status = Approved
+	approvalPayload, err := signPayload(payload)
 	if err != nil {
-		return nil, fmt.Errorf("can't marshal json: %v", err)
+		return nil, err
 	}
 
 	approveBtn := &slack.ButtonBlockElement{
 		Type:     slack.METButton,
 		ActionID: ApprovalButtonID,
-		Value:    string(approvalPayload),
+		Value:    approvalPayload,
 		Text:     &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Approve"},
 	}
 	approveBtn.WithStyle("danger")
 	actionBlock := slack.NewActionBlock("", approveBtn, denyBtn)
 
-	return []slack.Block{
+	header := "There is a new authentication request to escalate GCP privileges"
+	if r.IsExtension() {
+		header = "There is a request to extend a grant of GCP privileges"
+	}
+	blocks := []slack.Block{
 		&slack.SectionBlock{
 			Type: slack.MBTSection,
-			Text: &slack.TextBlockObject{Type: slack.MarkdownType, Text: "There is a new authentication request to escalate GCP privileges"},
+			Text: &slack.TextBlockObject{Type: slack.MarkdownType, Text: header},
 		},
 		&slack.SectionBlock{
 			Type: slack.MBTSection,
-			Fields: []*slack.TextBlockObject{
+			Fields: append([]*slack.TextBlockObject{
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*User:*\n%s", r.Requestor)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Role:*\n%s", r.Role)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Resource:*\n%s", r.Resource)},
+				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Duration:*\n%s", r.Duration)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*When:*\n%s", r.Timestamp)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Reason:*\n%s", r.Reason)},
-			},
+			}, extensionFields(r)...),
 			Accessory: nil,
 		},
-		actionBlock,
-	}, nil
+	}
+	if len(a.Approvals) > 0 {
+		blocks = append(blocks, &slack.SectionBlock{
+			Type: slack.MBTSection,
+			Fields: []*slack.TextBlockObject{
+				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Approved by:*\n%s", strings.Join(a.Approvals, "\n"))},
+				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Approvals still needed:*\n%d", a.ApprovalsRemaining)},
+			},
+		})
+	}
+	return append(blocks, actionBlock), nil
 }
 
-func GenerateSlackEscalationResponseMessage(r *EscalationApproval) []slack.Block {
-	return []slack.Block{
+// GenerateSlackEscalationResponseMessage shows how the request was decided, with Revoke and Extend buttons while the grant is active
+func GenerateSlackEscalationResponseMessage(r *EscalationApproval) ([]slack.Block, error) {
+	blocks := []slack.Block{
 		&slack.SectionBlock{
 			Type: slack.MBTSection,
-			Text: &slack.TextBlockObject{Type: slack.MarkdownType, Text: r.Status.ApprovalText(config.Cfg.DurationOfGrantInHours)},
+			Text: &slack.TextBlockObject{Type: slack.MarkdownType, Text: stateText(r)},
 		},
 		&slack.SectionBlock{
 			Type: slack.MBTSection,
-			Fields: []*slack.TextBlockObject{
+			Fields: append([]*slack.TextBlockObject{
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*User:*\n%s", r.Requestor)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Role:*\n%s", r.Role)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Resource:*\n%s", r.Resource)},
+				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Duration:*\n%s", r.Duration)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*When:*\n%s", r.Timestamp)},
 				{Type: slack.MarkdownType, Text: fmt.Sprintf("*Reason:*\n%s", r.Reason)},
-				{Type: slack.MarkdownType, Text: fmt.Sprintf("*%s:*\n%s", r.Status.String(), r.Approver)},
-			},
+				{Type: slack.MarkdownType, Text: fmt.Sprintf("*%s:*\n%s", r.Status.String(), approvers(r))},
+			}, extensionFields(r.EscalationRequest)...),
 			Accessory: nil,
 		},
 	}
+	if r.State != StateActive || r.ID == "" {
+		return blocks, nil
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, fmt.Errorf("can't generate nonce: %v", err)
+	}
+	payload := &ButtonPayload{RequestID: r.ID, ActionID: RevokeButtonID, Status: Approved, Nonce: nonce, IssuedAt: now().Unix()}
+	revokePayload, err := signPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	revokeBtn := &slack.ButtonBlockElement{
+		Type:     slack.METButton,
+		ActionID: RevokeButtonID,
+		Value:    revokePayload,
+		Text:     &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Revoke now"},
+	}
+	// The Extend button only opens a modal, its nonce is released once it has, so it shares the Revoke button's
+	payload.ActionID = ExtendButtonID
+	extendPayload, err := signPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	extendBtn := &slack.ButtonBlockElement{
+		Type:     slack.METButton,
+		ActionID: ExtendButtonID,
+		Value:    extendPayload,
+		Text:     &slack.TextBlockObject{Type: slack.PlainTextType, Text: "Extend"},
+	}
+	return append(blocks, slack.NewActionBlock("", revokeBtn, extendBtn)), nil
+}
+
+// extensionFields shows when the grant an extension extends currently expires
+func extensionFields(r *EscalationRequest) []*slack.TextBlockObject {
+	if !r.IsExtension() {
+		return nil
+	}
+	return []*slack.TextBlockObject{
+		{Type: slack.MarkdownType, Text: fmt.Sprintf("*Extends the grant until:*\n%s", formatTime(r.ExtendsExpiry))},
+	}
+}
+
+// GenerateSlackAutoApprovalMessage lets the channel know about a request that was granted without anyone approving it
+func GenerateSlackAutoApprovalMessage(r *EscalationApproval) ([]slack.Block, error) {
+	fyi := &slack.SectionBlock{
+		Type: slack.MBTSection,
+		Text: &slack.TextBlockObject{Type: slack.MarkdownType, Text: "FYI, this request was approved automatically, the rule for this role and resource doesn't need an approver."},
+	}
+	blocks, err := GenerateSlackEscalationResponseMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	return append([]slack.Block{fyi}, blocks...), nil
+}
+
+// stateText describes where the request ended up, requests from before the lifecycle only have their status
+func stateText(r *EscalationApproval) string {
+	switch r.State {
+	case StateFailed:
+		return fmt.Sprintf("Approved, but the role couldn't be granted: %s", lastNote(r))
+	case StateExpired:
+		if r.Expiry == "" {
+			return "The request expired before it was approved."
+		}
+		return fmt.Sprintf("The grant expired at %s.", formatTime(r.Expiry))
+	case StateCancelled:
+		return "The request has been cancelled."
+	case StateExtended:
+		return fmt.Sprintf("The grant was extended until %s.", formatTime(r.Expiry))
+	case StateActive:
+		if lastNote(r) == NoteGrantNotVisible {
+			return fmt.Sprintf("Approved and granted until %s, but the grant isn't visible in the IAM policy yet. IAM can take a few minutes to propagate, so it may not work straight away.", formatTime(r.Expiry))
+		}
+		if r.IsExtension() {
+			return fmt.Sprintf("Approved. The grant has been extended until %s.", formatTime(r.Expiry))
+		}
+		return r.Status.ApprovalText(formatTime(r.Expiry))
+	case StateRevoked:
+		last := r.History[len(r.History)-1]
+		return fmt.Sprintf("Revoked by %s at %s.", last.Actor, formatTime(last.At.Format(time.RFC3339)))
+	default:
+		return r.Status.ApprovalText(formatTime(r.Expiry))
+	}
+}
+
+func lastNote(r *EscalationApproval) string {
+	if len(r.History) == 0 {
+		return ""
+	}
+	return r.History[len(r.History)-1].Note
+}
+
+// approvers lists everyone who approved a granted request, or just the approver that denied it
+func approvers(r *EscalationApproval) string {
+	if r.Status == Approved && len(r.Approvals) > 1 {
+		return strings.Join(r.Approvals, "\n")
+	}
+	return r.Approver
+}
+
+// formatTime shows an RFC3339 timestamp in each viewer's own timezone, falling back to the timestamp itself for clients that can't
+func formatTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return fmt.Sprintf("<!date^%d^{date_short_pretty} at {time}|%s>", t.Unix(), timestamp)
 }
 
 func TextToBlock(text string) []slack.Block {
@@ -160,12 +420,88 @@ func TextToBlock(text string) []slack.Block {
 	return blocks
 }
 
+// createDurationOptions offers the standard durations up to the longest any rule allows, along with each rule's own durations
+func createDurationOptions(p *PolicyRules) []*slack.OptionBlockObject {
+	fallback := config.Cfg.DefaultGrantDuration()
+	longest := fallback
+	durations := map[time.Duration]struct{}{fallback: {}}
+	for _, pol := range p.PolicyRules {
+		longest = max(longest, pol.GrantMaxDuration(fallback))
+		durations[pol.GrantMaxDuration(fallback)] = struct{}{}
+		durations[pol.GrantDefaultDuration(fallback)] = struct{}{}
+	}
+	for _, d := range durationChoices {
+		if d <= longest {
+			durations[d] = struct{}{}
+		}
+	}
+	sorted := make([]time.Duration, 0, len(durations))
+	for d := range durations {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	options := make([]*slack.OptionBlockObject, 0, len(sorted))
+	for _, d := range sorted {
+		text := slack.NewTextBlockObject(slack.PlainTextType, Duration(d).String(), false, false)
+		options = append(options, slack.NewOptionBlockObject(Duration(d).String(), text, nil))
+	}
+	return options
+}
+
+// The order resource types are shown in the modal, from the top of the hierarchy down
+var resourceTypeLabels = []struct {
+	prefix string
+	label  string
+}{
+	{"organizations/", "Organizations"},
+	{"folders/", "Folders"},
+	{"projects/", "Projects"},
+}
+
+// createResourceOptionGroups groups the resources by their type, so folders and projects are easy to tell apart
+func createResourceOptionGroups(resources map[string]struct{}) []*slack.OptionGroupBlockObject {
+	var groups []*slack.OptionGroupBlockObject
+	remaining := make(map[string]struct{}, len(resources))
+	for r := range resources {
+		remaining[r] = struct{}{}
+	}
+	for _, t := range resourceTypeLabels {
+		matching := make(map[string]struct{})
+		for r := range remaining {
+			if strings.HasPrefix(r, t.prefix) {
+				matching[r] = struct{}{}
+				delete(remaining, r)
+			}
+		}
+		if len(matching) == 0 {
+			continue
+		}
+		label := slack.NewTextBlockObject(slack.PlainTextType, t.label, false, false)
+		groups = append(groups, slack.NewOptionGroupBlockElement(label, createOptionBlockObjects(matching)...))
+	}
+	if len(remaining) > 0 {
+		label := slack.NewTextBlockObject(slack.PlainTextType, "Other", false, false)
+		groups = append(groups, slack.NewOptionGroupBlockElement(label, createOptionBlockObjects(remaining)...))
+	}
+	return groups
+}
+
 func createOptionBlockObjects(options map[string]struct{}) []*slack.OptionBlockObject {
 	optionBlockObjects := make([]*slack.OptionBlockObject, 0, len(options))
-	for o := range options {
+	// sorted so the options are in a stable order every time the modal is opened
+	for _, o := range sortedKeys(options) {
 		optionText := slack.NewTextBlockObject(slack.PlainTextType, o, false, false)
 		descriptionText := slack.NewTextBlockObject(slack.PlainTextType, o, false, false)
 		optionBlockObjects = append(optionBlockObjects, slack.NewOptionBlockObject(o, optionText, descriptionText))
 	}
 	return optionBlockObjects
 }
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
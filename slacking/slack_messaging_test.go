@@ -2,9 +2,12 @@ package slacking
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
-	. "gcpsudobot/types"
+	"github.com/seslattery/gcpsudobot/config"
+	. "github.com/seslattery/gcpsudobot/types"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/slack-go/slack"
@@ -27,18 +30,32 @@ var TestSlackPolicy = &PolicyRules{
 }
 
 // TODO: This is bit brittle, but ensures slack format isn't changing unneccesarily
-func TestGenerateSlackEscalationRequestMessageFromModal(t *testing.T) {
-	t.Run("GenerateSlackEscalationRequestMessageFromModal", func(t *testing.T) {
-		blockString := `[{"type":"section","text":{"type":"mrkdwn","text":"There is a new authentication request to escalate GCP privileges"}},{"type":"section","fields":[{"type":"mrkdwn","text":"*User:*\ntest@example.io"},{"type":"mrkdwn","text":"*Role:*\norganizations/0000000000/roles/on_call_elevated"},{"type":"mrkdwn","text":"*Resource:*\norganizations/0000000000"},{"type":"mrkdwn","text":"*When:*\n100"},{"type":"mrkdwn","text":"*Reason:*\ntesting"}]},{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Approve"},"action_id":"apprv-id","value":"{\"requestor\":\"test@example.io\",\"groups\":{\"on-call@example.io\":{},\"testing@example.io\":{}},\"role\":\"organizations/0000000000/roles/on_call_elevated\",\"resource\":\"organizations/0000000000\",\"reason\":\"testing\",\"timestamp\":\"100\",\"approver\":\"default\",\"status\":true}","style":"danger"},{"type":"button","text":{"type":"plain_text","text":"Deny"},"action_id":"dny-id","value":"{\"requestor\":\"test@example.io\",\"groups\":{\"on-call@example.io\":{},\"testing@example.io\":{}},\"role\":\"organizations/0000000000/roles/on_call_elevated\",\"resource\":\"organizations/0000000000\",\"reason\":\"testing\",\"timestamp\":\"100\",\"approver\":\"default\",\"status\":false}"}]}]`
+// testSigning signs the approval payloads with a fixed key, nonce and time so the button values can be compared
+func testSigning(t *testing.T) {
+	key, origNow, origNonce := config.Cfg.PayloadSigningKey, now, newNonce
+	t.Cleanup(func() {
+		config.Cfg.PayloadSigningKey, now, newNonce = key, origNow, origNonce
+	})
+	config.Cfg.PayloadSigningKey = "test-signing-key"
+	now = func() time.Time { return time.Unix(1714262400, 0) }
+	newNonce = func() (string, error) { return "0123456789abcdef", nil }
+}
+
+func TestGenerateSlackEscalationRequestMessageForNewRequest(t *testing.T) {
+	testSigning(t)
+	t.Run("new request", func(t *testing.T) {
+		blockString := `[{"type":"section","text":{"type":"mrkdwn","text":"There is a new authentication request to escalate GCP privileges"}},{"type":"section","fields":[{"type":"mrkdwn","text":"*User:*\ntest@example.io"},{"type":"mrkdwn","text":"*Role:*\norganizations/0000000000/roles/on_call_elevated"},{"type":"mrkdwn","text":"*Resource:*\norganizations/0000000000"},{"type":"mrkdwn","text":"*Duration:*\n2h"},{"type":"mrkdwn","text":"*When:*\n100"},{"type":"mrkdwn","text":"*Reason:*\ntesting"}]},{"type":"actions","elements":[{"type":"button","text":{"type":"plain_text","text":"Approve"},"action_id":"apprv-id","value":"3z05vML4MbQvF4z0vb9Hgxd3n81mDP1yC95BA5DnF4o.{\"request_id\":\"0123456789abcdef0123456789abcdef\",\"action_id\":\"apprv-id\",\"status\":true,\"nonce\":\"0123456789abcdef\",\"issued_at\":1714262400}","style":"danger"},{"type":"button","text":{"type":"plain_text","text":"Deny"},"action_id":"dny-id","value":"5Wvi1kl_u2nDmxcPgpvPVswW1CvQMEN2rjH_Qmfd3ko.{\"request_id\":\"0123456789abcdef0123456789abcdef\",\"action_id\":\"dny-id\",\"status\":false,\"nonce\":\"0123456789abcdef\",\"issued_at\":1714262400}"}]}]`
 		r := &EscalationRequest{
+			ID:        "0123456789abcdef0123456789abcdef",
 			Requestor: "test@example.io",
 			Groups:    map[Group]struct{}{"on-call@example.io": {}, "testing@example.io": {}},
 			Role:      "organizations/0000000000/roles/on_call_elevated",
 			Resource:  "organizations/0000000000",
 			Reason:    "testing",
 			Timestamp: "100",
+			Duration:  Duration(2 * time.Hour),
 		}
-		got, err := GenerateSlackEscalationRequestMessageFromModal(r)
+		got, err := GenerateSlackEscalationRequestMessage(NewEscalationApproval(r, now()))
 		if err != nil {
 			t.Fatalf("handler failed: %v", err)
 		}
@@ -62,16 +79,17 @@ func TestGenerateSlackEscalationResponseMessage(t *testing.T) {
 	}{
 		{"Deny",
 			&EscalationApproval{
-				&EscalationRequest{
+				EscalationRequest: &EscalationRequest{
 					Requestor: "test@example.io",
 					Groups:    map[Group]struct{}{"on-call@example.io": struct{}{}},
 					Role:      "organizations/0000000000/roles/on_call_elevated",
 					Resource:  "organizations/0000000000",
 					Reason:    "testing",
 					Timestamp: "",
+					Duration:  Duration(2 * time.Hour),
 				},
-				"test-approver@example.io",
-				Denied,
+				Approver: "test-approver@example.io",
+				Status:   Denied,
 			},
 			[]slack.Block{
 				&slack.SectionBlock{Type: "section", Text: &slack.TextBlockObject{Type: "mrkdwn", Text: "The Request has been denied."}},
@@ -83,6 +101,7 @@ func TestGenerateSlackEscalationResponseMessage(t *testing.T) {
 						{Type: "mrkdwn", Text: "*User:*\ntest@example.io"},
 						{Type: "mrkdwn", Text: "*Role:*\norganizations/0000000000/roles/on_call_elevated"},
 						{Type: "mrkdwn", Text: "*Resource:*\norganizations/0000000000"},
+						{Type: "mrkdwn", Text: "*Duration:*\n2h"},
 						{Type: "mrkdwn", Text: "*When:*\n"},
 						{Type: "mrkdwn", Text: "*Reason:*\ntesting"},
 						{Type: "mrkdwn", Text: "*Denier:*\ntest-approver@example.io"},
@@ -92,19 +111,21 @@ func TestGenerateSlackEscalationResponseMessage(t *testing.T) {
 			},
 		},
 		{"Approve", &EscalationApproval{
-			&EscalationRequest{
+			EscalationRequest: &EscalationRequest{
 				Requestor: "test@example.io",
 				Groups:    make(map[Group]struct{}),
 				Role:      "organizations/0000000000/roles/on_call_elevated",
 				Resource:  "organizations/0000000000",
 				Reason:    "testing",
 				Timestamp: "",
+				Duration:  Duration(90 * time.Minute),
 			},
-			"test-approver@example.io",
-			Approved,
+			Approver: "test-approver@example.io",
+			Status:   Approved,
+			Expiry:   "2024-04-28T01:30:00Z",
 		},
 			[]slack.Block{
-				&slack.SectionBlock{Type: "section", Text: &slack.TextBlockObject{Type: "mrkdwn", Text: "Approved. The role has been granted for 2 hours."}},
+				&slack.SectionBlock{Type: "section", Text: &slack.TextBlockObject{Type: "mrkdwn", Text: "Approved. The role has been granted until <!date^1714267800^{date_short_pretty} at {time}|2024-04-28T01:30:00Z>."}},
 				&slack.SectionBlock{
 					Type:    "section",
 					Text:    nil,
@@ -113,6 +134,7 @@ func TestGenerateSlackEscalationResponseMessage(t *testing.T) {
 						{Type: "mrkdwn", Text: "*User:*\ntest@example.io"},
 						{Type: "mrkdwn", Text: "*Role:*\norganizations/0000000000/roles/on_call_elevated"},
 						{Type: "mrkdwn", Text: "*Resource:*\norganizations/0000000000"},
+						{Type: "mrkdwn", Text: "*Duration:*\n1h30m"},
 						{Type: "mrkdwn", Text: "*When:*\n"},
 						{Type: "mrkdwn", Text: "*Reason:*\ntesting"},
 						{Type: "mrkdwn", Text: "*Approver:*\ntest-approver@example.io"},
@@ -125,7 +147,10 @@ func TestGenerateSlackEscalationResponseMessage(t *testing.T) {
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
-			got := GenerateSlackEscalationResponseMessage(tt.input)
+			got, err := GenerateSlackEscalationResponseMessage(tt.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 			if diff := cmp.Diff(got, tt.expected); diff != "" {
 				t.Errorf("diff: %v", diff)
 			}
@@ -201,20 +226,79 @@ func TestGenerateModal(t *testing.T) {
       "element": {
         "type": "static_select",
         "action_id": "resourcez",
+        "option_groups": [
+          {
+            "label": {
+              "type": "plain_text",
+              "text": "Organizations"
+            },
+            "options": [
+              {
+                "text": {
+                  "type": "plain_text",
+                  "text": "organizations/baz"
+                },
+                "value": "organizations/baz",
+                "description": {
+                  "type": "plain_text",
+                  "text": "organizations/baz"
+                }
+              }
+            ]
+          }
+        ]
+      }
+    },
+    {
+      "type": "input",
+      "block_id": "gcp_duration",
+      "label": {
+        "type": "plain_text",
+        "text": "Duration"
+      },
+      "element": {
+        "type": "static_select",
+        "placeholder": {
+          "type": "plain_text",
+          "text": "Rule default"
+        },
+        "action_id": "durationz",
         "options": [
           {
             "text": {
               "type": "plain_text",
-              "text": "organizations/baz"
+              "text": "15m"
             },
-            "value": "organizations/baz",
-            "description": {
+            "value": "15m"
+          },
+          {
+            "text": {
               "type": "plain_text",
-              "text": "organizations/baz"
-            }
+              "text": "30m"
+            },
+            "value": "30m"
+          },
+          {
+            "text": {
+              "type": "plain_text",
+              "text": "1h"
+            },
+            "value": "1h"
+          },
+          {
+            "text": {
+              "type": "plain_text",
+              "text": "2h"
+            },
+            "value": "2h"
           }
         ]
-      }
+      },
+      "hint": {
+        "type": "plain_text",
+        "text": "Leave empty for the rule's default, durations longer than the rule allows are denied"
+      },
+      "optional": true
     }
   ],
   "close": {
@@ -236,3 +320,244 @@ func TestGenerateModal(t *testing.T) {
 		}
 	})
 }
+
+func TestCreateResourceOptionGroups(t *testing.T) {
+	t.Run("groups resources by type", func(t *testing.T) {
+		resources := map[string]struct{}{
+			"projects/testing":         {},
+			"folders/1234":             {},
+			"organizations/0000000000": {},
+			"projects/another":         {},
+		}
+		got := createResourceOptionGroups(resources)
+		want := map[string][]string{
+			"Organizations": {"organizations/0000000000"},
+			"Folders":       {"folders/1234"},
+			"Projects":      {"projects/another", "projects/testing"},
+		}
+		wantOrder := []string{"Organizations", "Folders", "Projects"}
+		if len(got) != len(wantOrder) {
+			t.Fatalf("got %d groups, want %d", len(got), len(wantOrder))
+		}
+		for i, g := range got {
+			if g.Label.Text != wantOrder[i] {
+				t.Errorf("got group %s, want %s", g.Label.Text, wantOrder[i])
+			}
+			var values []string
+			for _, o := range g.Options {
+				values = append(values, o.Value)
+			}
+			if diff := cmp.Diff(values, want[g.Label.Text]); diff != "" {
+				t.Errorf("diff: %v", diff)
+			}
+		}
+	})
+}
+
+func TestGenerateModalInherit(t *testing.T) {
+	t.Run("inheriting rules allow a resource to be typed in", func(t *testing.T) {
+		p := &PolicyRules{PolicyRules: []Rule{{
+			Groups:    map[Group]struct{}{"foo@gmail.com": {}},
+			Roles:     map[Role]struct{}{"roles/bar": {}},
+			Resources: map[Resource]struct{}{"organizations/baz": {}},
+			Inherit:   true,
+		}}}
+		blocks := GenerateModalRequest(p).Blocks.BlockSet
+		var resourceSelect, resourceText *slack.InputBlock
+		for _, b := range blocks {
+			if ib, ok := b.(*slack.InputBlock); ok {
+				switch ib.BlockID {
+				case ResourceBlockID:
+					resourceSelect = ib
+				case ResourceTextBlockID:
+					resourceText = ib
+				}
+			}
+		}
+		if resourceSelect == nil || resourceText == nil {
+			t.Fatalf("missing resource inputs")
+		}
+		if !resourceSelect.Optional || !resourceText.Optional {
+			t.Errorf("both resource inputs should be optional")
+		}
+	})
+}
+
+func TestGenerateModalPatterns(t *testing.T) {
+	t.Run("patterns without options only have a required text input", func(t *testing.T) {
+		p := &PolicyRules{PolicyRules: []Rule{{
+			Groups:    map[Group]struct{}{"foo@gmail.com": {}},
+			Roles:     map[Role]struct{}{"roles/bar": {}},
+			Resources: map[Resource]struct{}{"projects/prod-*": {}},
+		}}}
+		inputs := map[string]*slack.InputBlock{}
+		for _, b := range GenerateModalRequest(p).Blocks.BlockSet {
+			if ib, ok := b.(*slack.InputBlock); ok {
+				inputs[ib.BlockID] = ib
+			}
+		}
+		if _, ok := inputs[ResourceBlockID]; ok {
+			t.Errorf("resource select shouldn't be shown without any options")
+		}
+		text, ok := inputs[ResourceTextBlockID]
+		if !ok {
+			t.Fatalf("missing resource text input")
+		}
+		if text.Optional {
+			t.Errorf("resource text input should be required")
+		}
+		if text.Hint == nil || !strings.Contains(text.Hint.Text, "projects/prod-*") {
+			t.Errorf("hint should list the pattern, got %v", text.Hint)
+		}
+		if _, ok := inputs[RoleTextBlockID]; ok {
+			t.Errorf("role text input shouldn't be shown without role patterns")
+		}
+		if inputs[RoleBlockID].Optional {
+			t.Errorf("role select should be required")
+		}
+	})
+}
+
+func TestGenerateSlackEscalationRequestMessage(t *testing.T) {
+	testSigning(t)
+	t.Run("pending approvals are shown and the buttons carry the request id", func(t *testing.T) {
+		a := &EscalationApproval{
+			EscalationRequest: &EscalationRequest{
+				ID:        "0123456789abcdef0123456789abcdef",
+				Requestor: "test@example.io",
+				Role:      "organizations/0000000000/roles/hub_root",
+				Resource:  "organizations/0000000000",
+				Reason:    "testing",
+				Timestamp: "100",
+				Duration:  Duration(30 * time.Minute),
+			},
+			Approver:           "sre-1@example.io",
+			Status:             Approved,
+			Approvals:          []string{"sre-1@example.io"},
+			ApprovalsRemaining: 1,
+		}
+		blocks, err := GenerateSlackEscalationRequestMessage(a)
+		if err != nil {
+			t.Fatalf("handler failed: %v", err)
+		}
+		if len(blocks) != 4 {
+			t.Fatalf("got %d blocks, want 4", len(blocks))
+		}
+		wantFields := []*slack.TextBlockObject{
+			{Type: "mrkdwn", Text: "*Approved by:*\nsre-1@example.io"},
+			{Type: "mrkdwn", Text: "*Approvals still needed:*\n1"},
+		}
+		if diff := cmp.Diff(blocks[2].(*slack.SectionBlock).Fields, wantFields); diff != "" {
+			t.Errorf("diff: %v", diff)
+		}
+		buttons := blocks[3].(*slack.ActionBlock).Elements.ElementSet
+		for i, wantStatus := range []Approval{Approved, Denied} {
+			got, err := verifyPayload(buttons[i].(*slack.ButtonBlockElement).Value, 0)
+			if err != nil {
+				t.Fatalf("couldn't verify button: %v", err)
+			}
+			if got.Status != wantStatus || got.RequestID != a.ID {
+				t.Errorf("got status %v request %v, want %v %v", got.Status, got.RequestID, wantStatus, a.ID)
+			}
+		}
+		if a.Approver != "sre-1@example.io" || a.Status != Approved {
+			t.Errorf("generating the message shouldn't change the approval")
+		}
+	})
+}
+
+func TestStateText(t *testing.T) {
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	failed := NewEscalationApproval(&EscalationRequest{Requestor: "test@example.io"}, at)
+	failed.Status = Approved
+	failed.TransitionTo(StateFailed, "test-approver@example.io", at, "couldn't set IAM policy: permission denied")
+	expired := NewEscalationApproval(&EscalationRequest{Requestor: "test@example.io"}, at)
+	expired.TransitionTo(StateExpired, "gcpsudobot reaper", at, "")
+	extension := NewEscalationApproval(&EscalationRequest{Requestor: "test@example.io", ExtensionOf: "original"}, at)
+	extension.Status = Approved
+	extension.Expiry = "2024-04-28T01:30:00Z"
+	extension.TransitionTo(StateActive, "test-approver@example.io", at, "")
+	notVisible := NewEscalationApproval(&EscalationRequest{Requestor: "test@example.io"}, at)
+	notVisible.Status = Approved
+	notVisible.Expiry = "2024-04-28T01:30:00Z"
+	notVisible.TransitionTo(StateActive, "test-approver@example.io", at, NoteGrantNotVisible)
+	extended := NewEscalationApproval(&EscalationRequest{Requestor: "test@example.io"}, at)
+	extended.Expiry = "2024-04-28T01:30:00Z"
+	extended.TransitionTo(StateActive, "test-approver@example.io", at, "")
+	extended.TransitionTo(StateExtended, "test-approver@example.io", at, "")
+	tests := []struct {
+		name  string
+		input *EscalationApproval
+		want  string
+	}{
+		{"failed", failed, "Approved, but the role couldn't be granted: couldn't set IAM policy: permission denied"},
+		{"request expired", expired, "The request expired before it was approved."},
+		{"extension granted", extension, "Approved. The grant has been extended until <!date^1714267800^{date_short_pretty} at {time}|2024-04-28T01:30:00Z>."},
+		{"granted but not yet visible", notVisible, "Approved and granted until <!date^1714267800^{date_short_pretty} at {time}|2024-04-28T01:30:00Z>, but the grant isn't visible in the IAM policy yet. IAM can take a few minutes to propagate, so it may not work straight away."},
+		{"extended", extended, "The grant was extended until <!date^1714267800^{date_short_pretty} at {time}|2024-04-28T01:30:00Z>."},
+		{"from before the lifecycle", &EscalationApproval{EscalationRequest: &EscalationRequest{}, Status: Denied}, "The Request has been denied."},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stateText(tt.input); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateSlackEscalationResponseMessageActiveGrant(t *testing.T) {
+	testSigning(t)
+	a := &EscalationApproval{
+		EscalationRequest: &EscalationRequest{
+			ID:            "0123456789abcdef0123456789abcdef",
+			Requestor:     "test@example.io",
+			Role:          "roles/cloudsql.admin",
+			Resource:      "projects/testing",
+			Duration:      Duration(time.Hour),
+			ExtensionOf:   "fedcba9876543210fedcba9876543210",
+			ExtendsExpiry: "2024-04-28T00:30:00Z",
+		},
+		Approver: "test-approver@example.io",
+		Status:   Approved,
+		Expiry:   "2024-04-28T01:30:00Z",
+		State:    StateActive,
+	}
+	blocks, err := GenerateSlackEscalationResponseMessage(a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(blocks))
+	}
+	fields := blocks[1].(*slack.SectionBlock).Fields
+	if got := fields[len(fields)-1].Text; got != "*Extends the grant until:*\n<!date^1714264200^{date_short_pretty} at {time}|2024-04-28T00:30:00Z>" {
+		t.Errorf("got %q, want the expiry of the grant being extended", got)
+	}
+	buttons := blocks[2].(*slack.ActionBlock).Elements.ElementSet
+	for i, wantAction := range []string{RevokeButtonID, ExtendButtonID} {
+		got, err := verifyPayload(buttons[i].(*slack.ButtonBlockElement).Value, 0)
+		if err != nil {
+			t.Fatalf("couldn't verify button: %v", err)
+		}
+		if got.ActionID != wantAction || got.RequestID != a.ID {
+			t.Errorf("got action %v request %v, want %v %v", got.ActionID, got.RequestID, wantAction, a.ID)
+		}
+	}
+}
+
+func TestGenerateExtensionModalRequest(t *testing.T) {
+	original := &EscalationApproval{
+		EscalationRequest: &EscalationRequest{ID: "0123456789abcdef0123456789abcdef", Role: "roles/bar", Resource: "organizations/baz"},
+		Expiry:            "2024-04-28T01:30:00Z",
+	}
+	modal := GenerateExtensionModalRequest(TestSlackPolicy, original)
+	if modal.CallbackID != ExtensionCallbackID || modal.PrivateMetadata != original.ID {
+		t.Errorf("got callback %q metadata %q, want %q %q", modal.CallbackID, modal.PrivateMetadata, ExtensionCallbackID, original.ID)
+	}
+	want := "Extend *roles/bar* on *organizations/baz*, currently granted until <!date^1714267800^{date_short_pretty} at {time}|2024-04-28T01:30:00Z>."
+	if got := modal.Blocks.BlockSet[0].(*slack.SectionBlock).Text.Text; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
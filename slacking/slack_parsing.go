@@ -1,43 +1,255 @@
 package slacking
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/store"
 	. "github.com/seslattery/gcpsudobot/types"
 
 	"github.com/slack-go/slack"
 )
 
-func ParseEscalationRequestFromApproval(api *slack.Client, message slack.InteractionCallback) (*EscalationApproval, error) {
-	var r *EscalationApproval
-	if err := json.Unmarshal([]byte(message.ActionCallback.BlockActions[0].Value), &r); err != nil {
-		return nil, fmt.Errorf("can't unmarshal block action: %v", err)
+// ErrSlackPosture is wrapped with why someone's slack account can't be used to request or approve, so it can be shown to them
+var ErrSlackPosture = errors.New("your slack account can't be used for this")
+
+// UserInfo is the part of the slack client that looks up whoever made a request or clicked a button
+type UserInfo interface {
+	GetUserInfoContext(ctx context.Context, user string) (*slack.User, error)
+}
+
+// IdentityResolver maps the email on a slack account to the google identity it's authorized and granted roles as
+type IdentityResolver interface {
+	Resolve(ctx context.Context, email string) (string, error)
+}
+
+// Users looks up whoever made a request or clicked a button, and who they are in google
+type Users struct {
+	API UserInfo
+	// Optional, the slack email is used as the google identity when it isn't set
+	Identities IdentityResolver
+}
+
+// slackUser looks up a slack user's posture and checks their account meets the requirements, then returns their google identity.
+// Everyone goes through here, so requestors and approvers are compared, authorized and granted roles as the same identities.
+func slackUser(ctx context.Context, users *Users, userID string, want SlackPostureRequirements) (string, SlackPosture, error) {
+	u, err := users.API.GetUserInfoContext(ctx, userID)
+	if err != nil {
+		return "", SlackPosture{}, fmt.Errorf("can't get user info from slack: %v", err)
+	}
+	posture := SlackPosture{
+		UserID:  u.ID,
+		Email:   u.Profile.Email,
+		Guest:   u.IsRestricted || u.IsUltraRestricted,
+		Bot:     u.IsBot,
+		Deleted: u.Deleted,
+		Has2FA:  u.Has2FA,
+	}
+	if problems := want.Problems(posture); len(problems) > 0 {
+		return "", posture, fmt.Errorf("%w: %s", ErrSlackPosture, strings.Join(problems, ", "))
+	}
+	if users.Identities == nil {
+		return u.Profile.Email, posture, nil
 	}
-	approverProfile, err := api.GetUserProfile(&slack.GetUserProfileParameters{
-		UserID:        message.User.ID,
-		IncludeLabels: true,
-	})
+	identity, err := users.Identities.Resolve(ctx, u.Profile.Email)
 	if err != nil {
-		return nil, fmt.Errorf("can't get user info from slack: %v", err)
+		return "", posture, fmt.Errorf("can't resolve the google identity of %s: %v", u.Profile.Email, err)
 	}
-	r.Approver = approverProfile.Email
+	return identity, posture, nil
+}
+
+// recordPosture keeps the posture of someone who made or acted on the request with it
+func recordPosture(r *EscalationRequest, email string, posture SlackPosture) {
+	if r.SlackPostures == nil {
+		r.SlackPostures = make(map[string]SlackPosture)
+	}
+	r.SlackPostures[email] = posture
+}
+
+// ParseEscalationRequestFromApproval verifies the Approve or Deny button that was clicked and loads its request from the store
+func ParseEscalationRequestFromApproval(ctx context.Context, users *Users, s store.RequestStore, message slack.InteractionCallback) (*EscalationApproval, error) {
+	p, r, approver, err := parseButton(ctx, users, s, message, config.Cfg.ApprovalMaxAge(), config.Cfg.EscalationPolicy.ApproverPosture)
+	if err != nil {
+		return nil, err
+	}
+	if p.ActionID != ApprovalButtonID && p.ActionID != DenialButtonID {
+		releaseNonce(ctx, s, p.Nonce)
+		return nil, fmt.Errorf("%w: %s isn't an approval button", ErrInvalidPayload, p.ActionID)
+	}
+	r.Approver = approver
+	r.Status = p.Status
 	return r, nil
 }
 
-func ParseEscalationRequestFromModal(api *slack.Client, message slack.InteractionCallback) (*EscalationRequest, error) {
-	profile, err := api.GetUserProfile(&slack.GetUserProfileParameters{
-		UserID:        message.User.ID,
-		IncludeLabels: true,
-	})
+// ParseEscalationRequestFromRevocation verifies the Revoke button that was clicked, and returns its request along with who clicked it.
+// The button doesn't expire, only an active grant can be revoked.
+func ParseEscalationRequestFromRevocation(ctx context.Context, users *Users, s store.RequestStore, message slack.InteractionCallback) (*EscalationApproval, string, error) {
+	p, r, revoker, err := parseButton(ctx, users, s, message, 0, SlackPostureRequirements{})
+	if err != nil {
+		return nil, "", err
+	}
+	if p.ActionID != RevokeButtonID {
+		releaseNonce(ctx, s, p.Nonce)
+		return nil, "", fmt.Errorf("%w: %s isn't a revoke button", ErrInvalidPayload, p.ActionID)
+	}
+	return r, revoker, nil
+}
+
+// ParseEscalationRequestFromExtension verifies the Extend button that was clicked, and returns its request along with who clicked it.
+// The button only opens the extension modal, so its nonce is released straight away and it can be clicked again.
+func ParseEscalationRequestFromExtension(ctx context.Context, users *Users, s store.RequestStore, message slack.InteractionCallback) (*EscalationApproval, string, error) {
+	p, r, extender, err := parseButton(ctx, users, s, message, 0, config.Cfg.EscalationPolicy.RequestorPosture)
+	if err != nil {
+		return nil, "", err
+	}
+	releaseNonce(ctx, s, p.Nonce)
+	if p.ActionID != ExtendButtonID {
+		return nil, "", fmt.Errorf("%w: %s isn't an extend button", ErrInvalidPayload, p.ActionID)
+	}
+	return r, extender, nil
+}
+
+// ParseExtensionRequestFromModal loads the request being extended from the store, and reads the extension from the modal.
+// The extension only has who asked for it, why and for how long, it has to be linked to the grant before it's authorized.
+func ParseExtensionRequestFromModal(ctx context.Context, users *Users, s store.RequestStore, message slack.InteractionCallback) (*EscalationApproval, *EscalationRequest, error) {
+	original, err := s.Get(ctx, message.View.PrivateMetadata)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't load request: %w", err)
+	}
+	email, posture, err := slackUser(ctx, users, message.User.ID, config.Cfg.EscalationPolicy.RequestorPosture)
+	if err != nil {
+		return nil, nil, err
+	}
+	duration, err := selectedDuration(message.View.State)
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &EscalationRequest{
+		Requestor: Requestor(email),
+		Groups:    make(map[Group]struct{}),
+		Reason:    message.View.State.Values[ReasonBlockID][ReasonActionID].Value,
+		Timestamp: time.Now().Format(time.RFC822),
+		Duration:  Duration(duration),
+	}
+	recordPosture(r, email, posture)
+	return original, r, nil
+}
+
+// ParseRevokeCommand reads `/sudo revoke [request id]`, returning who sent it and the request id if one was given
+func ParseRevokeCommand(ctx context.Context, users *Users, command slack.SlashCommand) (string, string, error) {
+	args := strings.Fields(command.Text)
+	if len(args) == 0 || args[0] != "revoke" || len(args) > 2 {
+		return "", "", fmt.Errorf("usage: /sudo revoke [request id]")
+	}
+	email, _, err := slackUser(ctx, users, command.UserID, SlackPostureRequirements{})
+	if err != nil {
+		return "", "", err
+	}
+	if len(args) == 2 {
+		return email, args[1], nil
+	}
+	return email, "", nil
+}
+
+// ParseCancelCommand reads `/sudo cancel [request id]`, returning who sent it and the request id if one was given
+func ParseCancelCommand(ctx context.Context, users *Users, command slack.SlashCommand) (string, string, error) {
+	args := strings.Fields(command.Text)
+	if len(args) == 0 || args[0] != "cancel" || len(args) > 2 {
+		return "", "", fmt.Errorf("usage: /sudo cancel [request id]")
+	}
+	email, _, err := slackUser(ctx, users, command.UserID, SlackPostureRequirements{})
+	if err != nil {
+		return "", "", err
+	}
+	if len(args) == 2 {
+		return email, args[1], nil
+	}
+	return email, "", nil
+}
+
+// ButtonRequestID verifies the button that was clicked and returns the ID of its request, without claiming its nonce.
+// It's for telling whoever clicked what happened to the request, when the click itself can't be acted on.
+func ButtonRequestID(message slack.InteractionCallback) (string, error) {
+	action, err := clickedButton(message)
+	if err != nil {
+		return "", err
+	}
+	p, err := verifyPayload(action.Value, 0)
+	if err != nil {
+		return "", err
+	}
+	return p.RequestID, nil
+}
+
+// clickedButton is the action of a block_actions callback, slack sends one per click
+func clickedButton(message slack.InteractionCallback) (*slack.BlockAction, error) {
+	if len(message.ActionCallback.BlockActions) == 0 {
+		return nil, fmt.Errorf("%w: no button was clicked", ErrInvalidPayload)
+	}
+	return message.ActionCallback.BlockActions[0], nil
+}
+
+// parseButton verifies the button that was clicked, claims its nonce and loads its request from the store.
+// Along with the payload and the request, it returns the email of whoever clicked it, once their slack account meets want.
+func parseButton(ctx context.Context, users *Users, s store.RequestStore, message slack.InteractionCallback, maxAge time.Duration, want SlackPostureRequirements) (*ButtonPayload, *EscalationApproval, string, error) {
+	action, err := clickedButton(message)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	p, err := verifyPayload(action.Value, maxAge)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if action.ActionID != p.ActionID {
+		return nil, nil, "", fmt.Errorf("%w: the payload is for %s, not the %s button", ErrInvalidPayload, p.ActionID, action.ActionID)
+	}
+	if err := claimNonce(ctx, s, p, maxAge); err != nil {
+		return nil, nil, "", err
+	}
+	r, err := s.Get(ctx, p.RequestID)
+	if err != nil {
+		releaseNonce(ctx, s, p.Nonce)
+		return nil, nil, "", fmt.Errorf("can't load request: %w", err)
+	}
+	email, posture, err := slackUser(ctx, users, message.User.ID, want)
+	if err != nil {
+		releaseNonce(ctx, s, p.Nonce)
+		return nil, nil, "", err
+	}
+	r.Nonce = p.Nonce
+	// Requests posted before the message was recorded pick it up from the click
+	if r.Channel == "" {
+		r.Channel, r.MessageTS = message.Container.ChannelID, message.Container.MessageTs
+	}
+	recordPosture(r.EscalationRequest, email, posture)
+	return p, r, email, nil
+}
+
+func ParseEscalationRequestFromModal(ctx context.Context, users *Users, message slack.InteractionCallback) (*EscalationRequest, error) {
+	email, posture, err := slackUser(ctx, users, message.User.ID, config.Cfg.EscalationPolicy.RequestorPosture)
 	if err != nil {
-		return nil, fmt.Errorf("can't get user info from slack: %v", err)
+		return nil, err
 	}
-	requestor := Requestor(profile.Email)
+	requestor := Requestor(email)
 	reason := message.View.State.Values[ReasonBlockID][ReasonActionID].Value
-	role := Role(message.View.State.Values[RoleBlockID][RoleActionID].SelectedOption.Value)
-	resource := Resource(message.View.State.Values[ResourceBlockID][ResourceActionID].SelectedOption.Value)
+	// A role or resource that was typed in takes precedence over the select
+	role := Role(selectedOrTyped(message.View.State, RoleBlockID, RoleActionID, RoleTextBlockID, RoleTextActionID))
+	if role == "" {
+		return nil, fmt.Errorf("no role was selected")
+	}
+	resource := Resource(selectedOrTyped(message.View.State, ResourceBlockID, ResourceActionID, ResourceTextBlockID, ResourceTextActionID))
+	if resource == "" {
+		return nil, fmt.Errorf("no resource was selected")
+	}
+
+	duration, err := selectedDuration(message.View.State)
+	if err != nil {
+		return nil, err
+	}
 
 	r := &EscalationRequest{
 		Requestor: requestor,
@@ -46,6 +258,28 @@ func ParseEscalationRequestFromModal(api *slack.Client, message slack.Interactio
 		Resource:  resource,
 		Reason:    reason,
 		Timestamp: time.Now().Format(time.RFC822),
+		Duration:  Duration(duration),
 	}
+	recordPosture(r, email, posture)
 	return r, nil
 }
+
+func selectedOrTyped(state *slack.ViewState, selectBlockID, selectActionID, textBlockID, textActionID string) string {
+	if typed := strings.TrimSpace(state.Values[textBlockID][textActionID].Value); typed != "" {
+		return typed
+	}
+	return state.Values[selectBlockID][selectActionID].SelectedOption.Value
+}
+
+// selectedDuration is the duration picked in the modal, or zero for the rule's default
+func selectedDuration(state *slack.ViewState) (time.Duration, error) {
+	selected := state.Values[DurationBlockID][DurationActionID].SelectedOption.Value
+	if selected == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(selected)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %v", err)
+	}
+	return duration, nil
+}
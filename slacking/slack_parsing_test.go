@@ -0,0 +1,178 @@
+package slacking
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/seslattery/gcpsudobot/config"
+	"github.com/seslattery/gcpsudobot/store"
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"github.com/slack-go/slack"
+)
+
+type mockUserInfo map[string]slack.User
+
+func (m mockUserInfo) GetUserInfoContext(ctx context.Context, user string) (*slack.User, error) {
+	u, ok := m[user]
+	if !ok {
+		return nil, fmt.Errorf("user_not_found")
+	}
+	return &u, nil
+}
+
+var testSlackUsers = mockUserInfo{
+	"U1": {ID: "U1", Has2FA: true, Profile: slack.UserProfile{Email: "alice@gmail.com"}},
+	"U2": {ID: "U2", Profile: slack.UserProfile{Email: "bob@gmail.com"}},
+	"U3": {ID: "U3", IsRestricted: true, Has2FA: true, Profile: slack.UserProfile{Email: "guest@gmail.com"}},
+	"U4": {ID: "U4", IsUltraRestricted: true, Has2FA: true, Profile: slack.UserProfile{Email: "single-channel@gmail.com"}},
+	"U5": {ID: "U5", IsBot: true, Profile: slack.UserProfile{Email: "bot@gmail.com"}},
+	"U6": {ID: "U6", Deleted: true, Has2FA: true, Profile: slack.UserProfile{Email: "gone@gmail.com"}},
+}
+
+// testPosture sets the posture requirements in the config's policy for the test
+func testPosture(t *testing.T, requestors, approvers SlackPostureRequirements) {
+	policy := config.Cfg.EscalationPolicy
+	t.Cleanup(func() {
+		config.Cfg.EscalationPolicy = policy
+	})
+	p := *policy
+	p.RequestorPosture, p.ApproverPosture = requestors, approvers
+	config.Cfg.EscalationPolicy = &p
+}
+
+func modalSubmission(userID string) slack.InteractionCallback {
+	var message slack.InteractionCallback
+	message.User.ID = userID
+	message.View.State = &slack.ViewState{Values: map[string]map[string]slack.BlockAction{
+		ReasonBlockID:   {ReasonActionID: {Value: "incident"}},
+		RoleBlockID:     {RoleActionID: {SelectedOption: slack.OptionBlockObject{Value: "roles/viewer"}}},
+		ResourceBlockID: {ResourceActionID: {SelectedOption: slack.OptionBlockObject{Value: "projects/testing"}}},
+	}}
+	return message
+}
+
+func TestParseEscalationRequestFromModalPosture(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       string
+		requestors SlackPostureRequirements
+		wantError  string
+	}{
+		{"no requirements", "U2", SlackPostureRequirements{}, ""},
+		{"guests allowed", "U3", SlackPostureRequirements{Require2FA: true}, ""},
+		{"guest", "U3", SlackPostureRequirements{DenyGuests: true}, "the slack account is a guest"},
+		{"single channel guest", "U4", SlackPostureRequirements{DenyGuests: true}, "the slack account is a guest"},
+		{"no 2fa", "U2", SlackPostureRequirements{DenyGuests: true, Require2FA: true}, "the slack account doesn't have two-factor authentication turned on"},
+		{"bot", "U5", SlackPostureRequirements{}, "the slack account is a bot"},
+		{"deactivated", "U6", SlackPostureRequirements{}, "the slack account is deactivated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPosture(t, tt.requestors, SlackPostureRequirements{})
+			r, err := ParseEscalationRequestFromModal(context.Background(), &Users{API: testSlackUsers}, modalSubmission(tt.user))
+			if tt.wantError != "" {
+				if !errors.Is(err, ErrSlackPosture) || err.Error() != fmt.Sprintf("%v: %s", ErrSlackPosture, tt.wantError) {
+					t.Errorf("got %v, want ErrSlackPosture with %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			u := testSlackUsers[tt.user]
+			want := map[string]SlackPosture{u.Profile.Email: {UserID: u.ID, Email: u.Profile.Email, Guest: u.IsRestricted, Has2FA: u.Has2FA}}
+			if diff := cmp.Diff(r.SlackPostures, want); diff != "" {
+				t.Errorf("posture diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestParseEscalationRequestFromApprovalPosture(t *testing.T) {
+	testSigning(t)
+	testPosture(t, SlackPostureRequirements{}, SlackPostureRequirements{DenyGuests: true, Require2FA: true})
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+	a := NewEscalationApproval(&EscalationRequest{Requestor: "bob@gmail.com", Role: "roles/viewer", Resource: "projects/testing"}, now())
+	recordPosture(a.EscalationRequest, "bob@gmail.com", SlackPosture{UserID: "U2"})
+	if err := s.Create(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	value, err := signPayload(&ButtonPayload{RequestID: a.ID, ActionID: ApprovalButtonID, Status: Approved, Nonce: "posture-nonce", IssuedAt: now().Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	click := func(userID string) slack.InteractionCallback {
+		var message slack.InteractionCallback
+		message.User.ID = userID
+		message.ActionCallback.BlockActions = []*slack.BlockAction{{ActionID: ApprovalButtonID, Value: value}}
+		return message
+	}
+
+	if _, err := ParseEscalationRequestFromApproval(ctx, &Users{API: testSlackUsers}, s, slack.InteractionCallback{}); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("no actions: got %v, want ErrInvalidPayload", err)
+	}
+	if _, err := ButtonRequestID(slack.InteractionCallback{}); !errors.Is(err, ErrInvalidPayload) {
+		t.Errorf("no actions: got %v, want ErrInvalidPayload", err)
+	}
+	for _, user := range []string{"U2", "U3", "U5"} {
+		if _, err := ParseEscalationRequestFromApproval(ctx, &Users{API: testSlackUsers}, s, click(user)); !errors.Is(err, ErrSlackPosture) {
+			t.Errorf("%s: got %v, want ErrSlackPosture", user, err)
+		}
+	}
+	// The refused clicks don't use up the button
+	got, err := ParseEscalationRequestFromApproval(ctx, &Users{API: testSlackUsers}, s, click("U1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Approver != "alice@gmail.com" {
+		t.Errorf("got approver %s, want alice@gmail.com", got.Approver)
+	}
+	want := map[string]SlackPosture{"bob@gmail.com": {UserID: "U2"}, "alice@gmail.com": {UserID: "U1", Email: "alice@gmail.com", Has2FA: true}}
+	if diff := cmp.Diff(got.SlackPostures, want); diff != "" {
+		t.Errorf("posture diff: %v", diff)
+	}
+	// A second click is a replay until the button is released
+	if _, err := ParseEscalationRequestFromApproval(ctx, &Users{API: testSlackUsers}, s, click("U1")); !errors.Is(err, ErrButtonUsed) {
+		t.Errorf("second click got %v, want ErrButtonUsed", err)
+	}
+	ReleaseApproval(ctx, s, got)
+	if _, err := ParseEscalationRequestFromApproval(ctx, &Users{API: testSlackUsers}, s, click("U1")); err != nil {
+		t.Errorf("click after release got %v", err)
+	}
+}
+
+type mockIdentities map[string]string
+
+func (m mockIdentities) Resolve(ctx context.Context, email string) (string, error) {
+	if email == "bob@gmail.com" {
+		return "", fmt.Errorf("can't reach google")
+	}
+	if identity, ok := m[email]; ok {
+		return identity, nil
+	}
+	return email, nil
+}
+
+func TestParseEscalationRequestFromModalIdentity(t *testing.T) {
+	testPosture(t, SlackPostureRequirements{}, SlackPostureRequirements{})
+	users := &Users{API: testSlackUsers, Identities: mockIdentities{"alice@gmail.com": "alice.smith@example.io"}}
+	r, err := ParseEscalationRequestFromModal(context.Background(), users, modalSubmission("U1"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.Requestor != "alice.smith@example.io" {
+		t.Errorf("got requestor %s, want the resolved identity alice.smith@example.io", r.Requestor)
+	}
+	want := map[string]SlackPosture{"alice.smith@example.io": {UserID: "U1", Email: "alice@gmail.com", Has2FA: true}}
+	if diff := cmp.Diff(r.SlackPostures, want); diff != "" {
+		t.Errorf("posture diff: %v", diff)
+	}
+	if _, err := ParseEscalationRequestFromModal(context.Background(), users, modalSubmission("U2")); err == nil {
+		t.Errorf("got no error when the identity couldn't be resolved")
+	}
+}
@@ -0,0 +1,176 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// FileStore keeps every request in a single JSON file, and the used nonces in another next to it with a .nonces suffix.
+// It's safe for one process at a time, e.g. running cmd/main.go locally.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (f *FileStore) Create(ctx context.Context, a *EscalationApproval) error {
+	if err := assignID(a); err != nil {
+		return err
+	}
+	return f.modify(func(requests map[string]json.RawMessage) error {
+		return put(requests, a)
+	})
+}
+
+func (f *FileStore) Get(ctx context.Context, id string) (*EscalationApproval, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := requests[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return decode(b)
+}
+
+func (f *FileStore) Update(ctx context.Context, a *EscalationApproval) error {
+	return f.modify(func(requests map[string]json.RawMessage) error {
+		b, ok := requests[a.ID]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, a.ID)
+		}
+		stored, err := decode(b)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdate(stored, a); err != nil {
+			return err
+		}
+		return putVersion(requests, a)
+	})
+}
+
+func (f *FileStore) Delete(ctx context.Context, id string) error {
+	return f.modify(func(requests map[string]json.RawMessage) error {
+		if _, ok := requests[id]; !ok {
+			return fmt.Errorf("%w: %s", ErrNotFound, id)
+		}
+		delete(requests, id)
+		return nil
+	})
+}
+
+func (f *FileStore) List(ctx context.Context) ([]*EscalationApproval, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return list(requests)
+}
+
+func (f *FileStore) ClaimNonce(ctx context.Context, nonce string, now, expires time.Time) error {
+	return f.modifyNonces(func(nonces map[string]time.Time) error {
+		return claimNonce(nonces, nonce, now, expires)
+	})
+}
+
+func (f *FileStore) ReleaseNonce(ctx context.Context, nonce string) error {
+	return f.modifyNonces(func(nonces map[string]time.Time) error {
+		delete(nonces, nonce)
+		return nil
+	})
+}
+
+func (f *FileStore) noncesPath() string {
+	return f.path + ".nonces"
+}
+
+// modifyNonces loads the nonces, applies the change, and writes them back if the change succeeded
+func (f *FileStore) modifyNonces(change func(map[string]time.Time) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	nonces := make(map[string]time.Time)
+	b, err := os.ReadFile(f.noncesPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("can't read nonces: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &nonces); err != nil {
+			return fmt.Errorf("can't unmarshal nonces %s: %v", f.noncesPath(), err)
+		}
+	}
+	if err := change(nonces); err != nil {
+		return err
+	}
+	return writeJSON(f.noncesPath(), nonces)
+}
+
+// modify loads the file, applies the change, and writes it back if the change succeeded
+func (f *FileStore) modify(change func(map[string]json.RawMessage) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests, err := f.load()
+	if err != nil {
+		return err
+	}
+	if err := change(requests); err != nil {
+		return err
+	}
+	return writeJSON(f.path, requests)
+}
+
+func (f *FileStore) load() (map[string]json.RawMessage, error) {
+	requests := make(map[string]json.RawMessage)
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return requests, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't read request store: %v", err)
+	}
+	if err := json.Unmarshal(b, &requests); err != nil {
+		return nil, fmt.Errorf("can't unmarshal request store %s: %v", f.path, err)
+	}
+	return requests, nil
+}
+
+// writeJSON writes to a temporary file first, so a crash can't leave the store half written
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("can't marshal request store: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("can't write request store: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't write request store: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("can't write request store: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("can't write request store: %v", err)
+	}
+	return nil
+}
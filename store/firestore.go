@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	. "github.com/seslattery/gcpsudobot/types"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FirestoreStore keeps each request as a document in a collection, so it's shared by every instance of the cloud function.
+// The used nonces are kept in a second collection with a -nonces suffix, a TTL policy on its expires field cleans them up.
+// The firestore client uses FIRESTORE_EMULATOR_HOST when it's set.
+type FirestoreStore struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+	nonces     *firestore.CollectionRef
+}
+
+func NewFirestoreStore(ctx context.Context, project, collection string) (*FirestoreStore, error) {
+	client, err := firestore.NewClient(ctx, project)
+	if err != nil {
+		return nil, fmt.Errorf("can't create firestore client: %v", err)
+	}
+	return &FirestoreStore{client: client, collection: client.Collection(collection), nonces: client.Collection(collection + "-nonces")}, nil
+}
+
+func (f *FirestoreStore) Create(ctx context.Context, a *EscalationApproval) error {
+	if err := assignID(a); err != nil {
+		return err
+	}
+	doc, err := toDocument(a)
+	if err != nil {
+		return err
+	}
+	if _, err := f.collection.Doc(a.ID).Create(ctx, doc); err != nil {
+		return fmt.Errorf("can't create request %s: %v", a.ID, err)
+	}
+	return nil
+}
+
+func (f *FirestoreStore) Get(ctx context.Context, id string) (*EscalationApproval, error) {
+	snap, err := f.collection.Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't get request %s: %v", id, err)
+	}
+	return fromDocument(snap)
+}
+
+func (f *FirestoreStore) Update(ctx context.Context, a *EscalationApproval) error {
+	next := *a
+	next.Version++
+	doc, err := toDocument(&next)
+	if err != nil {
+		return err
+	}
+	ref := f.collection.Doc(a.ID)
+	// Set can't be made conditional on the stored version, so it's checked in a transaction instead
+	err = f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		stored, err := fromDocument(snap)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdate(stored, a); err != nil {
+			return err
+		}
+		return tx.Set(ref, doc)
+	})
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, a.ID)
+	}
+	if errors.Is(err, ErrConflict) || errors.Is(err, ErrInvalidTransition) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("can't update request %s: %v", a.ID, err)
+	}
+	a.Version = next.Version
+	return nil
+}
+
+func (f *FirestoreStore) Delete(ctx context.Context, id string) error {
+	_, err := f.collection.Doc(id).Delete(ctx, firestore.Exists)
+	if status.Code(err) == codes.NotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return fmt.Errorf("can't delete request %s: %v", id, err)
+	}
+	return nil
+}
+
+func (f *FirestoreStore) List(ctx context.Context) ([]*EscalationApproval, error) {
+	iter := f.collection.OrderBy(firestore.DocumentID, firestore.Asc).Documents(ctx)
+	defer iter.Stop()
+	var approvals []*EscalationApproval
+	for {
+		snap, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't list requests: %v", err)
+		}
+		a, err := fromDocument(snap)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, a)
+	}
+	return approvals, nil
+}
+
+// ClaimNonce creates the nonce's document, or replaces it if it has expired, in a transaction so only one instance can claim it
+func (f *FirestoreStore) ClaimNonce(ctx context.Context, nonce string, now, expires time.Time) error {
+	ref := f.nonces.Doc(nonce)
+	err := f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		snap, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if snap != nil && snap.Exists() {
+			if e, ok := snap.Data()["expires"].(time.Time); ok && !now.After(e) {
+				return fmt.Errorf("%w: %s", ErrNonceUsed, nonce)
+			}
+		}
+		return tx.Set(ref, map[string]interface{}{"expires": expires})
+	})
+	if errors.Is(err, ErrNonceUsed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("can't claim nonce %s: %v", nonce, err)
+	}
+	return nil
+}
+
+func (f *FirestoreStore) ReleaseNonce(ctx context.Context, nonce string) error {
+	if _, err := f.nonces.Doc(nonce).Delete(ctx); err != nil {
+		return fmt.Errorf("can't release nonce %s: %v", nonce, err)
+	}
+	return nil
+}
+
+// The documents use the same field names as the JSON, so the requests are converted through it
+func toDocument(a *EscalationApproval) (map[string]interface{}, error) {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal request: %v", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("can't unmarshal request: %v", err)
+	}
+	return doc, nil
+}
+
+func fromDocument(snap *firestore.DocumentSnapshot) (*EscalationApproval, error) {
+	b, err := json.Marshal(snap.Data())
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal request %s: %v", snap.Ref.ID, err)
+	}
+	return decode(b)
+}
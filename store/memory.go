@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+// MemoryStore only lasts as long as the process, and isn't shared between instances. It's meant for local development and tests.
+// Requests are kept serialized, so callers can't change what's stored without an Update.
+type MemoryStore struct {
+	mu       sync.Mutex
+	requests map[string]json.RawMessage
+	nonces   map[string]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{requests: make(map[string]json.RawMessage), nonces: make(map[string]time.Time)}
+}
+
+func (m *MemoryStore) Create(ctx context.Context, a *EscalationApproval) error {
+	if err := assignID(a); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return put(m.requests, a)
+}
+
+func (m *MemoryStore) Get(ctx context.Context, id string) (*EscalationApproval, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.requests[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return decode(b)
+}
+
+func (m *MemoryStore) Update(ctx context.Context, a *EscalationApproval) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.requests[a.ID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, a.ID)
+	}
+	stored, err := decode(b)
+	if err != nil {
+		return err
+	}
+	if err := checkUpdate(stored, a); err != nil {
+		return err
+	}
+	return putVersion(m.requests, a)
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.requests[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	delete(m.requests, id)
+	return nil
+}
+
+func (m *MemoryStore) List(ctx context.Context) ([]*EscalationApproval, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return list(m.requests)
+}
+
+func (m *MemoryStore) ClaimNonce(ctx context.Context, nonce string, now, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return claimNonce(m.nonces, nonce, now, expires)
+}
+
+func (m *MemoryStore) ReleaseNonce(ctx context.Context, nonce string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.nonces, nonce)
+	return nil
+}
@@ -0,0 +1,197 @@
+// Package store keeps escalation requests server side, so slack only has to carry the request ID
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	. "github.com/seslattery/gcpsudobot/types"
+)
+
+var ErrNotFound = errors.New("request not found")
+
+// ErrConflict is returned by an update made from a copy of the request that's older than what's stored
+var ErrConflict = errors.New("the request was changed by someone else, please check it and try again")
+
+var ErrNonceUsed = errors.New("nonce has already been used")
+
+// NonceStore remembers the nonces of the slack buttons that have been clicked, so a click can't be replayed against any instance
+type NonceStore interface {
+	// ClaimNonce marks the nonce as used until it expires, returning ErrNonceUsed if it's already been claimed and hasn't expired
+	ClaimNonce(ctx context.Context, nonce string, now, expires time.Time) error
+	// ReleaseNonce lets the nonce be claimed again, for when acting on a click failed
+	ReleaseNonce(ctx context.Context, nonce string) error
+}
+
+// RequestStore holds escalation requests, along with the approvals they've had so far, keyed by request ID.
+// The nonces of the buttons on their messages are kept alongside them.
+type RequestStore interface {
+	NonceStore
+	// Create saves a new request, assigning it a generated ID
+	Create(ctx context.Context, a *EscalationApproval) error
+	Get(ctx context.Context, id string) (*EscalationApproval, error)
+	// Update replaces an existing request, returning ErrNotFound if it doesn't exist.
+	// It's a compare and swap on the version, so it returns ErrConflict if the request has been updated since it was read,
+	// and increments the version on success.
+	Update(ctx context.Context, a *EscalationApproval) error
+	Delete(ctx context.Context, id string) error
+	List(ctx context.Context) ([]*EscalationApproval, error)
+}
+
+// NewID generates a random request ID
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("can't generate request id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// assignID gives the request a new ID before it's created
+func assignID(a *EscalationApproval) error {
+	if a.EscalationRequest == nil {
+		return fmt.Errorf("approval has no request")
+	}
+	id, err := NewID()
+	if err != nil {
+		return err
+	}
+	a.ID = id
+	return nil
+}
+
+// claimNonce forgets the nonces that have expired, then claims the nonce
+func claimNonce(nonces map[string]time.Time, nonce string, now, expires time.Time) error {
+	for n, e := range nonces {
+		if now.After(e) {
+			delete(nonces, n)
+		}
+	}
+	if _, ok := nonces[nonce]; ok {
+		return fmt.Errorf("%w: %s", ErrNonceUsed, nonce)
+	}
+	nonces[nonce] = expires
+	return nil
+}
+
+// checkUpdate compares the stored request's version with the one being updated, then checks its transitions start from the stored state.
+// It's called in the same transaction as the write, so the lifecycle holds across every instance.
+func checkUpdate(stored, a *EscalationApproval) error {
+	if stored.Version != a.Version {
+		return fmt.Errorf("%w: request %s is at version %d, the update was made from version %d", ErrConflict, a.ID, stored.Version, a.Version)
+	}
+	if err := a.CheckTransitionsSince(stored); err != nil {
+		return fmt.Errorf("can't update request %s: %w", a.ID, err)
+	}
+	return nil
+}
+
+// putVersion stores the next version of the request, the version is only incremented once it's been stored
+func putVersion(requests map[string]json.RawMessage, a *EscalationApproval) error {
+	a.Version++
+	if err := put(requests, a); err != nil {
+		a.Version--
+		return err
+	}
+	return nil
+}
+
+func put(requests map[string]json.RawMessage, a *EscalationApproval) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("can't marshal request: %v", err)
+	}
+	requests[a.ID] = b
+	return nil
+}
+
+// list decodes the requests, in order of their IDs
+func list(requests map[string]json.RawMessage) ([]*EscalationApproval, error) {
+	ids := make([]string, 0, len(requests))
+	for id := range requests {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var approvals []*EscalationApproval
+	for _, id := range ids {
+		a, err := decode(requests[id])
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, a)
+	}
+	return approvals, nil
+}
+
+func decode(b []byte) (*EscalationApproval, error) {
+	var a *EscalationApproval
+	if err := json.Unmarshal(b, &a); err != nil {
+		return nil, fmt.Errorf("can't unmarshal request: %v", err)
+	}
+	return a, nil
+}
+
+// GrantedResources returns the resources of every active or expired request, the ones that can still have a binding on them for the reaper
+func GrantedResources(ctx context.Context, s RequestStore) ([]Resource, error) {
+	approvals, err := s.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[Resource]struct{})
+	var resources []Resource
+	for _, a := range approvals {
+		switch a.CurrentState() {
+		case StateActive, StateExpired:
+		default:
+			continue
+		}
+		if _, ok := seen[a.Resource]; ok || a.Resource == "" {
+			continue
+		}
+		seen[a.Resource] = struct{}{}
+		resources = append(resources, a.Resource)
+	}
+	return resources, nil
+}
+
+// ExpireRequests moves active requests whose grant has run out, and pending requests older than maxAge, to expired.
+// A maxAge of 0 or less doesn't expire pending requests.
+func ExpireRequests(ctx context.Context, s RequestStore, actor string, now time.Time, maxAge time.Duration) (int, error) {
+	approvals, err := s.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	var errs []error
+	for _, a := range approvals {
+		switch a.CurrentState() {
+		case StateActive:
+			expiry, err := time.Parse(time.RFC3339, a.Expiry)
+			if err != nil || now.Before(expiry) {
+				continue
+			}
+		case StatePending:
+			if maxAge <= 0 || now.Sub(a.CreatedAt()) <= maxAge {
+				continue
+			}
+		default:
+			continue
+		}
+		if err := a.TransitionTo(StateExpired, actor, now, ""); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := s.Update(ctx, a); err != nil {
+			errs = append(errs, fmt.Errorf("can't expire request %s: %v", a.ID, err))
+			continue
+		}
+		expired++
+	}
+	return expired, errors.Join(errs...)
+}
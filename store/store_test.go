@@ -0,0 +1,291 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	. "github.com/seslattery/gcpsudobot/types"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testRequestStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.json")
+	testRequestStore(t, NewFileStore(path))
+	// A new store on the same file sees what the first one saved
+	approvals, err := NewFileStore(path).List(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(approvals) != 1 {
+		t.Errorf("got %d requests, want 1", len(approvals))
+	}
+}
+
+// Run against the emulator with: gcloud emulators firestore start --host-port=localhost:8086
+// and FIRESTORE_EMULATOR_HOST=localhost:8086 go test ./store
+func TestFirestoreStore(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST isn't set")
+	}
+	ctx := context.Background()
+	s, err := NewFirestoreStore(ctx, "test-project", fmt.Sprintf("requests-%d", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testRequestStore(t, s)
+}
+
+// testRequestStore checks the behavior every RequestStore has to share, it leaves a single request behind
+func testRequestStore(t *testing.T, s RequestStore) {
+	ctx := context.Background()
+	newApproval := func() *EscalationApproval {
+		return &EscalationApproval{
+			EscalationRequest: &EscalationRequest{
+				Requestor: "user@gmail.com",
+				Groups:    Groups{"on-call@gmail.com": {}},
+				Role:      "organizations/0000000000/roles/on_call_elevated",
+				Resource:  "organizations/0000000000",
+				Reason:    "testing",
+				Timestamp: "100",
+				Duration:  Duration(90 * time.Minute),
+			},
+		}
+	}
+
+	a, b := newApproval(), newApproval()
+	for _, approval := range []*EscalationApproval{a, b} {
+		if err := s.Create(ctx, approval); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if a.ID == "" || a.ID == b.ID {
+		t.Fatalf("got ids %q and %q, want two different ids", a.ID, b.ID)
+	}
+
+	got, err := s.Get(ctx, a.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if diff := cmp.Diff(got, a); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+
+	a.Approver = "approver@gmail.com"
+	a.Status = Approved
+	a.Approvals = []string{"approver@gmail.com"}
+	a.ApprovalsRemaining = 1
+	if err := s.Update(ctx, a); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	// Fields that are no longer set are removed by an update
+	a.ApprovalsRemaining = 0
+	if err := s.Update(ctx, a); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	got, err = s.Get(ctx, a.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if diff := cmp.Diff(got, a); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+
+	// Someone else updates the request after it's been read, the update made from the older copy is refused
+	stale, err := s.Get(ctx, a.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	now := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	if err := a.TransitionTo(StateDenied, "approver@gmail.com", now, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Update(ctx, a); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if err := stale.TransitionTo(StateActive, "approver@gmail.com", now, ""); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Update(ctx, stale); !errors.Is(err, ErrConflict) {
+		t.Errorf("update of a stale copy got %v, want ErrConflict", err)
+	}
+	// A state change that doesn't go through the lifecycle is refused, even from the latest copy
+	latest, err := s.Get(ctx, a.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	latest.State = StateActive
+	if err := s.Update(ctx, latest); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("update skipping the lifecycle got %v, want ErrInvalidTransition", err)
+	}
+	got, err = s.Get(ctx, a.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if diff := cmp.Diff(got, a); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+
+	approvals, err := s.List(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(approvals) != 2 {
+		t.Errorf("got %d requests, want 2", len(approvals))
+	}
+
+	if err := s.Delete(ctx, b.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := s.Get(ctx, b.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("get after delete got %v, want ErrNotFound", err)
+	}
+	if err := s.Delete(ctx, b.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second delete got %v, want ErrNotFound", err)
+	}
+	missing := newApproval()
+	missing.ID = "missing"
+	if err := s.Update(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of a missing request got %v, want ErrNotFound", err)
+	}
+
+	nonce := "nonce-" + a.ID
+	expires := now.Add(time.Hour)
+	if err := s.ClaimNonce(ctx, nonce, now, expires); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if err := s.ClaimNonce(ctx, nonce, now, expires); !errors.Is(err, ErrNonceUsed) {
+		t.Errorf("second claim got %v, want ErrNonceUsed", err)
+	}
+	if err := s.ReleaseNonce(ctx, nonce); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if err := s.ClaimNonce(ctx, nonce, now, expires); err != nil {
+		t.Errorf("claim after release got %v", err)
+	}
+	// Once it's expired it can be claimed again
+	if err := s.ClaimNonce(ctx, nonce, expires.Add(time.Minute), expires.Add(2*time.Hour)); err != nil {
+		t.Errorf("claim after expiry got %v", err)
+	}
+	if err := s.ClaimNonce(ctx, nonce, expires.Add(time.Hour), expires.Add(2*time.Hour)); !errors.Is(err, ErrNonceUsed) {
+		t.Errorf("claim of the renewed nonce got %v, want ErrNonceUsed", err)
+	}
+}
+
+func TestGrantedResources(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	s := NewMemoryStore()
+	for _, tt := range []struct {
+		resource Resource
+		states   []State
+	}{
+		{"projects/active", []State{StateActive}},
+		{"projects/active", []State{StateActive}},
+		{"projects/expired", []State{StateActive, StateExpired}},
+		{"projects/revoked", []State{StateActive, StateRevoked}},
+		{"projects/pending", nil},
+		{"projects/denied", []State{StateDenied}},
+	} {
+		a := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com", Resource: tt.resource}, at)
+		for _, state := range tt.states {
+			if err := a.TransitionTo(state, "approver@gmail.com", at, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := s.Create(ctx, a); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	got, err := GrantedResources(ctx, s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	want := []Resource{"projects/active", "projects/expired"}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+}
+
+func TestExpireRequests(t *testing.T) {
+	ctx := context.Background()
+	created := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	now := created.Add(3 * time.Hour)
+	s := NewMemoryStore()
+	newApproval := func(at time.Time, states ...State) *EscalationApproval {
+		a := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, at)
+		for _, state := range states {
+			if err := a.TransitionTo(state, "approver@gmail.com", at, ""); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if err := s.Create(ctx, a); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return a
+	}
+	expiredGrant := newApproval(created, StateActive)
+	expiredGrant.Expiry = created.Add(2 * time.Hour).Format(time.RFC3339)
+	activeGrant := newApproval(created, StateActive)
+	activeGrant.Expiry = created.Add(4 * time.Hour).Format(time.RFC3339)
+	for _, a := range []*EscalationApproval{expiredGrant, activeGrant} {
+		if err := s.Update(ctx, a); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	stalePending := newApproval(created)
+	freshPending := newApproval(now.Add(-time.Hour))
+	denied := newApproval(created, StateDenied)
+
+	expired, err := ExpireRequests(ctx, s, "reaper", now, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expired != 2 {
+		t.Errorf("got %d expired, want 2", expired)
+	}
+	want := map[string]State{
+		expiredGrant.ID: StateExpired,
+		activeGrant.ID:  StateActive,
+		stalePending.ID: StateExpired,
+		freshPending.ID: StatePending,
+		denied.ID:       StateDenied,
+	}
+	for id, state := range want {
+		a, err := s.Get(ctx, id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if a.State != state {
+			t.Errorf("got %s for %s, want %s", a.State, id, state)
+		}
+	}
+
+	// Without a max age pending requests are left alone, however old they are
+	unlimited := newApproval(created.Add(-24 * time.Hour))
+	expired, err = ExpireRequests(ctx, s, "reaper", now, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expired != 0 {
+		t.Errorf("got %d expired, want 0", expired)
+	}
+	a, err := s.Get(ctx, unlimited.ID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if a.State != StatePending {
+		t.Errorf("got %s, want %s", a.State, StatePending)
+	}
+}
@@ -0,0 +1,151 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// State is where an escalation request is in its lifecycle
+type State string
+
+const (
+	// Waiting on approvals
+	StatePending State = "pending"
+	// Approved and the role has been granted
+	StateActive State = "active"
+	StateDenied State = "denied"
+	// The grant ran out, or the request wasn't acted on in time
+	StateExpired State = "expired"
+	// The grant was removed before it expired
+	StateRevoked   State = "revoked"
+	StateCancelled State = "cancelled"
+	// Approved, but the role couldn't be granted
+	StateFailed State = "failed"
+	// The grant was taken over by an approved extension request
+	StateExtended State = "extended"
+)
+
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// NoteGrantNotVisible is the note on the move to active when the binding was written, but couldn't be read back before the response was sent
+const NoteGrantNotVisible = "granted but not yet visible"
+
+// transitions lists the states each state can move to. Pending can move to itself to record an approval while more are still needed.
+var transitions = map[State][]State{
+	StatePending: {StatePending, StateActive, StateDenied, StateCancelled, StateExpired, StateFailed},
+	StateActive:  {StateExpired, StateRevoked, StateExtended},
+}
+
+// Transition records a change of state, who made it and when
+type Transition struct {
+	From  State     `json:"from,omitempty"`
+	To    State     `json:"to"`
+	Actor string    `json:"actor"`
+	At    time.Time `json:"at"`
+	// Why, e.g. the error when a grant failed
+	Note string `json:"note,omitempty"`
+}
+
+// NewEscalationApproval starts the lifecycle of a request that's just been submitted
+func NewEscalationApproval(r *EscalationRequest, at time.Time) *EscalationApproval {
+	a := &EscalationApproval{EscalationRequest: r}
+	// Every request can become pending, so this can't fail
+	_ = a.TransitionTo(StatePending, string(r.Requestor), at, "")
+	return a
+}
+
+// CurrentState treats a request that hasn't been through NewEscalationApproval as pending
+func (e *EscalationApproval) CurrentState() State {
+	if e.State == "" {
+		return StatePending
+	}
+	return e.State
+}
+
+// checkTransition returns ErrInvalidTransition unless the lifecycle allows moving from one state to the other
+func checkTransition(from, to State) error {
+	for _, s := range transitions[from] {
+		if s == to {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: the request is %s, it can't become %s", ErrInvalidTransition, from, to)
+}
+
+// TransitionTo moves the request to a new state, recording it in the history, if the lifecycle allows it
+func (e *EscalationApproval) TransitionTo(to State, actor string, at time.Time, note string) error {
+	if err := checkTransition(e.CurrentState(), to); err != nil {
+		return err
+	}
+	e.History = append(e.History, Transition{From: e.State, To: to, Actor: actor, At: at.UTC(), Note: note})
+	e.State = to
+	return nil
+}
+
+// CheckTransitionsSince checks the request only differs from the stored copy by transitions the lifecycle allows, starting from the stored state.
+// The store calls it along with the write, since the copy the transitions were checked against may be older than what's stored by then.
+func (e *EscalationApproval) CheckTransitionsSince(stored *EscalationApproval) error {
+	if len(e.History) < len(stored.History) {
+		return fmt.Errorf("%w: the request has %d transitions, but %d are stored", ErrInvalidTransition, len(e.History), len(stored.History))
+	}
+	from := stored.CurrentState()
+	for _, t := range e.History[len(stored.History):] {
+		if err := checkTransition(from, t.To); err != nil {
+			return err
+		}
+		from = t.To
+	}
+	if from != e.CurrentState() {
+		return fmt.Errorf("%w: the request is %s, but its history ends at %s", ErrInvalidTransition, e.CurrentState(), from)
+	}
+	return nil
+}
+
+// CreatedAt is when the request was submitted, or the zero time if it has no history
+func (e *EscalationApproval) CreatedAt() time.Time {
+	if len(e.History) == 0 {
+		return time.Time{}
+	}
+	return e.History[0].At
+}
+
+// GrantStart is when the role was first granted, an extension carries it over from the grant it extends.
+// It's the zero time if the role hasn't been granted.
+func (e *EscalationApproval) GrantStart() time.Time {
+	if e.GrantedSince != "" {
+		t, err := time.Parse(time.RFC3339, e.GrantedSince)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	for _, t := range e.History {
+		if t.To == StateActive {
+			return t.At
+		}
+	}
+	return time.Time{}
+}
+
+// Decision describes how a request that's no longer pending was decided, e.g. "approved by sre@example.io".
+// It's shown to whoever acts on a request after it's been decided.
+func (e *EscalationApproval) Decision() string {
+	switch e.CurrentState() {
+	case StatePending:
+		return "pending"
+	case StateDenied:
+		return fmt.Sprintf("denied by %s", e.Approver)
+	case StateCancelled:
+		return "cancelled"
+	}
+	if e.Status == Approved && e.Approver != "" {
+		approvers := e.Approvals
+		if len(approvers) == 0 {
+			approvers = []string{e.Approver}
+		}
+		return fmt.Sprintf("approved by %s", strings.Join(approvers, ", "))
+	}
+	return string(e.CurrentState())
+}
@@ -0,0 +1,170 @@
+package types
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTransitionTo(t *testing.T) {
+	created := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		path    []State
+		wantErr bool
+	}{
+		{"approved", []State{StateActive}, false},
+		{"denied", []State{StateDenied}, false},
+		{"approval recorded before the quorum", []State{StatePending, StateActive}, false},
+		{"revoked", []State{StateActive, StateRevoked}, false},
+		{"grant expired", []State{StateActive, StateExpired}, false},
+		{"request expired", []State{StateExpired}, false},
+		{"grant failed", []State{StateFailed}, false},
+		{"extended", []State{StateActive, StateExtended}, false},
+		{"extended before approval", []State{StateExtended}, true},
+		{"denied after approval", []State{StateActive, StateDenied}, true},
+		{"approved after denial", []State{StateDenied, StateActive}, true},
+		{"revoked before approval", []State{StateRevoked}, true},
+		{"retried after failure", []State{StateFailed, StateActive}, true},
+		{"active after expiry", []State{StateActive, StateExpired, StateActive}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, created)
+			var err error
+			for i, s := range tt.path {
+				if err = a.TransitionTo(s, "approver@gmail.com", created.Add(time.Duration(i+1)*time.Minute), ""); err != nil {
+					break
+				}
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Errorf("got %v, want ErrInvalidTransition", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if a.State != tt.path[len(tt.path)-1] {
+				t.Errorf("got state %s, want %s", a.State, tt.path[len(tt.path)-1])
+			}
+			if len(a.History) != len(tt.path)+1 {
+				t.Errorf("got %d transitions, want %d", len(a.History), len(tt.path)+1)
+			}
+		})
+	}
+}
+
+func TestNewEscalationApproval(t *testing.T) {
+	created := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	a := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, created)
+	want := []Transition{{To: StatePending, Actor: "user@gmail.com", At: created}}
+	if diff := cmp.Diff(a.History, want); diff != "" {
+		t.Errorf("diff: %v", diff)
+	}
+	if a.Approver != "" || a.CreatedAt() != created {
+		t.Errorf("got approver %q created %v, want no approver and %v", a.Approver, a.CreatedAt(), created)
+	}
+	// Requests saved before the lifecycle are pending
+	if s := (&EscalationApproval{}).CurrentState(); s != StatePending {
+		t.Errorf("got %s, want pending", s)
+	}
+}
+
+func TestGrantStart(t *testing.T) {
+	created := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	a := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, created)
+	if !a.GrantStart().IsZero() {
+		t.Errorf("got %v, want the zero time before the grant", a.GrantStart())
+	}
+	a.TransitionTo(StateActive, "approver@gmail.com", created.Add(time.Minute), "")
+	if a.GrantStart() != created.Add(time.Minute) {
+		t.Errorf("got %v, want the time it became active", a.GrantStart())
+	}
+	// An extension is granted since the grant it extends was
+	a.GrantedSince = "2024-04-27T23:00:00Z"
+	if a.GrantStart() != created.Add(-time.Hour) {
+		t.Errorf("got %v, want when the extended grant started", a.GrantStart())
+	}
+}
+
+func TestDecision(t *testing.T) {
+	at := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	newApproval := func(approver string, status Approval, approvals []string, states ...State) *EscalationApproval {
+		a := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, at)
+		a.Approver, a.Status, a.Approvals = approver, status, approvals
+		for _, s := range states {
+			a.TransitionTo(s, approver, at, "")
+		}
+		return a
+	}
+	tests := []struct {
+		name  string
+		input *EscalationApproval
+		want  string
+	}{
+		{"approved", newApproval("approver@gmail.com", Approved, []string{"approver@gmail.com"}, StateActive), "approved by approver@gmail.com"},
+		{"approved by a quorum", newApproval("sre-2@gmail.com", Approved, []string{"sre-1@gmail.com", "sre-2@gmail.com"}, StateActive), "approved by sre-1@gmail.com, sre-2@gmail.com"},
+		{"approved then revoked", newApproval("approver@gmail.com", Approved, nil, StateActive, StateRevoked), "approved by approver@gmail.com"},
+		{"denied", newApproval("approver@gmail.com", Denied, nil, StateDenied), "denied by approver@gmail.com"},
+		{"expired before approval", newApproval("", Denied, nil, StateExpired), "expired"},
+		{"still pending", newApproval("", Denied, nil), "pending"},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.Decision(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTransitionsSince(t *testing.T) {
+	created := time.Date(2024, 4, 28, 0, 0, 0, 0, time.UTC)
+	// stored and updated are the paths the stored copy and the copy being updated took from the same pending request
+	tests := []struct {
+		name    string
+		stored  []State
+		updated []State
+		wantErr bool
+	}{
+		{"no change", nil, nil, false},
+		{"approved", nil, []State{StateActive}, false},
+		{"approved after a quorum approval", nil, []State{StatePending, StateActive}, false},
+		{"revoked", []State{StateActive}, []State{StateActive, StateRevoked}, false},
+		{"denied after it was approved", []State{StateActive}, []State{StateDenied}, true},
+		{"approved after it expired", []State{StateExpired}, []State{StateActive}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			stored := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, created)
+			for _, s := range tt.stored {
+				if err := stored.TransitionTo(s, "approver@gmail.com", created, ""); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			updated := NewEscalationApproval(&EscalationRequest{Requestor: "user@gmail.com"}, created)
+			for _, s := range tt.updated {
+				if err := updated.TransitionTo(s, "approver@gmail.com", created, ""); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			err := updated.CheckTransitionsSince(stored)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidTransition) {
+					t.Errorf("got %v, want ErrInvalidTransition", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package types
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Roles and resources in a rule can be patterns instead of exact values.
+// "re:" prefixes a regular expression that has to match the whole value, e.g. re:projects/prod-[a-z]+
+// Anything else containing *, ? or [ is a glob, e.g. projects/prod-*. A * doesn't match across a /.
+const regexPatternPrefix = "re:"
+
+func IsPattern(s string) bool {
+	return strings.HasPrefix(s, regexPatternPrefix) || strings.ContainsAny(s, "*?[")
+}
+
+func ValidatePattern(pattern string) error {
+	if expr, ok := strings.CutPrefix(pattern, regexPatternPrefix); ok {
+		if _, err := regexp.Compile(anchor(expr)); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", pattern, err)
+		}
+		return nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// MatchPattern reports whether value matches the pattern, values that aren't patterns have to match exactly
+func MatchPattern(pattern, value string) bool {
+	if !IsPattern(pattern) {
+		return pattern == value
+	}
+	if expr, ok := strings.CutPrefix(pattern, regexPatternPrefix); ok {
+		re, err := regexp.Compile(anchor(expr))
+		if err != nil {
+			return false
+		}
+		return re.MatchString(value)
+	}
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+func anchor(expr string) string {
+	return fmt.Sprintf("^(?:%s)$", expr)
+}
+
+func (r Rule) MatchRole(role Role) bool {
+	if _, ok := r.Roles[role]; ok {
+		return true
+	}
+	for rl := range r.Roles {
+		if IsPattern(string(rl)) && MatchPattern(string(rl), string(role)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r Rule) MatchResource(resource Resource) bool {
+	if _, ok := r.Resources[resource]; ok {
+		return true
+	}
+	for rsc := range r.Resources {
+		if IsPattern(string(rsc)) && MatchPattern(string(rsc), string(resource)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks every pattern in the policy compiles, so a typo is caught when the config loads instead of silently never matching.
+// It also checks the rule's durations are in whole minutes, and that its approvals can actually be satisfied.
+func (p *PolicyRules) Validate() error {
+	// Every level can be a groups lookup per group, so the depth is kept small. 0 is the same as leaving it out.
+	if p.MaxGroupDepth < 0 || p.MaxGroupDepth > 10 {
+		return fmt.Errorf("max_group_depth %d isn't between 1 and 10, or 0 for the default of %d", p.MaxGroupDepth, DefaultMaxGroupDepth)
+	}
+	if p.MaxGroupDepth > 0 && !p.NestedGroups {
+		return fmt.Errorf("max_group_depth is set, but nested_groups isn't turned on")
+	}
+	for i, pol := range p.PolicyRules {
+		if err := validateDuration(pol.MaxDuration); err != nil {
+			return fmt.Errorf("rule %d: max_duration %v", i, err)
+		}
+		if err := validateDuration(pol.DefaultDuration); err != nil {
+			return fmt.Errorf("rule %d: default_duration %v", i, err)
+		}
+		if pol.MaxDuration > 0 && pol.DefaultDuration > pol.MaxDuration {
+			return fmt.Errorf("rule %d: default_duration %v is longer than max_duration %v", i, pol.DefaultDuration, pol.MaxDuration)
+		}
+		if err := validateDuration(pol.MaxCumulativeDuration); err != nil {
+			return fmt.Errorf("rule %d: max_cumulative_duration %v", i, err)
+		}
+		if pol.MaxDuration > 0 && pol.MaxCumulativeDuration > 0 && pol.MaxCumulativeDuration < pol.MaxDuration {
+			return fmt.Errorf("rule %d: max_cumulative_duration %v is shorter than max_duration %v", i, pol.MaxCumulativeDuration, pol.MaxDuration)
+		}
+		switch pol.ApprovalMode {
+		case "", PeerApproval, SelfApproval, AutoApproval:
+		default:
+			return fmt.Errorf("rule %d: unknown approval_mode %q", i, pol.ApprovalMode)
+		}
+		if pol.RequiredApprovals < 0 {
+			return fmt.Errorf("rule %d: required_approvals can't be negative", i)
+		}
+		// Auto approval grants without anyone approving, so a quorum would never be asked for
+		if pol.ApprovalMode == AutoApproval && pol.RequiredApprovals > 1 {
+			return fmt.Errorf("rule %d: approval_mode auto can't require %d approvals", i, pol.RequiredApprovals)
+		}
+		if pol.DistinctApproverGroups && len(pol.ApproverGroups) < max(pol.RequiredApprovals, 1) {
+			return fmt.Errorf("rule %d: distinct_approver_groups needs at least %d approver_groups", i, max(pol.RequiredApprovals, 1))
+		}
+		for rl := range pol.Roles {
+			if IsPattern(string(rl)) {
+				if err := ValidatePattern(string(rl)); err != nil {
+					return fmt.Errorf("rule %d: %v", i, err)
+				}
+			}
+		}
+		for rsc := range pol.Resources {
+			if IsPattern(string(rsc)) {
+				if err := ValidatePattern(string(rsc)); err != nil {
+					return fmt.Errorf("rule %d: %v", i, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func validateDuration(d Duration) error {
+	if d < 0 {
+		return fmt.Errorf("%v can't be negative", d)
+	}
+	if time.Duration(d)%time.Minute != 0 {
+		return fmt.Errorf("%v must be in whole minutes", d)
+	}
+	return nil
+}
+
+// Returns deduplicated lists of the role and resource patterns, these can't be offered as options so they're listed separately
+func (p *PolicyRules) ListPatterns() (map[string]struct{}, map[string]struct{}) {
+	roles := make(map[string]struct{})
+	resources := make(map[string]struct{})
+	for _, pol := range p.PolicyRules {
+		for rl := range pol.Roles {
+			if IsPattern(string(rl)) {
+				roles[string(rl)] = struct{}{}
+			}
+		}
+		for rsc := range pol.Resources {
+			if IsPattern(string(rsc)) {
+				resources[string(rsc)] = struct{}{}
+			}
+		}
+	}
+	return roles, resources
+}
@@ -0,0 +1,100 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		value    string
+		expected bool
+	}{
+		{"exact", "projects/prod-db", "projects/prod-db", true},
+		{"exact mismatch", "projects/prod-db", "projects/prod-db2", false},
+		{"glob", "projects/prod-*", "projects/prod-db", true},
+		{"glob doesn't match other prefixes", "projects/prod-*", "projects/staging-db", false},
+		{"glob doesn't cross a slash", "organizations/*", "organizations/0000000000/roles/hub_root", false},
+		{"glob single character", "folders/12?4", "folders/1234", true},
+		{"regex", "re:projects/prod-[a-z]+", "projects/prod-db", true},
+		{"regex is anchored at the start", "re:prod-[a-z]+", "projects/prod-db", false},
+		{"regex is anchored at the end", "re:projects/prod-[a-z]+", "projects/prod-db-2", false},
+		{"regex alternation is anchored", "re:projects/a|projects/b", "projects/bb", false},
+		{"invalid regex never matches", "re:projects/(", "projects/(", false},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MatchPattern(tt.pattern, tt.value); got != tt.expected {
+				t.Errorf("got %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    *PolicyRules
+		wantError bool
+	}{
+		{"valid patterns", &PolicyRules{PolicyRules: []Rule{{
+			Roles:     map[Role]struct{}{"re:roles/cloudsql\\.[a-z]+": {}},
+			Resources: map[Resource]struct{}{"projects/prod-*": {}, "projects/testing": {}},
+		}}}, false},
+		{"invalid regex role", &PolicyRules{PolicyRules: []Rule{{
+			Roles: map[Role]struct{}{"re:roles/(": {}},
+		}}}, true},
+		{"invalid glob resource", &PolicyRules{PolicyRules: []Rule{{
+			Resources: map[Resource]struct{}{"projects/[prod": {}},
+		}}}, true},
+		{"durations in minutes", &PolicyRules{PolicyRules: []Rule{{
+			MaxDuration:     Duration(90 * time.Minute),
+			DefaultDuration: Duration(30 * time.Minute),
+		}}}, false},
+		{"duration in seconds", &PolicyRules{PolicyRules: []Rule{{
+			MaxDuration: Duration(90 * time.Second),
+		}}}, true},
+		{"default longer than max", &PolicyRules{PolicyRules: []Rule{{
+			MaxDuration:     Duration(30 * time.Minute),
+			DefaultDuration: Duration(time.Hour),
+		}}}, true},
+		{"cumulative longer than max", &PolicyRules{PolicyRules: []Rule{{
+			MaxDuration:           Duration(time.Hour),
+			MaxCumulativeDuration: Duration(4 * time.Hour),
+		}}}, false},
+		{"cumulative shorter than max", &PolicyRules{PolicyRules: []Rule{{
+			MaxDuration:           Duration(time.Hour),
+			MaxCumulativeDuration: Duration(30 * time.Minute),
+		}}}, true},
+		{"nested groups", &PolicyRules{NestedGroups: true, MaxGroupDepth: 2}, false},
+		{"nested groups at the default depth", &PolicyRules{NestedGroups: true, MaxGroupDepth: 0}, false},
+		{"nested groups too deep", &PolicyRules{NestedGroups: true, MaxGroupDepth: 11}, true},
+		{"negative group depth", &PolicyRules{NestedGroups: true, MaxGroupDepth: -1}, true},
+		{"group depth without nested groups", &PolicyRules{MaxGroupDepth: 2}, true},
+		{"auto approval mode", &PolicyRules{PolicyRules: []Rule{{
+			ApprovalMode: AutoApproval,
+		}}}, false},
+		{"auto approval with a quorum", &PolicyRules{PolicyRules: []Rule{{
+			ApprovalMode:      AutoApproval,
+			RequiredApprovals: 2,
+		}}}, true},
+		{"unknown approval mode", &PolicyRules{PolicyRules: []Rule{{
+			ApprovalMode: "anyone",
+		}}}, true},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Validate()
+			if !tt.wantError && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if tt.wantError && err == nil {
+				t.Errorf("expected error not found")
+			}
+		})
+	}
+}
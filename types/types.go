@@ -1,7 +1,10 @@
 package types
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type Approval bool
@@ -18,30 +21,211 @@ func (a Approval) String() string {
 	return "Denier"
 }
 
-func (a Approval) ApprovalText(duration int) string {
+func (a Approval) ApprovalText(expiry string) string {
 	if a {
-		return fmt.Sprintf("Approved. The role has been granted for %v hours.", duration)
+		return fmt.Sprintf("Approved. The role has been granted until %s.", expiry)
 	}
 	return "The Request has been denied."
 }
 
+type ApprovalMode string
+
+const (
+	// Someone other than the requestor has to approve, this is the default
+	PeerApproval ApprovalMode = "peer"
+	// The requestor can approve their own request
+	SelfApproval ApprovalMode = "self"
+	// The role is granted as soon as the request is submitted, with an FYI posted to the channel
+	AutoApproval ApprovalMode = "auto"
+)
+
+// AutoApprover is recorded as the approver of auto approved requests
+const AutoApprover = "gcpsudobot"
+
 type Group string
 type Role string
 type Resource string
 type Requestor string
 type Groups map[Group]struct{}
 
+// Duration is written as a string like "90m" or "2h" in json
+type Duration time.Duration
+
+func (d Duration) String() string {
+	s := time.Duration(d).String()
+	// 1h30m0s reads better as 1h30m, and 2h0m0s as 2h
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"90m\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
 type Rule struct {
 	Groups    Groups                `json:"groups"`
 	Roles     map[Role]struct{}     `json:"roles"`
 	Resources map[Resource]struct{} `json:"resources"`
+	// Inherit lets the rule's resources cover any folder or project beneath them
+	Inherit bool `json:"inherit,omitempty"`
+	// Grants are limited to whole minutes. When they aren't set the configured DurationOfGrantInHours is used.
+	MaxDuration     Duration `json:"max_duration,omitempty"`
+	DefaultDuration Duration `json:"default_duration,omitempty"`
+	// How long a grant can last in total once it's been extended, from when it was first granted. Defaults to the max duration, so grants can't be extended past it.
+	MaxCumulativeDuration Duration `json:"max_cumulative_duration,omitempty"`
+	// Only members of these groups can approve requests under the rule. Without any, any user from the valid domain can.
+	ApproverGroups Groups `json:"approver_groups,omitempty"`
+	// How many different people have to approve before the role is granted, defaults to 1
+	RequiredApprovals int `json:"required_approvals,omitempty"`
+	// Each of the required approvals has to come through a different approver group
+	DistinctApproverGroups bool `json:"distinct_approver_groups,omitempty"`
+	// One of peer, self or auto. Defaults to peer.
+	ApprovalMode ApprovalMode `json:"approval_mode,omitempty"`
+	// Requirements on the requestor's Google Workspace account, checked each time the request is authorized
+	Require2SV    bool `json:"require_2sv,omitempty"`
+	DenySuspended bool `json:"deny_suspended,omitempty"`
+	DenyArchived  bool `json:"deny_archived,omitempty"`
+}
+
+// ChecksAccount reports whether the rule has any requirements on the requestor's account
+func (r Rule) ChecksAccount() bool {
+	return r.Require2SV || r.DenySuspended || r.DenyArchived
+}
+
+// AccountProblems is why an account doesn't meet the rule's requirements, nil when it does.
+// An account that wasn't looked up doesn't meet any of them.
+func (r Rule) AccountProblems(a *Account) []string {
+	if !r.ChecksAccount() {
+		return nil
+	}
+	if a == nil {
+		return []string{"the account couldn't be checked"}
+	}
+	var problems []string
+	if r.DenySuspended && a.Suspended {
+		problems = append(problems, "the account is suspended")
+	}
+	if r.DenyArchived && a.Archived {
+		problems = append(problems, "the account is archived")
+	}
+	if r.Require2SV && !a.EnrolledIn2SV {
+		problems = append(problems, "2-Step Verification isn't turned on")
+	}
+	return problems
+}
+
+// Mode is the rule's approval mode, with the default filled in
+func (r Rule) Mode() ApprovalMode {
+	if r.ApprovalMode == "" {
+		return PeerApproval
+	}
+	return r.ApprovalMode
+}
+
+// GrantMaxDuration is the longest a grant under this rule can last, fallback is used when the rule doesn't set one
+func (r Rule) GrantMaxDuration(fallback time.Duration) time.Duration {
+	if r.MaxDuration > 0 {
+		return time.Duration(r.MaxDuration)
+	}
+	return fallback
+}
+
+// GrantMaxCumulativeDuration is the longest a grant under this rule can last including its extensions
+func (r Rule) GrantMaxCumulativeDuration(fallback time.Duration) time.Duration {
+	if r.MaxCumulativeDuration > 0 {
+		return time.Duration(r.MaxCumulativeDuration)
+	}
+	return r.GrantMaxDuration(fallback)
+}
+
+// GrantDefaultDuration is how long a grant under this rule lasts when the requestor doesn't pick a duration
+func (r Rule) GrantDefaultDuration(fallback time.Duration) time.Duration {
+	if r.DefaultDuration > 0 {
+		return time.Duration(r.DefaultDuration)
+	}
+	return min(fallback, r.GrantMaxDuration(fallback))
 }
 
 type PolicyRules struct {
 	PolicyRules []Rule `json:"policy_rules"`
+	// NestedGroups lets a user match a rule's groups through the groups they're in, not just directly
+	NestedGroups bool `json:"nested_groups,omitempty"`
+	// MaxGroupDepth is how many levels of nesting are followed above the user's own groups
+	MaxGroupDepth int `json:"max_group_depth,omitempty"`
+	// What the slack accounts of requestors and approvers need, for every rule
+	RequestorPosture SlackPostureRequirements `json:"requestor_posture,omitempty"`
+	ApproverPosture  SlackPostureRequirements `json:"approver_posture,omitempty"`
 }
 
-// Returns deduplicated lists of groups, roles and resources
+// SlackPosture is what slack said about the account of someone who made or acted on a request, when they did
+type SlackPosture struct {
+	UserID string `json:"user_id"`
+	// The email on the slack account, which can differ from the google identity the posture is saved under
+	Email string `json:"email,omitempty"`
+	// Multi-channel or single-channel guests
+	Guest   bool `json:"guest,omitempty"`
+	Bot     bool `json:"bot,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+	Has2FA  bool `json:"has_2fa,omitempty"`
+}
+
+// SlackPostureRequirements are what a slack account needs, on top of not being a bot or deleted, which never can request or approve
+type SlackPostureRequirements struct {
+	DenyGuests bool `json:"deny_guests,omitempty"`
+	Require2FA bool `json:"require_2fa,omitempty"`
+}
+
+// Problems is why a slack account doesn't meet the requirements, nil when it does
+func (s SlackPostureRequirements) Problems(p SlackPosture) []string {
+	var problems []string
+	if p.Deleted {
+		problems = append(problems, "the slack account is deactivated")
+	}
+	if p.Bot {
+		problems = append(problems, "the slack account is a bot")
+	}
+	if s.DenyGuests && p.Guest {
+		problems = append(problems, "the slack account is a guest")
+	}
+	if s.Require2FA && !p.Has2FA {
+		problems = append(problems, "the slack account doesn't have two-factor authentication turned on")
+	}
+	return problems
+}
+
+// DefaultMaxGroupDepth is followed when nested groups are turned on without a max_group_depth
+const DefaultMaxGroupDepth = 3
+
+// GroupDepth is how many levels of nested groups to follow, 0 when nested groups are off
+func (p *PolicyRules) GroupDepth() int {
+	if !p.NestedGroups {
+		return 0
+	}
+	if p.MaxGroupDepth == 0 {
+		return DefaultMaxGroupDepth
+	}
+	return p.MaxGroupDepth
+}
+
+// Returns deduplicated lists of groups, roles and resources. Role and resource patterns aren't included.
 func (p *PolicyRules) ListOptions() (map[string]struct{}, map[string]struct{}, map[string]struct{}) {
 	groups := make(map[string]struct{})
 	roles := make(map[string]struct{})
@@ -51,31 +235,127 @@ func (p *PolicyRules) ListOptions() (map[string]struct{}, map[string]struct{}, m
 			groups[string(g)] = struct{}{}
 		}
 		for rl := range pol.Roles {
-			roles[string(rl)] = struct{}{}
+			if !IsPattern(string(rl)) {
+				roles[string(rl)] = struct{}{}
+			}
 		}
 		for rsc := range pol.Resources {
-			resources[string(rsc)] = struct{}{}
+			if !IsPattern(string(rsc)) {
+				resources[string(rsc)] = struct{}{}
+			}
 		}
 	}
 	return groups, roles, resources
 }
 
+// Inherits reports whether any rule covers the resources beneath its own
+func (p *PolicyRules) Inherits() bool {
+	for _, pol := range p.PolicyRules {
+		if pol.Inherit {
+			return true
+		}
+	}
+	return false
+}
+
+// ChecksAccounts reports whether any rule has requirements on the requestor's account, so it has to be looked up
+func (p *PolicyRules) ChecksAccounts() bool {
+	for _, pol := range p.PolicyRules {
+		if pol.ChecksAccount() {
+			return true
+		}
+	}
+	return false
+}
+
+// Account is the requestor's Google Workspace account, as it was when the request was last authorized
+type Account struct {
+	Suspended     bool `json:"suspended,omitempty"`
+	Archived      bool `json:"archived,omitempty"`
+	EnrolledIn2SV bool `json:"enrolled_in_2sv,omitempty"`
+}
+
 type EscalationRequest struct {
-	Requestor Requestor `json:"requestor"`
-	Groups    Groups    `json:"groups"`
-	Role      Role      `json:"role"`
-	Resource  Resource  `json:"resource"`
-	Reason    string    `json:"reason"`
-	Timestamp string    `json:"timestamp"`
+	// Generated when the request is saved to the store, it's all slack carries in the buttons
+	ID        string     `json:"id,omitempty"`
+	Requestor Requestor  `json:"requestor"`
+	Groups    Groups     `json:"groups"`
+	Role      Role       `json:"role"`
+	Resource  Resource   `json:"resource"`
+	Ancestors []Resource `json:"ancestors,omitempty"`
+	Reason    string     `json:"reason"`
+	Timestamp string     `json:"timestamp"`
+	// How long the role is granted for, resolved from the rule's default if the requestor didn't pick one
+	Duration Duration `json:"duration,omitempty"`
+	// Set when the request extends an active grant instead of making a new one.
+	// ExtensionOf is the ID of the request that's being extended, its binding expires at ExtendsExpiry, and the role was first granted at GrantedSince.
+	// The extension's Duration is added on to ExtendsExpiry.
+	ExtensionOf   string `json:"extension_of,omitempty"`
+	ExtendsExpiry string `json:"extends_expiry,omitempty"`
+	GrantedSince  string `json:"granted_since,omitempty"`
+	// Group lookups that came from the cache because the directory couldn't be reached, with when they were cached
+	StaleGroups []string `json:"stale_groups,omitempty"`
+	// Only looked up when a rule has requirements on the requestor's account
+	Account *Account `json:"account,omitempty"`
+	// The slack accounts of whoever made or acted on the request, by their email
+	SlackPostures map[string]SlackPosture `json:"slack_postures,omitempty"`
+}
+
+// IsExtension reports whether the request extends an existing grant
+func (r *EscalationRequest) IsExtension() bool {
+	return r.ExtensionOf != ""
+}
+
+// ExtendedExpiry is when the grant will expire once the extension is approved
+func (r *EscalationRequest) ExtendedExpiry() (time.Time, error) {
+	expiry, err := time.Parse(time.RFC3339, r.ExtendsExpiry)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry of the grant being extended: %v", err)
+	}
+	return expiry.Add(time.Duration(r.Duration)), nil
+}
+
+// CumulativeDuration is how long the grant will have lasted in total once the extension is approved
+func (r *EscalationRequest) CumulativeDuration() (time.Duration, error) {
+	expiry, err := r.ExtendedExpiry()
+	if err != nil {
+		return 0, err
+	}
+	since, err := time.Parse(time.RFC3339, r.GrantedSince)
+	if err != nil {
+		return 0, fmt.Errorf("invalid start of the grant being extended: %v", err)
+	}
+	return expiry.Sub(since), nil
 }
 
 type EscalationApproval struct {
 	*EscalationRequest
 	Approver string   `json:"approver"`
 	Status   Approval `json:"status"`
+	// Set in RFC3339 once the role has been granted
+	Expiry string `json:"expiry,omitempty"`
+	// Everyone who has approved so far, including the current approver once they're authorized
+	Approvals          []string `json:"approvals,omitempty"`
+	ApprovalsRemaining int      `json:"approvals_remaining,omitempty"`
+	// Which approval mode the approval was made under
+	Mode ApprovalMode `json:"mode,omitempty"`
+	// The nonce of the button that was clicked, it isn't stored with the request
+	Nonce string `json:"-"`
+	// The slack message for the request, so it can be updated outside of a button click
+	Channel   string `json:"channel,omitempty"`
+	MessageTS string `json:"message_ts,omitempty"`
+	// Where the request is in its lifecycle, and every transition that got it there
+	State   State        `json:"state,omitempty"`
+	History []Transition `json:"history,omitempty"`
+	// Incremented by every update in the store, an update made from an older copy is refused
+	Version int `json:"version,omitempty"`
 }
 
 func (e EscalationApproval) String() string {
-	return fmt.Sprintf("[AUDIT], Requestor: %s, Role: %s, Resource: %s, When: %s, Reason: %s, %s: %s", e.Requestor,
-		e.Role, e.Resource, e.Timestamp, e.Reason, e.Status.String(), e.Approver)
+	s := fmt.Sprintf("[AUDIT], Requestor: %s, Role: %s, Resource: %s, When: %s, Reason: %s, Duration: %s, %s: %s, Mode: %s, State: %s", e.Requestor,
+		e.Role, e.Resource, e.Timestamp, e.Reason, e.Duration, e.Status.String(), e.Approver, e.Mode, e.CurrentState())
+	if len(e.StaleGroups) > 0 {
+		s += fmt.Sprintf(", Stale groups: %s", strings.Join(e.StaleGroups, "; "))
+	}
+	return s
 }